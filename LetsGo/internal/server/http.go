@@ -2,11 +2,19 @@ package server
 
 import (
 	"encoding/json"
+	"io"
+	"mime"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
 
+const (
+	contentTypeJSON        = "application/json"
+	contentTypeOctetStream = "application/octet-stream"
+)
+
 // NewHTTPServer は、新しいHTTPサーバーを指定されたアドレスで初期化して返します。
 // POSTメソッドでのプロデュース処理、およびGETメソッドでのコンシューム処理を提供します。
 func NewHTTPServer(addr string) *http.Server {
@@ -59,14 +67,27 @@ type ConsumeResponse struct {
 }
 
 // handleProduce はHTTPリクエストからレコードをデコードし、ログに追加してオフセットを応答として返します。
+// Content-Type が application/octet-stream の場合はリクエストボディ全体をレコードの値として扱い、
+// それ以外の場合は Content-Type によらず従来どおり ProduceRequest の JSON としてデコードします。
 func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	var req ProduceRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	switch contentType(r.Header.Get("Content-Type")) {
+	case contentTypeOctetStream:
+		value, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Record.Value = value
+	default:
+		// curl -d が付ける application/x-www-form-urlencoded なども、従来どおり JSON として扱う
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 	off, err := s.Log.Append(req.Record)
 	if err != nil {
@@ -74,6 +95,7 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	res := ProduceResponse{Offset: off}
+	w.Header().Set("Content-Type", contentTypeJSON)
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -85,9 +107,15 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 // リクエストボディをConsumeRequest構造体としてデコードし、ログから対応するレコードを取得します。
 // オフセットが無効な場合は404エラー、有効でない場合は500エラーを返します。
 // 正常時にConsumeResponse構造体としてログレコードをJSONエンコードしてレスポンスします。
+// Accept で application/octet-stream が指定された場合は、レコードの値をそのままレスポンスボディとして返します。
 func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
+	accept, ok := negotiate(r.Header.Get("Accept"))
+	if !ok {
+		http.Error(w, "unsupported accept type", http.StatusNotAcceptable)
+		return
+	}
 	var req ConsumeRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
@@ -103,10 +131,44 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if accept == contentTypeOctetStream {
+		w.Header().Set("Content-Type", contentTypeOctetStream)
+		if _, err = w.Write(record.Value); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
 	res := ConsumeResponse{Record: record}
+	w.Header().Set("Content-Type", contentTypeJSON)
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
+
+// contentType はヘッダー値からパラメーターを除いたメディアタイプを返します。解析できない場合はヘッダー値をそのまま返します。
+func contentType(header string) string {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return header
+	}
+	return mediaType
+}
+
+// negotiate は Accept ヘッダーから応答に使用するメディアタイプを決定します。
+// 未指定またはワイルドカードの場合は JSON を選択し、対応するメディアタイプがない場合は false を返します。
+func negotiate(accept string) (string, bool) {
+	if accept == "" {
+		return contentTypeJSON, true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		switch contentType(strings.TrimSpace(part)) {
+		case contentTypeJSON, "application/*", "*/*":
+			return contentTypeJSON, true
+		case contentTypeOctetStream:
+			return contentTypeOctetStream, true
+		}
+	}
+	return "", false
+}
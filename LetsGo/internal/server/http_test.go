@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestOctetStreamProduceConsume は application/octet-stream でバイナリの値を書き込み、
+// 同じメディアタイプを Accept に指定して読み出した値が一致することを検証します。
+func TestOctetStreamProduceConsume(t *testing.T) {
+	srv := httptest.NewServer(NewHTTPServer("").Handler)
+	defer srv.Close()
+
+	value := []byte{0x00, 0xff, 0x10, 0x80, 0x7f}
+	res, err := http.Post(srv.URL, contentTypeOctetStream, bytes.NewReader(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var produce ProduceResponse
+	if err = json.NewDecoder(res.Body).Decode(&produce); err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+
+	body, err := json.Marshal(ConsumeRequest{Offset: produce.Offset})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, srv.URL, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", contentTypeOctetStream)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if got := res.Header.Get("Content-Type"); got != contentTypeOctetStream {
+		t.Fatalf("got content type: %s, want: %s", got, contentTypeOctetStream)
+	}
+	got, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Fatalf("got value: %v, want: %v", got, value)
+	}
+}
+
+// TestJSONIsDefault は Content-Type と Accept を指定しない場合や、Content-Type が application/octet-stream 以外の場合に、
+// 従来どおり JSON で読み書きできることを検証します。
+func TestJSONIsDefault(t *testing.T) {
+	srv := httptest.NewServer(NewHTTPServer("").Handler)
+	defer srv.Close()
+
+	body, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte("hello world")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Post(srv.URL, "", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	// curl -d と同じ Content-Type でも JSON として受け付ける
+	res, err = http.Post(srv.URL, "application/x-www-form-urlencoded", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status: %d, want: %d", res.StatusCode, http.StatusOK)
+	}
+
+	body, err = json.Marshal(ConsumeRequest{Offset: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, srv.URL, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	var consume ConsumeResponse
+	if err = json.NewDecoder(res.Body).Decode(&consume); err != nil {
+		t.Fatal(err)
+	}
+	if string(consume.Record.Value) != "hello world" {
+		t.Fatalf("got value: %s, want: hello world", consume.Record.Value)
+	}
+}
@@ -3,6 +3,7 @@ package v1
 import (
 	"fmt"
 	"google.golang.org/grpc/codes"
+	"strconv"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/status"
@@ -36,3 +37,60 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrInvalidArgument struct {
+	Field  string
+	Reason string
+}
+
+func (e ErrInvalidArgument) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid %s: %s", e.Field, e.Reason),
+	)
+	d := &errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+			Field:       e.Field,
+			Description: e.Reason,
+		}},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrInvalidArgument) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrOutOfSequence struct {
+	Header   string
+	Expected uint64
+	Got      uint64
+}
+
+func (e ErrOutOfSequence) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("out of sequence %s: expected %d, got %d", e.Header, e.Expected, e.Got),
+	)
+	d := &errdetails.ErrorInfo{
+		Reason: "OUT_OF_SEQUENCE",
+		Metadata: map[string]string{
+			"header":   e.Header,
+			"expected": strconv.FormatUint(e.Expected, 10),
+			"got":      strconv.FormatUint(e.Got, 10),
+		},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOutOfSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -0,0 +1,21 @@
+package v1
+
+// StreamEndReasonKey は、ConsumeStream や ProduceStream が終了した理由を格納するトレーラーメタデータのキーです。
+const StreamEndReasonKey = "stream-end-reason"
+
+// ConsumeStream が終了した理由としてトレーラーに設定される値です。
+const (
+	// StreamEndReached は、EndOffset まで送信し終えたことを表します。
+	StreamEndReached = "end_reached"
+	// StreamEndTruncated は、読み出す予定のオフセットがログの切り詰めで削除されたことを表します。
+	StreamEndTruncated = "truncated"
+	// StreamEndUnauthorized は、ストリームの途中で読み出しの権限がなくなったことを表します。
+	StreamEndUnauthorized = "unauthorized"
+	// StreamEndShuttingDown は、サーバーが停止処理中であることを表します。
+	StreamEndShuttingDown = "shutting_down"
+	// StreamEndMaxDuration は、ストリームがサーバーの許可する最大の時間に達したことを表します。
+	// ProduceStream の終了時にも設定されます。
+	StreamEndMaxDuration = "max_duration"
+	// StreamEndSendTimeout は、クライアントが受信しないためにレコードを StreamSendTimeout 以内に送信できなかったことを表します。
+	StreamEndSendTimeout = "send_timeout"
+)
@@ -4,12 +4,17 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	api "github.com/ishisaka/go_distribute/proglog/api/v1"
 	"github.com/ishisaka/go_distribute/proglog/internal/auth"
@@ -24,9 +29,12 @@ type Agent struct {
 	Config
 
 	log        *log.Log
+	auditLog   *log.Log
 	server     *grpc.Server
 	membership *discovery.Membership
 	replicator *log.Replicator
+	health     *health.Server
+	logLevel   zap.AtomicLevel
 
 	shutdown     bool
 	shutdowns    chan struct{}
@@ -34,21 +42,55 @@ type Agent struct {
 }
 
 // Config はシステムの設定情報を格納するための構造体です。
+// Listener を設定すると、RPCPort で新たに待ち受ける代わりにそのリスナーで RPC を受け付けます。
+// 旧プロセスから引き継いだソケットを使い、同じポートのまま新しいバイナリへ切り替える場合に使用します。
+// Role を設定すると、そのロールをメンバーシップの role タグで公開し、RoleLeader のノードだけから複製します。
+// フォロワー同士は互いに複製しません。空の場合は全てのピアから複製します。
+// AuditDir は管理操作の監査ログを保存するディレクトリです。空の場合は DataDir と同じ階層の DataDir-audit を使用します。
+// ログの削除や移動で監査ログが失われないように、DataDir の外に置きます。
+// RPC のポートでは gRPC のヘルスチェックサービスを提供します。MaxReplicationLag を設定すると、複製元の最大オフセットとの差が
+// MaxReplicationLag を超えた状態が ReplicationLagWindow（0 の場合はデフォルト値）以上続いている間、
+// ヘルスチェックの状態を NOT_SERVING にし、遅延が解消されると SERVING に戻します。
 type Config struct {
-	ServerTLSConfig *tls.Config
-	PeerTLSConfig   *tls.Config
-	DataDir         string
-	BindAddr        string
-	RPCPort         int
-	NodeName        string
-	StartJoinAddrs  []string
-	ACLModelFile    string
-	ACLPolicyFile   string
+	ServerTLSConfig      *tls.Config
+	PeerTLSConfig        *tls.Config
+	DataDir              string
+	BindAddr             string
+	RPCPort              int
+	NodeName             string
+	StartJoinAddrs       []string
+	ACLModelFile         string
+	ACLPolicyFile        string
+	Listener             net.Listener
+	Role                 string
+	AuditDir             string
+	MaxReplicationLag    uint64
+	ReplicationLagWindow time.Duration
 }
 
+// AuditLogDir は監査ログを保存するディレクトリを返します。AuditDir が空の場合は DataDir と同じ階層のディレクトリを返します。
+func (c Config) AuditLogDir() string {
+	if c.AuditDir != "" {
+		return c.AuditDir
+	}
+	return filepath.Clean(c.DataDir) + "-audit"
+}
+
+const (
+	// RoleLeader は、フォロワーの複製元になるノードのロールです。
+	RoleLeader = "leader"
+	// RoleFollower は、リーダーからだけ複製するノードのロールです。
+	RoleFollower = "follower"
+	// roleTag は、ノードのロールを公開するメンバーシップのタグ名です。
+	roleTag = "role"
+)
+
 // RPCAddr は Config 構造体の BindAddr フィールドと RPCPort フィールドから RPC アドレスの文字列を生成して返します。
-// Host とポートの分離に失敗した場合、エラーを返します。
+// Host とポートの分離に失敗した場合、エラーを返します。Listener が設定されている場合はそのアドレスを返します。
 func (c Config) RPCAddr() (string, error) {
+	if c.Listener != nil {
+		return c.Listener.Addr().String(), nil
+	}
 	host, _, err := net.SplitHostPort(c.BindAddr)
 	if err != nil {
 		return "", err
@@ -77,8 +119,11 @@ func New(config Config) (*Agent, error) {
 }
 
 // setupLogger は、開発用の logger を初期化し、グローバルロガーとして設定します。エラーが発生した場合は返します。
+// ログレベルは実行中に SetLogLevel で変更できるように保持します。
 func (a *Agent) setupLogger() error {
-	logger, err := zap.NewDevelopment()
+	config := zap.NewDevelopmentConfig()
+	a.logLevel = config.Level
+	logger, err := config.Build()
 	if err != nil {
 		return err
 	}
@@ -89,10 +134,20 @@ func (a *Agent) setupLogger() error {
 // setupLog はログシステムを初期化し、エージェント内で使用可能にします。初期化に失敗した場合はエラーを返します。
 func (a *Agent) setupLog() error {
 	var err error
+	// レプリカの AckReplica から求めたハイウォーターマークを記録する
 	a.log, err = log.NewLog(
 		a.DataDir,
-		log.Config{},
+		log.Config{TrackHighWatermark: true},
 	)
+	if err != nil {
+		return err
+	}
+	// 管理操作の監査ログは、通常のログのディレクトリの外にある別のストアに記録する
+	auditDir := a.AuditLogDir()
+	if err = os.MkdirAll(auditDir, 0700); err != nil {
+		return err
+	}
+	a.auditLog, err = log.NewLog(auditDir, log.Config{})
 	return err
 }
 
@@ -103,35 +158,79 @@ func (a *Agent) setupServer() error {
 		a.ACLPolicyFile,
 	)
 	serverConfig := &server.Config{
-		CommitLog:  a.log,
-		Authorizer: authorizer,
+		CommitLog:      a.log,
+		Authorizer:     authorizer,
+		AuditLog:       a.auditLog,
+		LogLevel:       &a.logLevel,
+		ClusterMembers: a.clusterMembers,
+		ReplicaNames:   a.replicaNames,
+		Shutdown:       a.shutdowns,
+	}
+	if a.PeerTLSConfig != nil {
+		serverConfig.PeerDialOptions = []grpc.DialOption{
+			grpc.WithTransportCredentials(credentials.NewTLS(a.PeerTLSConfig)),
+		}
 	}
 	var opts []grpc.ServerOption
 	if a.ServerTLSConfig != nil {
 		creds := credentials.NewTLS(a.ServerTLSConfig)
 		opts = append(opts, grpc.Creds(creds))
 	}
+	// ヘルスチェックは Log と同じポートで提供し、複製の遅延に応じて状態を切り替える
+	a.health = health.NewServer()
 	var err error
-	a.server, err = server.NewGRPCServer(serverConfig, opts...)
+	a.server, err = server.NewGRPCServerWith(serverConfig, func(gsrv *grpc.Server) {
+		healthpb.RegisterHealthServer(gsrv, a.health)
+	}, opts...)
 	if err != nil {
 		return err
 	}
-	rpcAddr, err := a.RPCAddr()
-	if err != nil {
-		return err
-	}
-	ln, err := net.Listen("tcp", rpcAddr)
-	if err != nil {
-		return err
+	ln := a.Listener
+	if ln == nil {
+		rpcAddr, err := a.RPCAddr()
+		if err != nil {
+			return err
+		}
+		if ln, err = net.Listen("tcp", rpcAddr); err != nil {
+			return err
+		}
 	}
 	go func() {
-		if err := a.server.Serve(ln); err != nil {
+		if err := a.server.Serve(server.WrapListener(serverConfig, ln)); err != nil {
 			_ = a.Shutdown()
 		}
 	}()
 	return err
 }
 
+// clusterMembers はクラスターのメンバーのノード名と RPC アドレスを返します。
+// メンバーシップの初期化前に呼び出された場合は空の一覧を返します。
+func (a *Agent) clusterMembers() map[string]string {
+	members := make(map[string]string)
+	if a.membership == nil {
+		return members
+	}
+	for _, m := range a.membership.Members() {
+		members[m.Name] = m.Tags["rpc_addr"]
+	}
+	return members
+}
+
+// replicaNames はこのノードから複製する他のメンバーのノード名を返します。
+// フォロワーから複製するノードはないため、フォロワーの場合とメンバーシップの初期化前は空の一覧を返します。
+func (a *Agent) replicaNames() []string {
+	if a.membership == nil || a.Role == RoleFollower {
+		return nil
+	}
+	var names []string
+	for _, m := range a.membership.Members() {
+		if m.Name != a.NodeName {
+			names = append(names, m.Name)
+		}
+	}
+	return names
+}
+
 // setupMembership メソッドはメンバーシップ管理を初期化し、分散システムのノード間通信を可能にします。
 // RPC アドレスを取得し、TLS 設定も考慮した gRPC 接続を作成します。
 // replicator と discovery パッケージを用いてノードの同期および参加を構成します。
@@ -153,20 +252,42 @@ func (a *Agent) setupMembership() error {
 	}
 	client := api.NewLogClient(conn)
 	a.replicator = &log.Replicator{
-		DialOptions: opts,
-		LocalServer: client,
+		DialOptions:    opts,
+		LocalServer:    client,
+		CheckpointPath: filepath.Join(a.DataDir, "replication.checkpoint"),
+		AckName:        a.NodeName,
+		MaxLag:         a.MaxReplicationLag,
+		LagWindow:      a.ReplicationLagWindow,
+		OnHealthChange: a.setHealth,
 	}
-	a.membership, err = discovery.New(a.replicator, discovery.Config{
+	membershipConfig := discovery.Config{
 		NodeName: a.NodeName,
 		BindAddr: a.BindAddr,
 		Tags: map[string]string{
 			"rpc_addr": rpcAddr,
 		},
 		StartJoinAddrs: a.StartJoinAddrs,
-	})
+	}
+	if a.Role != "" {
+		// リーダー・フォロワー構成では、リーダーのタグを持つノードからだけ複製する
+		membershipConfig.Tags[roleTag] = a.Role
+		membershipConfig.JoinFilter = func(tags map[string]string) bool {
+			return tags[roleTag] == RoleLeader
+		}
+	}
+	a.membership, err = discovery.New(a.replicator, membershipConfig)
 	return err
 }
 
+// setHealth は複製の遅延の状態 healthy をヘルスチェックのサーバー全体の状態に反映します。
+func (a *Agent) setHealth(healthy bool) {
+	status := healthpb.HealthCheckResponse_SERVING
+	if !healthy {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	a.health.SetServingStatus("", status)
+}
+
 // Shutdown メソッドはエージェントの安全な終了処理を行います。
 // すべてのサブコンポーネントの停止とリソース開放を処理します。
 // 複数回の呼び出しに対しても安全に動作します。
@@ -180,6 +301,11 @@ func (a *Agent) Shutdown() error {
 	close(a.shutdowns)
 
 	shutdown := []func() error{
+		func() error {
+			// 停止中のノードに新しいリクエストが振り分けられないようにする
+			a.health.Shutdown()
+			return nil
+		},
 		a.membership.Leave,
 		a.replicator.Close,
 		func() error {
@@ -187,6 +313,7 @@ func (a *Agent) Shutdown() error {
 			return nil
 		},
 		a.log.Close,
+		a.auditLog.Close,
 	}
 	for _, fn := range shutdown {
 		if err := fn(); err != nil {
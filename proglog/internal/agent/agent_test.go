@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"os"
 	"testing"
 	"time"
@@ -11,10 +12,14 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 
 	api "github.com/ishisaka/go_distribute/proglog/api/v1"
 	"github.com/ishisaka/go_distribute/proglog/internal/config"
+	"github.com/ishisaka/go_distribute/proglog/internal/log"
 )
 
 func TestAgent(t *testing.T) {
@@ -79,6 +84,11 @@ func TestAgent(t *testing.T) {
 			require.NoError(t,
 				os.RemoveAll(agent.DataDir),
 			)
+			// 監査ログはログのディレクトリの外にあるため、ログを削除しても残る
+			require.DirExists(t, agent.AuditLogDir())
+			require.NoError(t,
+				os.RemoveAll(agent.AuditLogDir()),
+			)
 		}
 	}()
 	// 3秒待つ
@@ -116,6 +126,19 @@ func TestAgent(t *testing.T) {
 	)
 	require.NoError(t, err)
 	require.Equal(t, consumeResponse.Record.Value, []byte("foo"))
+
+	// 全てのノードのオフセットの範囲を 1 回の問い合わせで取得できる
+	offsets, err := leaderClient.GetClusterOffsets(
+		context.Background(),
+		&api.GetClusterOffsetsRequest{},
+	)
+	require.NoError(t, err)
+	require.Len(t, offsets.Nodes, len(agents))
+	for _, agent := range agents {
+		node, ok := offsets.Nodes[agent.NodeName]
+		require.True(t, ok)
+		require.Empty(t, node.Error)
+	}
 }
 
 // client 関数は、指定されたエージェントおよび TLS 設定を使用して gRPC を介した Log サービスのクライアントを作成します。
@@ -138,3 +161,219 @@ func client(
 	client := api.NewLogClient(conn)
 	return client
 }
+
+// TestAgentListener は、外部で作成したリスナーを渡したエージェントがそのリスナーで RPC を受け付けることを検証します。
+func TestAgentListener(t *testing.T) {
+	ln, err := ListenerFromEnv()
+	require.NoError(t, err)
+	require.Nil(t, ln)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	agent, err := New(Config{
+		NodeName:        "0",
+		BindAddr:        fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]),
+		DataDir:         t.TempDir(),
+		ACLModelFile:    config.ACLModelFile,
+		ACLPolicyFile:   config.ACLPolicyFile,
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   peerTLSConfig,
+		Listener:        ln,
+	})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, agent.Shutdown()) }()
+
+	rpcAddr, err := agent.RPCAddr()
+	require.NoError(t, err)
+	require.Equal(t, ln.Addr().String(), rpcAddr)
+
+	client := client(t, agent, peerTLSConfig)
+	produce, err := client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("foo")},
+	})
+	require.NoError(t, err)
+	consume, err := client.Consume(context.Background(), &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), consume.Record.Value)
+}
+
+// TestAgentLeaderFollower は、リーダー 1 台とフォロワー 2 台の構成で、フォロワーがリーダーからだけ複製し、
+// フォロワー同士やリーダーがフォロワーから複製しないことを検証します。
+func TestAgentLeaderFollower(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	var agents []*Agent
+	for i, role := range []string{RoleLeader, RoleFollower, RoleFollower} {
+		ports := dynaport.Get(2)
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].BindAddr)
+		}
+		agent, err := New(Config{
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:         ports[1],
+			DataDir:         t.TempDir(),
+			ACLModelFile:    config.ACLModelFile,
+			ACLPolicyFile:   config.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			Role:            role,
+		})
+		require.NoError(t, err)
+		agents = append(agents, agent)
+	}
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+		}
+	}()
+	time.Sleep(3 * time.Second)
+
+	// フォロワーに先に書き込み、リーダーのレコードがその後ろに複製されるようにする
+	ctx := context.Background()
+	_, err = client(t, agents[1], peerTLSConfig).Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("from follower")},
+	})
+	require.NoError(t, err)
+	leaderClient := client(t, agents[0], peerTLSConfig)
+	_, err = leaderClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("from leader")},
+	})
+	require.NoError(t, err)
+	// レプリケーションが完了するまで待つ
+	time.Sleep(3 * time.Second)
+
+	// 書き込みを受けたフォロワーは、自身のレコードに続けてリーダーのレコードを複製している
+	consume, err := client(t, agents[1], peerTLSConfig).Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("from leader"), consume.Record.Value)
+
+	// もう一方のフォロワーはリーダーのレコードだけを複製している
+	followerClient := client(t, agents[2], peerTLSConfig)
+	consume, err = followerClient.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte("from leader"), consume.Record.Value)
+	_, err = followerClient.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// リーダーはフォロワーのレコードを複製しない
+	_, err = leaderClient.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+// TestAgentReplicationLagHealth は、MaxReplicationLag を設定したフォロワーが、レコードを溜めたリーダーから複製を始めて
+// 遅延が MaxReplicationLag を超えるとヘルスチェックの状態を NOT_SERVING にし、追いつくと SERVING に戻すことを検証します。
+func TestAgentReplicationLagHealth(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	// リーダーのログには、フォロワーが参加する前からレコードを溜めておく
+	const n = 50
+	leaderDir := t.TempDir()
+	clog, err := log.NewLog(leaderDir, log.Config{})
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		_, err = clog.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, clog.Close())
+
+	newAgent := func(name, role, dataDir string, startJoinAddrs []string) *Agent {
+		ports := dynaport.Get(2)
+		agent, err := New(Config{
+			NodeName:             name,
+			StartJoinAddrs:       startJoinAddrs,
+			BindAddr:             fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:              ports[1],
+			DataDir:              dataDir,
+			ACLModelFile:         config.ACLModelFile,
+			ACLPolicyFile:        config.ACLPolicyFile,
+			ServerTLSConfig:      serverTLSConfig,
+			PeerTLSConfig:        peerTLSConfig,
+			Role:                 role,
+			MaxReplicationLag:    10,
+			ReplicationLagWindow: time.Nanosecond,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { require.NoError(t, agent.Shutdown()) })
+		return agent
+	}
+	follower := newAgent("follower", RoleFollower, t.TempDir(), nil)
+
+	rpcAddr, err := follower.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.NewClient(rpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	watch, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	next := func() healthpb.HealthCheckResponse_ServingStatus {
+		res, err := watch.Recv()
+		require.NoError(t, err)
+		return res.Status
+	}
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, next())
+
+	newAgent("leader", RoleLeader, leaderDir, []string{follower.BindAddr})
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, next())
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, next())
+
+	// 遅延が MaxReplicationLag 以下になった時点で SERVING に戻るため、末尾のレコードは少し遅れて届く
+	followerClient := client(t, follower, peerTLSConfig)
+	require.Eventually(t, func() bool {
+		consume, err := followerClient.Consume(ctx, &api.ConsumeRequest{Offset: n - 1})
+		return err == nil && consume.Record.Offset == n-1
+	}, 10*time.Second, 50*time.Millisecond)
+}
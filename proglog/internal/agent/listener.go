@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart は、引き継がれたソケットに割り当てられる最初のファイルディスクリプターです。
+const listenFDsStart = 3
+
+// ListenerFromEnv は、systemd のソケットアクティベーションと同じ LISTEN_PID と LISTEN_FDS の環境変数で
+// 親プロセスから引き継いだリスナーを返します。引き継いだソケットがない場合は nil を返します。
+// 返したリスナーは Config.Listener に設定して使用します。
+func ListenerFromEnv() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	f := os.NewFile(listenFDsStart, "listener")
+	defer func() { _ = f.Close() }()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited fd %d is not a listener: %w", listenFDsStart, err)
+	}
+	return ln, nil
+}
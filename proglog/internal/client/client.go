@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// ClientConfig はクライアントの接続設定を保持する構造体です。
+// TLSConfig が nil の場合は TLS を使用せずに接続します。
+// DialTimeout を設定すると、New は接続が確立するまで最大でその時間だけ待機し、確立できなければエラーを返します。
+// 0 の場合は接続を待たずに返し、最初の RPC 呼び出し時に接続します。
+// HandshakeTimeout は 1 回の接続試行（TLS ハンドシェイクを含む）に許可する時間で、0 の場合は gRPC のデフォルトを使用します。
+// WaitForReady を有効にすると、RPC 呼び出しは接続が準備できるまで待機してから実行されます。
+// ConsumePageSize は ConsumeAll が 1 回の ConsumeBatch で読み出すレコード数で、0 の場合はデフォルト値を使用します。
+// nolint:revive
+type ClientConfig struct {
+	TLSConfig        *tls.Config
+	DialTimeout      time.Duration
+	HandshakeTimeout time.Duration
+	WaitForReady     bool
+	ConsumePageSize  uint32
+}
+
+// defaultConsumePageSize は ConsumePageSize が未設定の場合に ConsumeAll が 1 回で読み出すレコード数です。
+const defaultConsumePageSize = 100
+
+// Client は Log サービスの gRPC クライアントをラップする構造体です。
+// api.LogClient を埋め込み、接続のライフサイクルを管理します。
+type Client struct {
+	api.LogClient
+	conn     *grpc.ClientConn
+	pageSize uint32
+}
+
+// New は addr の Log サービスに接続するクライアントを作成します。
+// DialTimeout が設定されている場合、時間内に接続が確立できなければエラーを返します。
+func New(addr string, config ClientConfig) (*Client, error) {
+	creds := insecure.NewCredentials()
+	if config.TLSConfig != nil {
+		creds = credentials.NewTLS(config.TLSConfig)
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if config.HandshakeTimeout > 0 {
+		opts = append(opts, grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.DefaultConfig,
+			MinConnectTimeout: config.HandshakeTimeout,
+		}))
+	}
+	if config.WaitForReady {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.WaitForReady(true)))
+	}
+	conn, err := grpc.NewClient(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if config.DialTimeout > 0 {
+		if err = waitForReady(conn, config.DialTimeout); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to connect to %s within %s: %w", addr, config.DialTimeout, err)
+		}
+	}
+	pageSize := config.ConsumePageSize
+	if pageSize == 0 {
+		pageSize = defaultConsumePageSize
+	}
+	return &Client{
+		LogClient: api.NewLogClient(conn),
+		conn:      conn,
+		pageSize:  pageSize,
+	}, nil
+}
+
+// waitForReady は接続を開始し、timeout 以内に接続が Ready 状態になるまで待機します。
+func waitForReady(conn *grpc.ClientConn, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		if state == connectivity.Ready {
+			return nil
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return ctx.Err()
+		}
+	}
+}
+
+// Close はクライアントの接続を閉じます。
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// ConsumeAll はオフセット from から to の直前までのレコードを、ConsumeBatch で複数回に分けて読み出して返します。
+// 範囲が大きい場合は、全てのレコードをメモリに保持しない ConsumeAllFunc を使用してください。
+func (c *Client) ConsumeAll(ctx context.Context, from, to uint64) ([]*api.Record, error) {
+	var records []*api.Record
+	err := c.ConsumeAllFunc(ctx, from, to, func(record *api.Record) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// ConsumeAllFunc はオフセット from から to の直前までのレコードを ConsumeBatch で複数回に分けて読み出し、
+// 1 件ずつオフセットの順に fn に渡します。fn がエラーを返した場合は読み出しを中止してそのエラーを返します。
+// to に達する前にログの末尾に達した場合は、読み出せなかった最初のオフセットの api.ErrOffsetOutOfRange を返します。
+func (c *Client) ConsumeAllFunc(
+	ctx context.Context,
+	from, to uint64,
+	fn func(*api.Record) error,
+) error {
+	for off := from; off < to; {
+		limit := c.pageSize
+		if rest := to - off; rest < uint64(limit) {
+			limit = uint32(rest)
+		}
+		res, err := c.ConsumeBatch(ctx, &api.ConsumeBatchRequest{
+			Offset:     off,
+			MaxRecords: limit,
+		})
+		if err != nil {
+			return err
+		}
+		if len(res.Records) == 0 {
+			return api.ErrOffsetOutOfRange{Offset: off}
+		}
+		for _, record := range res.Records {
+			if err = fn(record); err != nil {
+				return err
+			}
+		}
+		off += uint64(len(res.Records))
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+	"github.com/ishisaka/go_distribute/proglog/internal/log"
+	"github.com/ishisaka/go_distribute/proglog/internal/server"
+)
+
+// TestNewDialTimeout は待ち受けていないアドレスへの接続が DialTimeout で打ち切られ、速やかにエラーになることを検証します。
+func TestNewDialTimeout(t *testing.T) {
+	addr := fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0])
+
+	start := time.Now()
+	c, err := New(addr, ClientConfig{
+		DialTimeout:      200 * time.Millisecond,
+		HandshakeTimeout: 100 * time.Millisecond,
+	})
+	require.Error(t, err)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Nil(t, c)
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+// TestNewConnects は待ち受けているサーバーに対して DialTimeout 内に接続できることを検証します。
+func TestNewConnects(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	defer srv.Stop()
+
+	c, err := New(l.Addr().String(), ClientConfig{
+		DialTimeout:  time.Second,
+		WaitForReady: true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+}
+
+// TestConsumeAll は、1000 件の範囲を小さなページに分けて読み出し、全てのレコードが順番どおりに 1 回ずつ届くことを検証します。
+func TestConsumeAll(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer func() { _ = clog.Close() }()
+	for i := 0; i < 1000; i++ {
+		_, err = clog.Append(&api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+		require.NoError(t, err)
+	}
+
+	var batches atomic.Int64
+	srv, err := server.NewGRPCServer(&server.Config{
+		CommitLog:      clog,
+		AllowAnonymous: true,
+	}, grpc.ChainUnaryInterceptor(func(
+		ctx context.Context,
+		req any,
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (any, error) {
+		if info.FullMethod == api.Log_ConsumeBatch_FullMethodName {
+			batches.Add(1)
+		}
+		return handler(ctx, req)
+	}))
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	defer srv.Stop()
+
+	c, err := New(l.Addr().String(), ClientConfig{ConsumePageSize: 7})
+	require.NoError(t, err)
+	defer func() { _ = c.Close() }()
+
+	records, err := c.ConsumeAll(context.Background(), 0, 1000)
+	require.NoError(t, err)
+	require.Len(t, records, 1000)
+	for i, record := range records {
+		require.Equal(t, uint64(i), record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record-%d", i)), record.Value)
+	}
+	// 7 件ずつのページに分けて読み出している
+	require.Equal(t, int64(143), batches.Load())
+
+	// ログの末尾を越える範囲は、読み出せなかった最初のオフセットで失敗する
+	var n int
+	err = c.ConsumeAllFunc(context.Background(), 995, 1005, func(*api.Record) error {
+		n++
+		return nil
+	})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+	require.Equal(t, 5, n)
+}
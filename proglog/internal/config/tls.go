@@ -3,16 +3,24 @@ package config
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"os"
 )
 
+// TLSConfig は SetupTLSConfig に渡す証明書ファイルの設定です。
+// CRLFile にサーバー側で CA が発行した証明書失効リスト (PEM または DER) を指定すると、
+// 失効したクライアント証明書でのハンドシェイクを拒否します。空の場合は失効の確認を行いません。
+// RequireClientAuthEKU を有効にすると、拡張鍵用途にクライアント認証 (ExtKeyUsageClientAuth) が含まれていない
+// クライアント証明書でのハンドシェイクを拒否します。拡張鍵用途を持たない証明書も拒否します。
 type TLSConfig struct {
-	CertFile      string
-	KeyFile       string
-	CAFile        string
-	ServerAddress string
-	Server        bool
+	CertFile             string
+	KeyFile              string
+	CAFile               string
+	CRLFile              string
+	ServerAddress        string
+	Server               bool
+	RequireClientAuthEKU bool
 }
 
 func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
@@ -44,6 +52,20 @@ func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 		if cfg.Server {
 			tlsConfig.ClientCAs = ca
 			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			var verifiers []peerVerifier
+			if cfg.CRLFile != "" {
+				revoked, err := loadCRL(cfg.CRLFile, b)
+				if err != nil {
+					return nil, err
+				}
+				verifiers = append(verifiers, verifyNotRevoked(revoked))
+			}
+			if cfg.RequireClientAuthEKU {
+				verifiers = append(verifiers, verifyClientAuthEKU)
+			}
+			if len(verifiers) > 0 {
+				tlsConfig.VerifyPeerCertificate = verifyAll(verifiers)
+			}
 		} else {
 			tlsConfig.RootCAs = ca
 		}
@@ -51,3 +73,90 @@ func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 	}
 	return tlsConfig, nil
 }
+
+// loadCRL は crlFile の証明書失効リストを読み込み、caPEM の CA によって署名されていることを確認して、
+// 失効したシリアル番号の集合を返します。
+func loadCRL(crlFile string, caPEM []byte) (map[string]struct{}, error) {
+	b, err := os.ReadFile(crlFile)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		b = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse crl: %q: %w", crlFile, err)
+	}
+	var signed bool
+	for rest := caPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return nil, fmt.Errorf("crl is not signed by the ca: %q", crlFile)
+	}
+	revoked := make(map[string]struct{}, len(crl.RevokedCertificateEntries))
+	for _, e := range crl.RevokedCertificateEntries {
+		revoked[e.SerialNumber.String()] = struct{}{}
+	}
+	return revoked, nil
+}
+
+// peerVerifier は tls.Config の VerifyPeerCertificate として呼び出される、証明書チェーンの追加の検証です。
+type peerVerifier func(rawCerts [][]byte, chains [][]*x509.Certificate) error
+
+// verifyAll は verifiers を順番に呼び出し、最初に失敗した検証のエラーを返す VerifyPeerCertificate を返します。
+func verifyAll(verifiers []peerVerifier) peerVerifier {
+	return func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		for _, verify := range verifiers {
+			if err := verify(rawCerts, chains); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// verifyClientAuthEKU は、検証済みの証明書チェーンのクライアント証明書の拡張鍵用途に
+// クライアント認証が含まれていなければハンドシェイクを失敗させます。
+func verifyClientAuthEKU(_ [][]byte, chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		if len(chain) == 0 {
+			continue
+		}
+		for _, usage := range chain[0].ExtKeyUsage {
+			if usage == x509.ExtKeyUsageClientAuth {
+				return nil
+			}
+		}
+		return fmt.Errorf("certificate %s is not marked for client authentication", chain[0].SerialNumber)
+	}
+	return fmt.Errorf("no verified client certificate")
+}
+
+// verifyNotRevoked は、検証済みの証明書チェーンに revoked に含まれる証明書があればハンドシェイクを失敗させる
+// VerifyPeerCertificate を返します。
+func verifyNotRevoked(revoked map[string]struct{}) peerVerifier {
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if _, ok := revoked[cert.SerialNumber.String()]; ok {
+					return fmt.Errorf("certificate %s has been revoked", cert.SerialNumber)
+				}
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,195 @@
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestSetupTLSConfigCRL は、CRLFile に含まれるクライアント証明書ではハンドシェイクが失敗し、
+// 含まれない証明書では成功することを検証します。
+func TestSetupTLSConfigCRL(t *testing.T) {
+	crlFile := writeCRL(t, NobodyClientCertFile)
+	serverTLSConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile: ServerCertFile,
+		KeyFile:  ServerKeyFile,
+		CAFile:   CAFile,
+		CRLFile:  crlFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+
+	for scenario, c := range map[string]struct {
+		certFile, keyFile string
+		revoked           bool
+	}{
+		"not revoked cert succeeds": {RootClientCertFile, RootClientKeyFile, false},
+		"revoked cert fails":        {NobodyClientCertFile, NobodyClientKeyFile, true},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			clientTLSConfig, err := SetupTLSConfig(TLSConfig{
+				CertFile:      c.certFile,
+				KeyFile:       c.keyFile,
+				CAFile:        CAFile,
+				ServerAddress: "127.0.0.1",
+			})
+			require.NoError(t, err)
+
+			err = handshake(t, serverTLSConfig, clientTLSConfig)
+			if c.revoked {
+				require.ErrorContains(t, err, "revoked")
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestSetupTLSConfigRequireClientAuthEKU は、RequireClientAuthEKU を有効にしたサーバーが
+// 拡張鍵用途にクライアント認証を含まない証明書を拒否し、含む証明書を受け入れることを検証します。
+func TestSetupTLSConfigRequireClientAuthEKU(t *testing.T) {
+	serverTLSConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile:             ServerCertFile,
+		KeyFile:              ServerKeyFile,
+		CAFile:               CAFile,
+		Server:               true,
+		RequireClientAuthEKU: true,
+	})
+	require.NoError(t, err)
+
+	noEKUCertFile, noEKUKeyFile := writeClientCert(t)
+	for scenario, c := range map[string]struct {
+		certFile, keyFile string
+		rejected          bool
+	}{
+		"client auth eku succeeds": {RootClientCertFile, RootClientKeyFile, false},
+		"missing eku fails":        {noEKUCertFile, noEKUKeyFile, true},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			clientTLSConfig, err := SetupTLSConfig(TLSConfig{
+				CertFile:      c.certFile,
+				KeyFile:       c.keyFile,
+				CAFile:        CAFile,
+				ServerAddress: "127.0.0.1",
+			})
+			require.NoError(t, err)
+
+			err = handshake(t, serverTLSConfig, clientTLSConfig)
+			if c.rejected {
+				require.ErrorContains(t, err, "not marked for client authentication")
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// handshake は serverConfig で待ち受けたサーバーに clientConfig で接続し、サーバー側のハンドシェイクの結果を返します。
+func handshake(t *testing.T, serverConfig, clientConfig *tls.Config) error {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		done <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+	if err == nil {
+		// TLS 1.3 ではクライアント証明書の拒否は最初の読み込みで通知される
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _ = conn.Read(make([]byte, 1))
+		_ = conn.Close()
+	}
+	return <-done
+}
+
+// writeCRL は CA の鍵で certFile の証明書を失効させた CRL を作成し、そのパスを返します。
+func writeCRL(t *testing.T, certFile string) string {
+	t.Helper()
+	caPair, err := tls.LoadX509KeyPair(CAFile, configFile("ca-key.pem"))
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caPair.Certificate[0])
+	require.NoError(t, err)
+	// テスト用の CA には鍵用途の拡張がないため、CRL の署名に必要な用途を付けて署名する
+	ca.KeyUsage |= x509.KeyUsageCRLSign
+	b, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	block, _ := pem.Decode(b)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: time.Now(),
+		}},
+	}, ca, caPair.PrivateKey.(crypto.Signer))
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "crl.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{
+		Type:  "X509 CRL",
+		Bytes: crl,
+	}), 0600))
+	return path
+}
+
+// writeClientCert は CA の鍵で拡張鍵用途を持たないクライアント証明書を発行し、証明書と鍵のファイルのパスを返します。
+func writeClientCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	caPair, err := tls.LoadX509KeyPair(CAFile, configFile("ca-key.pem"))
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caPair.Certificate[0])
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	cert, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "root"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, ca, &key.PublicKey, caPair.PrivateKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "client.pem")
+	keyFile = filepath.Join(dir, "client-key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert,
+	}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: keyDER,
+	}), 0600))
+	return certFile, keyFile
+}
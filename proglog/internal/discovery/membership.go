@@ -39,11 +39,13 @@ func New(handler Handler, config Config) (*Membership, error) {
 // BindAddr はノードがバインドするアドレスを指定します。
 // Tags はノードのメタデータを保持するマップです。
 // StartJoinAddrs はクラスタ参加時に接続する初期アドレス一覧を指定します。
+// JoinFilter を設定すると、参加したメンバーのタグを渡して呼び出し、false を返したメンバーの参加をハンドラーに通知しません。
 type Config struct {
 	NodeName       string
 	BindAddr       string
 	Tags           map[string]string
 	StartJoinAddrs []string
+	JoinFilter     func(tags map[string]string) bool
 }
 
 // setupSerf は Serf インスタンスを初期化し、クラスタイベントを処理する準備を行います。
@@ -115,8 +117,12 @@ func (m *Membership) eventHandler() {
 
 // handleJoin は、新しいメンバーがクラスタに参加した際の処理を行います。
 // メンバーの情報をハンドラーを通じて登録します。
+// JoinFilter が設定されていて、メンバーのタグが条件に合わない場合は通知しません。
 // エラーが発生した場合は記録します。
 func (m *Membership) handleJoin(member serf.Member) {
+	if m.JoinFilter != nil && !m.JoinFilter(member.Tags) {
+		return
+	}
 	if err := m.handler.Join(
 		member.Name,
 		member.Tags["rpc_addr"],
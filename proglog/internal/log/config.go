@@ -1,12 +1,57 @@
 package log
 
+import "time"
+
 // Config はログセグメントに関連する設定を管理する構造体です。
 // Segment フィールドは各セグメントの容量制限や初期オフセットを設定します。
+// Segment.MaxRecords はセグメントあたりの最大レコード数で、0 の場合は無制限です。
+// Segment.NoMmap を true にすると、インデックスをメモリマッピングせずにファイル I/O で読み書きします。
+// Segment.IdleTimeout を設定すると、その時間読み書きされていない封印済みセグメントのメモリマップとバッファを解放し、
+// 次の読み出しで再びマッピングします。
+// Segment.MmapStore を true にすると、封印済みセグメントのストアを読み取り専用でメモリマッピングし、ReadRef がコピーせずに読み出せるようにします。
+// Segment.AlignBytes を設定すると、ストアの各レコードの後ろをパディングし、レコードの開始位置をその倍数に揃えます。
+// ダイレクト I/O や読み出し性能の安定のために容量を犠牲にする設定で、MaxAlignBytes 以下である必要があります。
+// Segment.DirectSync を true にすると、ストアのファイルを O_DSYNC で開き、Append が書き込んだデータの永続化を待ってから戻ります。
+// fsync を別に呼び出さずに永続性を得られますが、O_DSYNC がないプラットフォームでは書き込みごとに fsync します。
+// Segment.WideIndex を true にすると、新しく作成するインデックスのオフセットを uint32 ではなく uint64 で保存します。
+// 既存のインデックスはファイル先頭のヘッダーから形式を判定するため、設定を変えても再オープンできます。
+// Segment.PreallocStore を true にすると、新しく開いたセグメントのストアのファイルに MaxStoreBytes までのブロックを fallocate で事前に確保し、
+// 追記のたびにブロックを割り当てずに済むようにします。確保した余りはセグメントの封印時と Close 時に解放します。
+// fallocate がないプラットフォームやファイルシステムでは何もしません。
+// Segment.Encryptor を設定すると、レコードの値を暗号化してストアに保存し、読み出し時に復号します。
+// 使った鍵の ID を EncryptionKeyIDHeader に記録するため、鍵をローテーションしても古いレコードを読み出せます。
+// SetupConcurrency を 1 より大きくすると、ログを開くときに最大その数のセグメントを並行して開きます。
+// セグメントが多いログの起動を速くするための設定で、0 または 1 の場合は順に開きます。
+// MinConsumedOffsetFunc を設定すると、Truncate はその戻り値（まだ消費されていない最小のオフセット）以降のレコードを削除しません。
+// 戻り値の 0 はまだ何も消費されていないことを表し、その場合 Truncate は何も削除せずに ErrNothingConsumed を返します。
+// OnExcessiveRolls を設定すると、直近 RollRateWindow の間のセグメントの切り替え頻度（回/秒）が MaxRollRate を超えた場合に、
+// その頻度を引数に呼び出します。呼び出しは RollRateWindow ごとに最大 1 回です。
+// ログのロックを保持したまま呼び出すため、OnExcessiveRolls から Log のメソッドを呼び出してはいけません。
+// RejectConsecutiveDuplicates を true にすると、Append は直前に追加したレコードと値が同じレコードを ErrDuplicateRecord で拒否します。
+// 直前の 1 件だけと比較するため、全てのレコードとの重複を除く場合よりも安価です。
+// TrackHighWatermark を true にすると、HighWatermark は SetHighWatermark で記録した複製済みの最大オフセットを返します。
+// false の場合は複製を考慮せず、HighWatermark は HighestOffset と同じ値を返します。
 // nolint:revive
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		MaxRecords    uint64
+		NoMmap        bool
+		IdleTimeout   time.Duration
+		MmapStore     bool
+		AlignBytes    uint64
+		WideIndex     bool
+		DirectSync    bool
+		PreallocStore bool
+		Encryptor     Encryptor
 	}
+	SetupConcurrency            int
+	MinConsumedOffsetFunc       func() uint64
+	RollRateWindow              time.Duration
+	MaxRollRate                 float64
+	OnExcessiveRolls            func(rate float64)
+	RejectConsecutiveDuplicates bool
+	TrackHighWatermark          bool
 }
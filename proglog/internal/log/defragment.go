@@ -0,0 +1,275 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defragmentDir は Defragment が新しいセグメントを書き出す一時ディレクトリの名前です。
+	defragmentDir = ".defragment"
+	// defragmentMarker は一時ディレクトリへの書き出しが完了したことを示すファイルの名前です。
+	// 置き換え対象となる旧セグメントのベースオフセットが 1 行に 1 つずつ記録されます。
+	defragmentMarker = "complete"
+)
+
+// Defragment はアクティブセグメント以外の封印済みセグメントを、現在の設定サイズで密に詰めた新しいセグメントへ書き直します。
+// 削除済みや期限切れのレコードは Truncate（Config.MinConsumedOffsetFunc による制限を含む）がセグメント単位で削除するため、
+// Defragment 自身はレコードを捨てず、削除の後に細かく分かれて残ったセグメントをまとめてディスク容量を解放します。
+// 残したレコードのオフセットは維持されます。新しいセグメントは一時ディレクトリに書き出してディスクへ同期してから置き換えるため、
+// 途中で中断された場合でも、次回の setup で完了済みの置き換えを再開するか、未完了の一時ファイルを破棄します。
+// 書き出しの間はログのロックを保持しないため、Append や Read は止まりません。
+// 旧セグメントを閉じた後に置き換えが失敗した場合は、閉じたセグメントが使われないようにログを閉じた状態にします。
+// ディスク上の置き換えは setup で完了できるため、NewLog で開き直せば復旧できます。
+// 書き直した場合は封印済みセグメントの最後のオフセットを EventCompacted として購読者に通知します。
+// 詰め直してもセグメントの構成が変わらない場合は何も置き換えず、通知もしません。
+func (l *Log) Defragment() error {
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+	// 封印済みセグメントを置き換える保守処理は maintenance で直列化されているため、書き出しの間に sealed は変わらない
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return ErrLogClosed
+	}
+	sealed := append([]*segment(nil), l.segments[:len(l.segments)-1]...)
+	l.mu.RUnlock()
+	if len(sealed) == 0 {
+		return nil
+	}
+
+	tmp := filepath.Join(l.Dir, defragmentDir)
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.Mkdir(tmp, 0700); err != nil {
+		return err
+	}
+	bases, err := l.repack(tmp, sealed)
+	if err == nil && unchanged(sealed, bases) {
+		return os.RemoveAll(tmp)
+	}
+	if err == nil {
+		err = syncDir(tmp)
+	}
+	if err == nil {
+		err = writeDefragmentMarker(tmp, sealed)
+	}
+	if err == nil {
+		// マーカーファイルのディレクトリエントリも永続化してから旧セグメントを削除する
+		err = syncPath(tmp)
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		// 旧セグメントはそのまま残っているため、書き出したセグメントは破棄する
+		_ = os.RemoveAll(tmp)
+		return ErrLogClosed
+	}
+	for _, s := range sealed {
+		s.mu.Lock()
+		err = s.Close()
+		s.mu.Unlock()
+		if err != nil {
+			return l.abortDefragment(len(sealed), nil, err)
+		}
+	}
+	if err = l.finishDefragment(); err != nil {
+		return l.abortDefragment(len(sealed), nil, err)
+	}
+	if err = syncPath(l.Dir); err != nil {
+		return l.abortDefragment(len(sealed), nil, err)
+	}
+	segments := make([]*segment, 0, len(bases)+len(l.segments)-len(sealed))
+	for _, base := range bases {
+		s, err := newSegment(l.Dir, base, l.Config)
+		if err != nil {
+			return l.abortDefragment(len(sealed), segments, err)
+		}
+		segments = append(segments, s)
+		if err = l.seal(s); err != nil {
+			return l.abortDefragment(len(sealed), segments, err)
+		}
+	}
+	// 書き出しの間に Append がセグメントを切り替えていても、sealed より後ろのセグメントはそのまま残す
+	l.segments = append(segments, l.segments[len(sealed):]...)
+	l.publish(Event{Type: EventCompacted, Offset: sealed[len(sealed)-1].nextOffset - 1})
+	return nil
+}
+
+// abortDefragment は旧セグメントを閉じた後に置き換えが失敗した場合に、開いたセグメント opened と、
+// l.segments のうち閉じていない n 番目以降のセグメントを閉じてログを閉じた状態にし、err を返します。
+// 呼び出し側で書き込みロックを取得している必要があります。
+func (l *Log) abortDefragment(n int, opened []*segment, err error) error {
+	for _, s := range opened {
+		_ = s.Close()
+	}
+	l.segments = l.segments[n:]
+	return errors.Join(
+		fmt.Errorf("defragment: %w; reopen the log to finish the replacement", err),
+		l.close(),
+	)
+}
+
+// unchanged は repack が作成したセグメントのベースオフセット bases が sealed と同じ構成かどうかを返します。
+func unchanged(sealed []*segment, bases []uint64) bool {
+	if len(sealed) != len(bases) {
+		return false
+	}
+	for i, s := range sealed {
+		if s.baseOffset != bases[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// repack は sealed のレコードを dir 内の新しいセグメントへ順番に書き込み、
+// 作成したセグメントのベースオフセットを返します。新しいセグメントは設定サイズの上限に達するたびに切り替えます。
+// ログのロックを保持せずに呼び出すため、レコードは Read でアイドル状態から戻しながら読み出します。
+func (l *Log) repack(dir string, sealed []*segment) ([]uint64, error) {
+	var bases []uint64
+	var packed *segment
+	for _, s := range sealed {
+		for off := s.baseOffset; off < s.nextOffset; off++ {
+			record, err := l.Read(off)
+			if err != nil {
+				if packed != nil {
+					_ = packed.Close()
+				}
+				return nil, err
+			}
+			if packed == nil || packed.IsMaxed() {
+				if packed != nil {
+					if err = packed.Close(); err != nil {
+						return nil, err
+					}
+				}
+				if packed, err = newSegment(dir, off, l.Config); err != nil {
+					return nil, err
+				}
+				bases = append(bases, off)
+			}
+			if _, err = packed.Append(record); err != nil {
+				_ = packed.Close()
+				return nil, err
+			}
+		}
+	}
+	if packed != nil {
+		if err := packed.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return bases, nil
+}
+
+// syncDir は dir 内の全てのファイルと dir 自身をディスクへ同期します。
+func syncDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err = syncPath(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return syncPath(dir)
+}
+
+// syncPath は path のファイルまたはディレクトリをディスクへ同期します。
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeDefragmentMarker は置き換え対象のセグメントのベースオフセットをマーカーファイルに書き込み、ディスクへ同期します。
+func writeDefragmentMarker(dir string, sealed []*segment) error {
+	f, err := os.OpenFile(
+		filepath.Join(dir, defragmentMarker),
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC,
+		0600,
+	)
+	if err != nil {
+		return err
+	}
+	for _, s := range sealed {
+		if _, err = fmt.Fprintf(f, "%d\n", s.baseOffset); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// finishDefragment はマーカーファイルに記録された旧セグメントを削除し、一時ディレクトリのセグメントをログディレクトリへ移動します。
+// 何度実行しても同じ結果になるため、中断された置き換えの再開にも使用します。
+func (l *Log) finishDefragment() error {
+	tmp := filepath.Join(l.Dir, defragmentDir)
+	b, err := os.ReadFile(filepath.Join(tmp, defragmentMarker))
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Fields(string(b)) {
+		base, err := strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			return err
+		}
+		for _, ext := range []string{".store", ".index"} {
+			name := filepath.Join(l.Dir, fmt.Sprintf("%d%s", base, ext))
+			if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() == defragmentMarker {
+			continue
+		}
+		if err = os.Rename(
+			filepath.Join(tmp, e.Name()),
+			filepath.Join(l.Dir, e.Name()),
+		); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(tmp)
+}
+
+// recoverDefragment は中断された Defragment の後始末を行います。
+// マーカーファイルがあれば置き換えを完了させ、なければ書きかけの一時ディレクトリを削除します。
+func (l *Log) recoverDefragment() error {
+	tmp := filepath.Join(l.Dir, defragmentDir)
+	if _, err := os.Stat(tmp); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(tmp, defragmentMarker)); err == nil {
+		return l.finishDefragment()
+	}
+	return os.RemoveAll(tmp)
+}
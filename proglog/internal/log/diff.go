@@ -0,0 +1,75 @@
+package log
+
+import (
+	"bytes"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// Mismatch の Reason に設定する、レコードが一致しない理由です。
+const (
+	// MismatchMissing は比較先にレコードが存在しないことを示します。
+	MismatchMissing = "missing"
+	// MismatchSizeDiffers はレコードの値の長さが異なることを示します。
+	MismatchSizeDiffers = "size-differs"
+	// MismatchValueDiffers はレコードの値の長さは同じで内容が異なることを示します。
+	MismatchValueDiffers = "value-differs"
+)
+
+// Mismatch は 2 つのログを比較したときに一致しなかったオフセットとその理由です。
+type Mismatch struct {
+	Offset uint64
+	Reason string
+}
+
+// RecordReader はオフセットを指定してレコードを読み出せる、比較先のログです。
+// 存在しないオフセットに対しては、gRPC のステータスコードが OutOfRange となるエラーを返す必要があります。
+type RecordReader interface {
+	Read(off uint64) (*api.Record, error)
+}
+
+// ForEach は from から to までのオフセットのうち、ログに存在するレコードを順番に fn に渡します。
+// fn がエラーを返した場合は、その時点で処理を中断してエラーを返します。
+func (l *Log) ForEach(from, to uint64, fn func(*api.Record) error) error {
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	for off := max(from, lowest); off <= to; off++ {
+		record, err := l.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Diff は src の from から to までのレコードを dst の同じオフセットのレコードと比較し、
+// 一致しなかったオフセットごとに fn を呼び出します。fn がエラーを返した場合は、その時点で比較を中断します。
+func Diff(src *Log, dst RecordReader, from, to uint64, fn func(Mismatch) error) error {
+	return src.ForEach(from, to, func(want *api.Record) error {
+		got, err := dst.Read(want.Offset)
+		if status.Code(err) == codes.OutOfRange {
+			return fn(Mismatch{Offset: want.Offset, Reason: MismatchMissing})
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(got.Value) != len(want.Value):
+			return fn(Mismatch{Offset: want.Offset, Reason: MismatchSizeDiffers})
+		case !bytes.Equal(got.Value, want.Value):
+			return fn(Mismatch{Offset: want.Offset, Reason: MismatchValueDiffers})
+		}
+		return nil
+	})
+}
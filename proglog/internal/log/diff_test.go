@@ -0,0 +1,50 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+func TestDiff(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 2
+	src, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer func() { _ = src.Close() }()
+	dst, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer func() { _ = dst.Close() }()
+
+	for _, v := range []string{"a", "b", "c", "d", "e", "f"} {
+		_, err = src.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	// オフセット 2 は内容が、オフセット 3 は長さが異なり、オフセット 5 は存在しない
+	for _, v := range []string{"a", "b", "x", "dd", "e"} {
+		_, err = dst.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+
+	var mismatches []Mismatch
+	err = Diff(src, dst, 0, 10, func(m Mismatch) error {
+		mismatches = append(mismatches, m)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []Mismatch{
+		{Offset: 2, Reason: MismatchValueDiffers},
+		{Offset: 3, Reason: MismatchSizeDiffers},
+		{Offset: 5, Reason: MismatchMissing},
+	}, mismatches)
+
+	mismatches = nil
+	err = Diff(src, dst, 0, 2, func(m Mismatch) error {
+		mismatches = append(mismatches, m)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []Mismatch{{Offset: 2, Reason: MismatchValueDiffers}}, mismatches)
+}
@@ -0,0 +1,11 @@
+//go:build linux || darwin || freebsd || netbsd
+
+package log
+
+import "syscall"
+
+// oDSync は、書き込みがデータの永続化まで完了してから戻るようにストアのファイルを開くフラグです。
+const oDSync = syscall.O_DSYNC
+
+// dsyncSupported は、このプラットフォームで O_DSYNC を使用できるかを表します。
+const dsyncSupported = true
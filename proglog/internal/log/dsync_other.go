@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd)
+
+package log
+
+// oDSync は、O_DSYNC を使用できないプラットフォームでは 0 で、ストアは書き込みごとに fsync します。
+const oDSync = 0
+
+// dsyncSupported は、このプラットフォームで O_DSYNC を使用できるかを表します。
+const dsyncSupported = false
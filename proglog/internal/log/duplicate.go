@@ -0,0 +1,62 @@
+package log
+
+import "bytes"
+
+// lastAppended は RejectConsecutiveDuplicates のために、直前に追加したレコードの値を保持します。
+// loaded が false の場合は、ログを開いた直後などでまだ最後のレコードを読み込んでいないことを表します。
+// exists が false の場合は、ログにレコードがないことを表します。
+type lastAppended struct {
+	value  []byte
+	exists bool
+	loaded bool
+}
+
+// checkConsecutiveDuplicate は RejectConsecutiveDuplicates が有効で、value が直前に追加したレコードの値と同じ場合に
+// ErrDuplicateRecord を返します。直前の値を読み込んでいない場合は、最後のレコードをログから読み出して比較します。
+// 呼び出し側で書き込みロックを取得している必要があります。
+func (l *Log) checkConsecutiveDuplicate(value []byte) error {
+	if !l.Config.RejectConsecutiveDuplicates {
+		return nil
+	}
+	if !l.last.loaded {
+		if err := l.loadLastAppended(); err != nil {
+			return err
+		}
+	}
+	if l.last.exists && bytes.Equal(l.last.value, value) {
+		return ErrDuplicateRecord
+	}
+	return nil
+}
+
+// rememberAppended は RejectConsecutiveDuplicates が有効な場合に、追加したレコードの値を次の比較のために保持します。
+// 呼び出し側で書き込みロックを取得している必要があります。
+func (l *Log) rememberAppended(value []byte) {
+	if !l.Config.RejectConsecutiveDuplicates {
+		return
+	}
+	l.last = lastAppended{value: bytes.Clone(value), exists: true, loaded: true}
+}
+
+// loadLastAppended はログの最後のレコードを読み出し、その値を直前に追加したレコードの値として保持します。
+// 呼び出し側で書き込みロックを取得している必要があります。
+func (l *Log) loadLastAppended() error {
+	l.last = lastAppended{loaded: true}
+	next := l.activeSegment.nextOffset
+	if next == 0 {
+		return nil
+	}
+	s := l.segmentFor(next - 1)
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	record, err := s.Read(next - 1)
+	s.mu.RUnlock()
+	if err != nil {
+		l.last.loaded = false
+		return err
+	}
+	l.last.value, l.last.exists = record.Value, true
+	return nil
+}
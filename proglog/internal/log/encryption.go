@@ -0,0 +1,63 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// EncryptionKeyIDHeader は、暗号化したレコードの値に使った鍵の ID を記録するヘッダーのキーです。
+// 鍵ごとに ID を残すため、鍵をローテーションした後も古い鍵で暗号化したレコードを復号できます。
+const EncryptionKeyIDHeader = "encryption-key-id"
+
+// ErrDecryption は、レコードの値を復号できなかったことを示します。
+var ErrDecryption = errors.New("failed to decrypt record")
+
+// Encryptor はセグメントに保存するレコードの値を暗号化・復号します。
+// Encrypt は現在の鍵で暗号化し、暗号文と鍵の ID を返します。
+// Decrypt は keyID の鍵で復号します。鍵が見つからない場合や認証に失敗した場合はエラーを返します。
+type Encryptor interface {
+	Encrypt(plaintext []byte) (ciphertext []byte, keyID string, err error)
+	Decrypt(ciphertext []byte, keyID string) ([]byte, error)
+}
+
+// encrypt は record の値を暗号化したコピーを返します。
+// ヘッダーやオフセットは平文のまま残るため、ストア上のレコードは通常のレコードとして解析できます。
+func (s *segment) encrypt(record *api.Record) (*api.Record, error) {
+	ciphertext, keyID, err := s.config.Segment.Encryptor.Encrypt(record.Value)
+	if err != nil {
+		return nil, err
+	}
+	stored := proto.Clone(record).(*api.Record)
+	stored.Value = ciphertext
+	if stored.Headers == nil {
+		stored.Headers = make(map[string]string, 1)
+	}
+	stored.Headers[EncryptionKeyIDHeader] = keyID
+	return stored, nil
+}
+
+// decrypt は暗号化されたレコードの値をその場で復号し、鍵の ID のヘッダーを取り除きます。
+// 暗号化されていないレコードはそのまま返します。
+func (s *segment) decrypt(record *api.Record) error {
+	keyID, ok := record.Headers[EncryptionKeyIDHeader]
+	if !ok {
+		return nil
+	}
+	enc := s.config.Segment.Encryptor
+	if enc == nil {
+		return fmt.Errorf("%w: offset %d: no encryptor configured for key %q", ErrDecryption, record.Offset, keyID)
+	}
+	plaintext, err := enc.Decrypt(record.Value, keyID)
+	if err != nil {
+		return fmt.Errorf("%w: offset %d: key %q: %v", ErrDecryption, record.Offset, keyID, err)
+	}
+	record.Value = plaintext
+	delete(record.Headers, EncryptionKeyIDHeader)
+	if len(record.Headers) == 0 {
+		record.Headers = nil
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package log
+
+import "errors"
+
+var (
+	// ErrInvalidTruncate は、Truncate がアクティブセグメントを含む全データを削除してしまう場合に返されるエラーです。
+	ErrInvalidTruncate = errors.New("truncate would remove all records including the active segment")
+	// ErrOffsetSpaceExhausted は、次のオフセットが uint64 の上限を超えてしまうため追加できない場合に返されるエラーです。
+	ErrOffsetSpaceExhausted = errors.New("offset space exhausted")
+	// ErrLogClosed は、Close したログに対して読み書きしようとした場合に返されるエラーです。
+	ErrLogClosed = errors.New("log is closed")
+	// ErrIndexOffsetOverflow は、ワイド形式でないインデックスに uint32 に収まらない相対オフセットを書き込もうとした場合に返されるエラーです。
+	ErrIndexOffsetOverflow = errors.New("index offset overflows uint32; use Segment.WideIndex")
+	// ErrDuplicateRecord は、RejectConsecutiveDuplicates が有効で、直前のレコードと同じ値のレコードを追加しようとした場合に返されるエラーです。
+	ErrDuplicateRecord = errors.New("record value duplicates the previous record")
+	// ErrNothingConsumed は、Config.MinConsumedOffsetFunc が 0 を返し、まだ何も消費されていないため Truncate が何も削除できない場合に返されるエラーです。
+	ErrNothingConsumed = errors.New("truncate removed nothing because no records have been consumed")
+	// ErrStoreFailed は、バッファに溜めたレコードをファイルに書き出せず、ストアが使用できなくなった場合に返されるエラーです。
+	// 書き出せなかったレコードはすでにインデックスに登録されているため、以降の読み書きは全てこのエラーで失敗します。
+	ErrStoreFailed = errors.New("store failed to flush buffered records")
+)
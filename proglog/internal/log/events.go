@@ -0,0 +1,49 @@
+package log
+
+// EventType はログで発生した操作の種類です。
+type EventType string
+
+const (
+	// EventTruncated は、Truncate や ForceTruncate によって Offset 以下のレコードが削除されたことを表します。
+	EventTruncated EventType = "truncated"
+	// EventCompacted は、Defragment によって Offset 以下の封印済みセグメントが書き直されたことを表します。
+	EventCompacted EventType = "compacted"
+)
+
+// eventBufferSize は購読者ごとに溜めておけるイベントの数です。
+const eventBufferSize = 16
+
+// Event は、読み出し中のレコードの位置に影響するログの操作を購読者に通知するためのイベントです。
+type Event struct {
+	Type   EventType
+	Offset uint64
+}
+
+// Subscribe はログのイベントを受け取るチャネルと、購読を解除する関数を返します。
+// イベントはログのロックを保持したまま送信するため、受信が追いつかずバッファが一杯の購読者には送信せずに破棄します。
+func (l *Log) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+	l.subsMu.Lock()
+	if l.subs == nil {
+		l.subs = make(map[chan Event]struct{})
+	}
+	l.subs[ch] = struct{}{}
+	l.subsMu.Unlock()
+	return ch, func() {
+		l.subsMu.Lock()
+		delete(l.subs, ch)
+		l.subsMu.Unlock()
+	}
+}
+
+// publish は全ての購読者に e を送信します。
+func (l *Log) publish(e Event) {
+	l.subsMu.Lock()
+	defer l.subsMu.Unlock()
+	for ch := range l.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
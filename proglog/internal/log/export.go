@@ -0,0 +1,194 @@
+package log
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// exportMagic はエクスポートしたアーカイブの先頭に置く識別子です。
+	exportMagic = "PLGX"
+	// exportVersion はアーカイブの形式のバージョンです。
+	exportVersion uint32 = 1
+	// importDir は Import がアーカイブのセグメントを書き出す一時ディレクトリの名前です。
+	importDir = ".import"
+)
+
+// ErrInvalidArchive は、Import に渡されたデータが Export の形式でない場合に返されるエラーです。
+var ErrInvalidArchive = errors.New("invalid log archive")
+
+// Export はログの全てのセグメントのストアとインデックスを、そのままのバイト列で w に書き出します。
+// アーカイブは識別子とバージョン、セグメントの数に続けて、セグメントごとにベースオフセット、
+// ストアのバイト列、インデックスのバイト列をそれぞれ長さを前に付けて並べたものです。
+// Import で読み込むと、セグメントの境界とインデックスを含めて元のログと同じファイルを再現できます。
+// 書き出している間は読み取りロックを保持するため、書き込みは待機します。
+func (l *Log) Export(w io.Writer) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(exportMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, enc, exportVersion); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, enc, uint64(len(l.segments))); err != nil {
+		return err
+	}
+	for _, s := range l.segments {
+		s.mu.RLock()
+		err := s.export(bw)
+		s.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// export はセグメントのベースオフセットと、ストアとインデックスのバイト列を w に書き出します。
+// 呼び出し側でセグメントの読み取りロックを取得している必要があります。
+func (s *segment) export(w io.Writer) error {
+	if err := binary.Write(w, enc, s.baseOffset); err != nil {
+		return err
+	}
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	if err := s.store.flush(); err != nil {
+		return err
+	}
+	if err := writeSection(w, io.NewSectionReader(s.store.File, 0, int64(s.store.size)),
+		s.store.size); err != nil {
+		return err
+	}
+	return writeSection(w, io.NewSectionReader(s.index.file, 0, int64(s.index.size)),
+		s.index.size)
+}
+
+// writeSection は長さ n を書き出してから、r の n バイトを w にコピーします。
+func writeSection(w io.Writer, r io.Reader, n uint64) error {
+	if err := binary.Write(w, enc, n); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, r, int64(n))
+	return err
+}
+
+// Import は Export で書き出したアーカイブを r から読み込み、ログの内容をアーカイブのセグメントで置き換えます。
+// セグメントのファイルはバイト列をそのまま書き出すため、インデックスを再構築せずにログを開けます。
+// アーカイブは一時ディレクトリに全て書き出してから置き換えるため、途中で失敗した場合は元のログが残ります。
+// 置き換えている間はログを閉じるため、並行して行われた読み書きは ErrLogClosed で失敗することがあります。
+func (l *Log) Import(r io.Reader) error {
+	tmp := filepath.Join(l.Dir, importDir)
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.Mkdir(tmp, 0700); err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(tmp) }()
+	if err := readArchive(bufio.NewReader(r), tmp); err != nil {
+		return err
+	}
+	if err := l.Close(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := removeSegmentFiles(l.Dir); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err = os.Rename(filepath.Join(tmp, e.Name()), filepath.Join(l.Dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	l.segments = nil
+	l.activeSegment = nil
+	return l.setup()
+}
+
+// readArchive はアーカイブを r から読み込み、セグメントのストアとインデックスのファイルを dir に書き出します。
+func readArchive(r io.Reader, dir string) error {
+	magic := make([]byte, len(exportMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != exportMagic {
+		return ErrInvalidArchive
+	}
+	var version uint32
+	if err := binary.Read(r, enc, &version); err != nil {
+		return err
+	}
+	if version != exportVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidArchive, version)
+	}
+	var n uint64
+	if err := binary.Read(r, enc, &n); err != nil {
+		return err
+	}
+	for i := uint64(0); i < n; i++ {
+		var base uint64
+		if err := binary.Read(r, enc, &base); err != nil {
+			return err
+		}
+		for _, ext := range []string{".store", ".index"} {
+			if err := readSection(r, filepath.Join(dir, fmt.Sprintf("%d%s", base, ext))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readSection は長さを読み込んでから、その長さのバイト列を r から path のファイルに書き出します。
+func readSection(r io.Reader, path string) error {
+	var n uint64
+	if err := binary.Read(r, enc, &n); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(f, r, int64(n)); err != nil {
+		_ = f.Close()
+		if errors.Is(err, io.EOF) {
+			return ErrInvalidArchive
+		}
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// removeSegmentFiles は dir にあるセグメントの .store と .index のファイルを削除します。
+func removeSegmentFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".store" && ext != ".index") {
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
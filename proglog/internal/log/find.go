@@ -0,0 +1,26 @@
+package log
+
+import (
+	"math"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// ProducerSubjectHeader は、レコードを書き込んだ主体を記録するヘッダーのキーです。
+const ProducerSubjectHeader = "producer-subject"
+
+// FindBySubject は ProducerSubjectHeader に subject が記録されたレコードのオフセットを古い順に返します。
+// ログ全体を先頭から読み出すため、監査などの頻度の低い用途を想定しています。
+func (l *Log) FindBySubject(subject string) ([]uint64, error) {
+	var offsets []uint64
+	err := l.ForEach(0, math.MaxUint64, func(record *api.Record) error {
+		if record.Headers[ProducerSubjectHeader] == subject {
+			offsets = append(offsets, record.Offset)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return offsets, nil
+}
@@ -1,7 +1,9 @@
 package log
 
 import (
+	"fmt"
 	"io"
+	"math"
 	"os"
 
 	"github.com/tysonmote/gommap"
@@ -11,13 +13,29 @@ const (
 	offWidth uint64 = 4
 	posWidth uint64 = 8
 	entWidth        = offWidth + posWidth
+
+	// wideOffWidth は、ワイド形式のインデックスでのオフセットの幅です。
+	wideOffWidth uint64 = 8
+	wideEntWidth        = wideOffWidth + posWidth
+	// wideHeaderWidth は、ワイド形式のインデックスの先頭に置くヘッダーの幅です。
+	// ヘッダーは wideMarker とオフセットの幅を 4 バイトずつ並べたものです。
+	wideHeaderWidth uint64 = 8
+	// wideMarker は、ワイド形式のインデックスであることを示すヘッダーの先頭の値です。
+	// 従来の形式では最初のエントリの相対オフセットが必ず 0 になるため、この値と区別できます。
+	wideMarker uint32 = math.MaxUint32
 )
 
 // index はファイルを使用したメモリマッピングとそのサイズを管理する構造体です。
+// mmap が nil の場合は、メモリマッピングの代わりにファイルへの ReadAt/WriteAt でエントリを読み書きします。
+// wide が true の場合は、オフセットを uint64 で保存するワイド形式で、ファイルの先頭に header バイトのヘッダーを持ちます。
 type index struct {
-	file *os.File
-	mmap gommap.MMap
-	size uint64
+	file   *os.File
+	mmap   gommap.MMap
+	size   uint64
+	limit  uint64
+	wide   bool
+	header uint64
+	width  uint64
 }
 
 // newIndex は、新しいindexを初期化し、指定されたファイルを使用してマッピングされたメモリ領域を作成します。
@@ -25,35 +43,111 @@ type index struct {
 // エラーが発生する可能性があるため、構造体ポインタとエラー値を返します。
 // ファイルサイズを取得し、指定されたバイトサイズにtruncate処理を行います。
 // gommapを使用してメモリマッピングを作成し、読み書き・共有属性を設定します。
+// c.Segment.NoMmap が true の場合、またはメモリマッピングに失敗した場合は、ファイル I/O で読み書きします。
+// 新しいファイルは c.Segment.WideIndex に従った形式で作成し、既存のファイルはヘッダーから形式を判定します。
 func newIndex(f *os.File, c Config) (*index, error) {
 	idx := &index{
-		file: f,
+		file:  f,
+		limit: c.Segment.MaxIndexBytes,
 	}
 	fi, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
 	idx.size = uint64(fi.Size())
+	if idx.size == 0 {
+		if c.Segment.WideIndex {
+			if err = idx.writeWideHeader(); err != nil {
+				return nil, err
+			}
+		}
+	} else if idx.wide, err = isWideIndex(f); err != nil {
+		return nil, err
+	}
+	idx.width = entWidth
+	if idx.wide {
+		idx.header = wideHeaderWidth
+		idx.width = wideEntWidth
+	}
 	if err = os.Truncate(
 		f.Name(), int64(c.Segment.MaxIndexBytes),
 	); err != nil {
 		return nil, err
 	}
-	if idx.mmap, err = gommap.Map(
-		idx.file.Fd(),
+	if !c.Segment.NoMmap {
+		idx.remap()
+	}
+	return idx, nil
+}
+
+// writeWideHeader は空のインデックスファイルにワイド形式のヘッダーを書き込みます。
+func (i *index) writeWideHeader() error {
+	h := make([]byte, wideHeaderWidth)
+	enc.PutUint32(h[:4], wideMarker)
+	enc.PutUint32(h[4:], uint32(wideOffWidth))
+	if _, err := i.file.WriteAt(h, 0); err != nil {
+		return err
+	}
+	i.wide = true
+	i.size = wideHeaderWidth
+	return nil
+}
+
+// isWideIndex は既存のインデックスファイルの先頭を読み、ワイド形式のヘッダーを持つかを判定します。
+// ヘッダーのオフセットの幅が未知の値の場合はエラーを返します。
+func isWideIndex(f *os.File) (bool, error) {
+	h := make([]byte, wideHeaderWidth)
+	if _, err := f.ReadAt(h, 0); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	if enc.Uint32(h[:4]) != wideMarker {
+		return false, nil
+	}
+	if w := enc.Uint32(h[4:]); uint64(w) != wideOffWidth {
+		return false, fmt.Errorf("unsupported index offset width: %d", w)
+	}
+	return true, nil
+}
+
+// remap はインデックスファイルをメモリにマッピングします。
+// 32 ビット環境やメモリ不足でマッピングできない場合は、ファイル I/O にフォールバックします。
+func (i *index) remap() {
+	mmap, err := gommap.Map(
+		i.file.Fd(),
 		gommap.PROT_READ|gommap.PROT_WRITE,
 		gommap.MAP_SHARED,
-	); err != nil {
-		return nil, err
+	)
+	if err != nil {
+		return
 	}
-	return idx, nil
+	i.mmap = mmap
+}
+
+// release はメモリマップを同期してから解放します。解放後はファイル I/O でエントリを読み書きします。
+func (i *index) release() error {
+	if i.mmap == nil {
+		return nil
+	}
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	if err := i.mmap.UnsafeUnmap(); err != nil {
+		return err
+	}
+	i.mmap = nil
+	return nil
 }
 
 // Close はindexを閉じる処理を行います。メモリマップの同期、ファイルの同期、トランケーション、およびクローズを実行します。
 // エラーが発生した場合、最初に遭遇したエラーを返します。
 func (i *index) Close() error {
-	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
-		return err
+	if i.mmap != nil {
+		if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+			return err
+		}
 	}
 	if err := i.file.Sync(); err != nil {
 		return err
@@ -67,38 +161,75 @@ func (i *index) Close() error {
 // Read は、指定された位置からエントリを読み取り、値、オフセット、およびエラーを返します。
 // 位置が -1 の場合、最後のエントリを読み取ります。
 // ファイルサイズが不正な場合、または範囲外の位置にアクセスすると io.EOF を返します。
-func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
-	if i.size == 0 {
+func (i *index) Read(in int64) (out uint64, pos uint64, err error) {
+	if i.size <= i.header {
 		return 0, 0, io.EOF
 	}
 	if in == -1 {
-		out = uint32((i.size / entWidth) - 1)
+		out = (i.size-i.header)/i.width - 1
 	} else {
-		out = uint32(in)
+		out = uint64(in)
 	}
-	pos = uint64(out) * entWidth
-	if i.size < pos+entWidth {
+	pos = i.header + out*i.width
+	if i.size < pos+i.width {
 		return 0, 0, io.EOF
 	}
-	out = enc.Uint32(i.mmap[pos : pos+offWidth])
-	pos = enc.Uint64(i.mmap[pos+offWidth : pos+entWidth])
+	var ent []byte
+	if i.mmap != nil {
+		ent = i.mmap[pos : pos+i.width]
+	} else {
+		ent = make([]byte, i.width)
+		if _, err = i.file.ReadAt(ent, int64(pos)); err != nil {
+			return 0, 0, err
+		}
+	}
+	if i.wide {
+		out = enc.Uint64(ent[:wideOffWidth])
+		pos = enc.Uint64(ent[wideOffWidth:])
+	} else {
+		out = uint64(enc.Uint32(ent[:offWidth]))
+		pos = enc.Uint64(ent[offWidth:])
+	}
 	return out, pos, nil
 }
 
 // Write は、指定されたオフセットと位置をエントリとしてメモリマップに保存します。マックスに達した場合は io.EOF を返します。
-func (i *index) Write(off uint32, pos uint64) error {
+// ワイド形式でないインデックスに uint32 に収まらないオフセットを書き込もうとした場合は ErrIndexOffsetOverflow を返します。
+func (i *index) Write(off uint64, pos uint64) error {
+	if !i.wide && off > math.MaxUint32 {
+		return ErrIndexOffsetOverflow
+	}
 	if i.isMaxed() {
 		return io.EOF
 	}
-	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
-	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
-	i.size += uint64(entWidth)
+	var ent []byte
+	if i.mmap != nil {
+		ent = i.mmap[i.size : i.size+i.width]
+	} else {
+		ent = make([]byte, i.width)
+	}
+	if i.wide {
+		enc.PutUint64(ent[:wideOffWidth], off)
+		enc.PutUint64(ent[wideOffWidth:], pos)
+	} else {
+		enc.PutUint32(ent[:offWidth], uint32(off))
+		enc.PutUint64(ent[offWidth:], pos)
+	}
+	if i.mmap == nil {
+		if _, err := i.file.WriteAt(ent, int64(i.size)); err != nil {
+			return err
+		}
+	}
+	i.size += i.width
 	return nil
 }
 
-// isMaxed は、メモリマップが容量の上限に達しているかを判定し、達していれば true を返します。
+// isMaxed は、インデックスが容量の上限に達しているかを判定し、達していれば true を返します。
 func (i *index) isMaxed() bool {
-	return uint64(len(i.mmap)) < i.size+entWidth
+	if i.mmap != nil {
+		return uint64(len(i.mmap)) < i.size+i.width
+	}
+	return i.limit < i.size+i.width
 }
 
 // Name は、関連付けられたファイルの名前を文字列として返します。
@@ -2,6 +2,7 @@ package log
 
 import (
 	"io"
+	"math"
 	"os"
 	"testing"
 
@@ -9,12 +10,25 @@ import (
 )
 
 func TestIndex(t *testing.T) {
+	for name, noMmap := range map[string]bool{
+		"mmap":    false,
+		"no mmap": true,
+	} {
+		t.Run(name, func(t *testing.T) {
+			testIndex(t, noMmap)
+		})
+	}
+}
+
+// testIndex は、メモリマッピングの有無にかかわらずインデックスが同じように読み書きできることを検証します。
+func testIndex(t *testing.T, noMmap bool) {
 	f, err := os.CreateTemp(os.TempDir(), "index_test")
 	require.NoError(t, err)
 	defer func() { _ = os.Remove(f.Name()) }()
 
 	c := Config{}
 	c.Segment.MaxIndexBytes = 1024
+	c.Segment.NoMmap = noMmap
 	idx, err := newIndex(f, c)
 	require.NoError(t, err)
 	_, _, err = idx.Read(-1)
@@ -22,7 +36,7 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, f.Name(), idx.Name())
 
 	entries := []struct {
-		Off uint32
+		Off uint64
 		Pos uint64
 	}{
 		{Off: 0, Pos: 0},
@@ -48,6 +62,68 @@ func TestIndex(t *testing.T) {
 	require.NoError(t, err)
 	off, pos, err := idx.Read(-1)
 	require.NoError(t, err)
-	require.Equal(t, uint32(1), off)
+	require.Equal(t, uint64(1), off)
 	require.Equal(t, entries[1].Pos, pos)
+
+	// 容量の上限に達すると、インデックスは io.EOF を返す
+	for n := uint64(len(entries)); n < c.Segment.MaxIndexBytes/entWidth; n++ {
+		require.NoError(t, idx.Write(n, n*10))
+	}
+	require.Equal(t, io.EOF, idx.Write(0, 0))
+	require.NoError(t, idx.Close())
+}
+
+// TestIndexWide は、ワイド形式のインデックスが uint32 を超えるオフセットを読み書きでき、
+// 再オープン時には設定にかかわらずヘッダーから形式を判定することを検証します。
+func TestIndexWide(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_test")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = wideHeaderWidth + wideEntWidth*3
+	c.Segment.WideIndex = true
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	_, _, err = idx.Read(-1)
+	require.Equal(t, io.EOF, err)
+
+	entries := []struct {
+		Off uint64
+		Pos uint64
+	}{
+		{Off: 0, Pos: 0},
+		{Off: math.MaxUint32 + 1, Pos: 10},
+		{Off: math.MaxUint64 - 1, Pos: 20},
+	}
+	for n, want := range entries {
+		require.NoError(t, idx.Write(want.Off, want.Pos))
+		off, pos, err := idx.Read(int64(n))
+		require.NoError(t, err)
+		require.Equal(t, want.Off, off)
+		require.Equal(t, want.Pos, pos)
+	}
+	require.Equal(t, io.EOF, idx.Write(0, 0))
+	require.NoError(t, idx.Close())
+
+	// 設定がワイド形式でなくても、既存のファイルはヘッダーからワイド形式と判定される
+	c.Segment.WideIndex = false
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, entries[2].Off, off)
+	require.Equal(t, entries[2].Pos, pos)
+	require.NoError(t, idx.Close())
+
+	// 従来の形式では uint32 に収まらないオフセットを書き込めない
+	f, err = os.CreateTemp(os.TempDir(), "index_test")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(f.Name()) }()
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	require.Equal(t, ErrIndexOffsetOverflow, idx.Write(math.MaxUint32+1, 0))
+	require.NoError(t, idx.Close())
 }
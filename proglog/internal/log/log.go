@@ -1,13 +1,16 @@
 package log
 
 import (
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/ishisaka/go_distribute/proglog/api/v1"
 )
@@ -16,12 +19,30 @@ import (
 // ディレクトリ内のセグメントを利用してレコードを保存および管理します。
 type Log struct {
 	mu sync.RWMutex
+	// maintenance は Defragment、Truncate、ForceTruncate のようにセグメントの構成を置き換える保守処理を直列化します。
+	// 保守処理は mu より先に取得するため、通常の読み書きは mu だけで従来どおり並行して行えます。
+	maintenance sync.Mutex
 
 	Dir    string
 	Config Config
 
 	activeSegment *segment
 	segments      []*segment
+
+	now      func() time.Time
+	stopIdle chan struct{}
+
+	rolls         []time.Time
+	lastRollAlert time.Time
+
+	closed bool
+
+	last lastAppended
+	// highWatermark は SetHighWatermark で記録した複製済みの最大オフセットで、メモリ上にだけ保持します。
+	highWatermark uint64
+
+	subsMu sync.Mutex
+	subs   map[chan Event]struct{}
 }
 
 // NewLog は新しい永続ログシステムを初期化します。
@@ -34,9 +55,13 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Segment.AlignBytes > MaxAlignBytes {
+		return nil, fmt.Errorf("align bytes %d exceeds the maximum %d", c.Segment.AlignBytes, MaxAlignBytes)
+	}
 	l := &Log{
 		Dir:    dir,
 		Config: c,
+		now:    time.Now,
 	}
 
 	return l, l.setup()
@@ -45,12 +70,22 @@ func NewLog(dir string, c Config) (*Log, error) {
 // setup はログの初期化を行い、既存のセグメントを読み込んで管理対象に設定します。
 // セグメントが存在しない場合は新しいセグメントを作成します。
 func (l *Log) setup() error {
+	l.closed = false
+	l.last = lastAppended{}
+	if err := l.recoverDefragment(); err != nil {
+		return err
+	}
 	files, err := os.ReadDir(l.Dir)
 	if err != nil {
 		return err
 	}
 	var baseOffsets []uint64
 	for _, file := range files {
+		// セグメント以外のファイルやディレクトリは無視する
+		ext := path.Ext(file.Name())
+		if file.IsDir() || (ext != ".store" && ext != ".index") {
+			continue
+		}
 		offStr := strings.TrimSuffix(
 			file.Name(),
 			path.Ext(file.Name()),
@@ -61,13 +96,14 @@ func (l *Log) setup() error {
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
-			return err
-		}
-		// baseOffsetsは、インデックスとストアの二つの重複を含んで
-		// いるので、重複しているものをスキップする
-		i++
+	// baseOffsetsは、インデックスとストアの二つの重複を含んで
+	// いるので、重複しているものをスキップする
+	var unique []uint64
+	for i := 0; i < len(baseOffsets); i += 2 {
+		unique = append(unique, baseOffsets[i])
+	}
+	if err = l.openSegments(unique); err != nil {
+		return err
 	}
 	if l.segments == nil {
 		if err = l.newSegment(
@@ -76,62 +112,250 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if err = l.seal(s); err != nil {
+			return err
+		}
+	}
+	if l.Config.Segment.IdleTimeout > 0 {
+		l.stopIdle = make(chan struct{})
+		go l.releaseIdleLoop(l.stopIdle)
+	}
 	return nil
 }
 
 // Append は指定されたレコードを現在のアクティブセグメントに追加し、その記録のオフセットを返します。
 // 必要に応じて新しいセグメントを作成し、エラーが発生した場合はそれを返します。
+// セグメントの切り替え、ストアとインデックスへの書き込み、nextOffset の更新は書き込みロックの中で行うため、
+// 読み出し側からはインデックスへの書き込みまで完了したレコードだけが見えます。
+// Config.RejectConsecutiveDuplicates が有効で、値が直前のレコードと同じ場合は追加せずに ErrDuplicateRecord を返します。
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	off, _, err := l.AppendWithMeta(record)
+	return off, err
+}
+
+// AppendWithMeta は Append と同様にレコードを追加し、オフセットに加えて書き込んだセグメントのベースオフセットを返します。
+// 書き込みと同じロックの中でセグメントを決めるため、後から Segments で調べる場合と異なり、他の書き込みによるセグメントの切り替えと競合しません。
+func (l *Log) AppendWithMeta(record *api.Record) (offset, segmentBase uint64, err error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-
-	highestOffset, err := l.highestOffset()
-	if err != nil {
-		return 0, err
+	if l.closed {
+		return 0, 0, ErrLogClosed
+	}
+	if err = l.checkConsecutiveDuplicate(record.Value); err != nil {
+		return 0, 0, err
 	}
 
 	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(highestOffset + 1)
-		if err != nil {
-			return 0, err
+		// 新しいセグメントは、アクティブセグメントが次に書き込むはずだったオフセットから始める
+		if err = l.roll(l.activeSegment.nextOffset); err != nil {
+			return 0, 0, err
 		}
 	}
 
+	l.activeSegment.mu.Lock()
 	off, err := l.activeSegment.Append(record)
+	l.activeSegment.mu.Unlock()
+	l.activeSegment.touch(l.now())
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
+	l.rememberAppended(record.Value)
 
-	return off, err
+	return off, l.activeSegment.baseOffset, nil
+}
+
+// Seal はアクティブセグメントを封印し、以降の書き込みを新しいセグメントに向けます。
+// 封印されたセグメントは書き込まれなくなるため、バックアップのために安全にコピーできます。
+// アクティブセグメントが空の場合は何もしません。
+func (l *Log) Seal() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+
+	if l.activeSegment.nextOffset == l.activeSegment.baseOffset {
+		return nil
+	}
+	return l.roll(l.activeSegment.nextOffset)
 }
 
 // Read は指定されたオフセットからレコードを読み込みます。
 // 該当するセグメントが見つからない場合、エラーを返します。
-// メソッドはスレッドセーフであり、読み取りロックを使用します。
+// メソッドはスレッドセーフであり、セグメント単位の読み取りロックを使用するため、異なるセグメントの読み出しは並行して進みます。
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	s, err := l.acquireSegment(off)
+	if err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+	return s.Read(off)
+}
+
+// readBufPool は ReadInto がストアのデータを読み込むためのバッファを再利用するためのプールです。
+var readBufPool = sync.Pool{
+	New: func() any {
+		return new([]byte)
+	},
+}
+
+// ReadInto は Read と同様に指定されたオフセットからレコードを読み込みますが、新しいレコードを確保せずに record へ読み込みます。
+// ストアのデータはプールしたバッファに読み込むため、大量のレコードを読み出す場合のメモリ確保を減らせます。
+// record の内容は、同じ record に対して次に ReadInto を呼び出すまでの間だけ有効です。
+func (l *Log) ReadInto(off uint64, record *api.Record) error {
+	s, err := l.acquireSegment(off)
+	if err != nil {
+		return err
+	}
+	defer s.mu.RUnlock()
+	buf := readBufPool.Get().(*[]byte)
+	defer readBufPool.Put(buf)
+	*buf, err = s.ReadInto(off, record, *buf)
+	return err
+}
+
+// acquireSegment は指定されたオフセットのレコードを含むセグメントを探し、その読み取りロックを取得して返します。
+// アイドル状態で解放されていたセグメントは、読み出しの前に再びマッピングします。
+// ログ全体のロックはセグメントを探す間だけ保持し、セグメントのロックを取得してから解放します。
+// 該当するセグメントがない場合は api.ErrOffsetOutOfRange を、ログが閉じられている場合は ErrLogClosed を返します。
+// 呼び出し側は読み出し後にセグメントの読み取りロックを解放する必要があります。
+func (l *Log) acquireSegment(off uint64) (*segment, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var s *segment
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	s := l.segmentFor(off)
+	if s == nil {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	if s.released.Load() {
+		s.mu.Lock()
+		if s.released.Load() {
+			s.reopen()
+		}
+		s.mu.Unlock()
+	}
+	s.mu.RLock()
+	s.touch(l.now())
+	return s, nil
+}
+
+// Exists は指定されたオフセットのレコードがログに存在するかを、ストアの値を読まずにセグメントの範囲とインデックスだけで判定します。
+// ログの範囲外のオフセット、Truncate で削除されたオフセット、セグメントの間の欠番、およびログが閉じられている場合は false を返します。
+// アイドル状態で解放されたセグメントも再びマッピングせずに判定します。
+func (l *Log) Exists(off uint64) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return false
+	}
+	s := l.segmentFor(off)
+	if s == nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rel, _, err := s.index.Read(int64(off - s.baseOffset))
+	return err == nil && rel == off-s.baseOffset
+}
+
+// ReadValueRange は指定されたオフセットのレコードの値のうち、start から length バイトだけを読み出します。
+// length が 0 の場合は値の末尾までを読み出します。大きなレコードの一部だけが必要な場合に、値全体を読み込まずに済みます。
+// 範囲が値の長さを超える場合は api.ErrInvalidArgument を返します。
+func (l *Log) ReadValueRange(off, start, length uint64) ([]byte, error) {
+	s, err := l.acquireSegment(off)
+	if err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+	return s.ReadValueRange(off, start, length)
+}
+
+// Prefetch は offsets のレコードをストアから OS のページキャッシュに読み込むよう促し、直後の読み出しの遅延を減らします。
+// レコードの内容は返しません。ログに存在しないオフセットは無視します。
+func (l *Log) Prefetch(offsets []uint64) error {
+	for _, off := range offsets {
+		s, err := l.acquireSegment(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = s.prefetch(off)
+		s.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadRef は指定されたオフセットのレコードを protobuf でエンコードしたバイト列を、可能であればコピーせずに返します。
+// MmapStore が有効で、レコードが封印済みセグメントにある場合、返すバイト列はストアのメモリマップを直接参照します。
+// それ以外の場合はコピーを返します。
+//
+// 呼び出し側はバイト列を使い終えたら、必ず一度だけ release を呼び出す必要があります。
+// メモリマップを参照している場合は、release を呼び出すまでそのセグメントの読み取りロックを保持するため、
+// そのセグメントは閉じることも削除することもできず、Truncate や Close は待機します。
+// コピーを返す場合はロックを返す前に解放するため、アクティブセグメントのレコードを保持したままでも Append できます。
+// バイト列は読み取り専用で、書き換えてはいけません。また release を呼び出した後に参照してはいけません。
+func (l *Log) ReadRef(off uint64) (b []byte, release func(), err error) {
+	s, err := l.acquireSegment(off)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, shared, err := s.ReadRef(off)
+	if err != nil || !shared {
+		s.mu.RUnlock()
+		if err != nil {
+			return nil, nil, err
+		}
+		return b, func() {}, nil
+	}
+	var once sync.Once
+	return b, func() { once.Do(s.mu.RUnlock) }, nil
+}
+
+// segmentFor は指定されたオフセットのレコードを含むセグメントを返します。該当するセグメントがない場合は nil を返します。
+// 呼び出し側で読み取りロックを取得している必要があります。
+func (l *Log) segmentFor(off uint64) *segment {
 	for _, segment := range l.segments {
 		// nolint:all
 		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
-			break
+			return segment
 		}
 	}
-	if s == nil || s.nextOffset <= off {
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
-	}
-	return s.Read(off)
+	return nil
 }
 
 // Close はログとその内部セグメントをクローズし、必要に応じてリソースを解放します。
 // エラーが発生した場合、そのエラーを返します。スレッドセーフです。
+// 各セグメントは読み出し中の操作が終わるのを待ってから閉じ、閉じた後の読み書きは ErrLogClosed を返します。
+// 既に閉じられている場合は何もしません。
 func (l *Log) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	return l.close()
+}
+
+// close は Close の本体です。呼び出し側で書き込みロックを取得している必要があります。
+func (l *Log) close() error {
+	l.closed = true
+	if l.stopIdle != nil {
+		close(l.stopIdle)
+		l.stopIdle = nil
+	}
 	for _, segment := range l.segments {
-		if err := segment.Close(); err != nil {
+		segment.mu.Lock()
+		err := segment.Close()
+		segment.mu.Unlock()
+		if err != nil {
 			return err
 		}
 	}
@@ -155,6 +379,37 @@ func (l *Log) Reset() error {
 	return l.setup()
 }
 
+// SegmentInfo はセグメントが保持するレコードの範囲です。BaseOffset から NextOffset の手前までのレコードを保持します。
+type SegmentInfo struct {
+	BaseOffset uint64
+	NextOffset uint64
+}
+
+// Segments は現在のセグメントの範囲を、ベースオフセットの昇順で返します。
+func (l *Log) Segments() []SegmentInfo {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	infos := make([]SegmentInfo, len(l.segments))
+	for i, s := range l.segments {
+		infos[i] = SegmentInfo{BaseOffset: s.baseOffset, NextOffset: s.nextOffset}
+	}
+	return infos
+}
+
+// NextSegmentOffset は off を含むセグメントの次のセグメントのベースオフセットを返します。
+// セグメント単位でログを分担して読み出すコンシューマーが、担当の境界で読み出しを止めるために使います。
+// off がアクティブセグメントに含まれる場合や、どのセグメントにも含まれない場合は false を返します。
+func (l *Log) NextSegmentOffset(off uint64) (uint64, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for i, s := range l.segments[:len(l.segments)-1] {
+		if s.baseOffset <= off && off < s.nextOffset {
+			return l.segments[i+1].baseOffset, true
+		}
+	}
+	return 0, false
+}
+
 // LowestOffset はログ内で利用可能な最小のオフセットを返します。スレッドセーフで読み取りロックを使用します。
 // エラーが発生した場合はそのエラーを返します。
 func (l *Log) LowestOffset() (uint64, error) {
@@ -172,6 +427,28 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return l.highestOffset()
 }
 
+// HighWatermark は複製済みの最大オフセット（ハイウォーターマーク）を返します。
+// Config.TrackHighWatermark が有効な場合は SetHighWatermark で記録した値を返し、まだ記録していない場合は 0 を返します。
+// 有効でない場合は複製を考慮しない単一ノードのログとして、HighestOffset と同じ値を返します。
+func (l *Log) HighWatermark() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if !l.Config.TrackHighWatermark {
+		off, _ := l.highestOffset()
+		return off
+	}
+	return l.highWatermark
+}
+
+// SetHighWatermark は複製の確認応答から求めたハイウォーターマーク off を記録します。
+// ハイウォーターマークは戻らず、最大オフセットを超える値は最大オフセットに切り詰めます。
+func (l *Log) SetHighWatermark(off uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	highest, _ := l.highestOffset()
+	l.highWatermark = max(l.highWatermark, min(off, highest))
+}
+
 // highestOffset は、現在のセグメントにおける最大のオフセットを計算して返します。
 // セグメントが空の場合は 0 を返します。
 // nolint:revive
@@ -184,13 +461,63 @@ func (l *Log) highestOffset() (uint64, error) {
 }
 
 // Truncate は指定されたオフセットよりも小さい範囲のログセグメントを削除し、リソースを解放します。
+// lowest が最大オフセット以上でアクティブセグメントまで削除されてしまう場合は ErrInvalidTruncate を返します。
+// Config.MinConsumedOffsetFunc が設定されている場合は、まだ消費されていないレコードを残すように lowest を切り詰めます。
+// MinConsumedOffsetFunc が 0 を返し、まだ何も消費されていない場合は何も削除せずに ErrNothingConsumed を返します。
+// セグメントを削除した場合は、削除した最後のオフセットを EventTruncated として購読者に通知します。
 func (l *Log) Truncate(lowest uint64) error {
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.truncate(lowest, false)
+}
+
+// ForceTruncate は Truncate と同様にセグメントを削除しますが、lowest の検証や消費済みオフセットによる制限を行いません。
+// 全てのセグメントが削除された場合は、lowest+1 を基準とした新しいアクティブセグメントを作成します。
+func (l *Log) ForceTruncate(lowest uint64) error {
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.truncate(lowest, true)
+}
+
+// truncate は Truncate と ForceTruncate の共通処理です。呼び出し側で書き込みロックを取得している必要があります。
+func (l *Log) truncate(lowest uint64, force bool) error {
+	if l.closed {
+		return ErrLogClosed
+	}
+	highest, err := l.highestOffset()
+	if err != nil {
+		return err
+	}
+	if !force && lowest >= highest {
+		return ErrInvalidTruncate
+	}
+	if lowest == math.MaxUint64 {
+		// lowest+1 から始まるセグメントを作れないため、オフセットが 0 に戻らないように拒否する
+		return ErrOffsetSpaceExhausted
+	}
+	if !force && l.Config.MinConsumedOffsetFunc != nil {
+		minConsumed := l.Config.MinConsumedOffsetFunc()
+		if minConsumed == 0 {
+			return ErrNothingConsumed
+		}
+		if lowest >= minConsumed {
+			lowest = minConsumed - 1
+		}
+	}
 	var segments []*segment
+	removed := false
 	for _, s := range l.segments {
 		if s.nextOffset <= lowest+1 {
-			if err := s.Remove(); err != nil {
+			removed = true
+			// 読み出し中のレコードがあれば、読み終わるのを待ってから削除する
+			s.mu.Lock()
+			err := s.Remove()
+			s.mu.Unlock()
+			if err != nil {
 				return err
 			}
 			continue
@@ -198,6 +525,16 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	if len(l.segments) == 0 {
+		// 直前のレコードも削除されたため、次の Append で最後のレコードを読み込み直す
+		l.last = lastAppended{}
+		if err = l.newSegment(lowest + 1); err != nil {
+			return err
+		}
+	}
+	if removed {
+		l.publish(Event{Type: EventTruncated, Offset: l.segments[0].baseOffset - 1})
+	}
 	return nil
 }
 
@@ -227,6 +564,92 @@ func (o *originReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// releaseIdleLoop は stop が閉じられるまで、IdleTimeout ごとにアイドル状態のセグメントを解放します。
+func (l *Log) releaseIdleLoop(stop chan struct{}) {
+	ticker := time.NewTicker(l.Config.Segment.IdleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			// 解放に失敗したセグメントはそのまま使用できるため、次の機会に再試行する
+			_ = l.releaseIdle()
+		}
+	}
+}
+
+// releaseIdle は IdleTimeout 以上読み書きされていない封印済みセグメントのメモリマップとバッファを解放します。
+// アクティブセグメントは解放しません。
+func (l *Log) releaseIdle() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if s.released.Load() || !s.idle(now, l.Config.Segment.IdleTimeout) {
+			continue
+		}
+		s.mu.Lock()
+		err := s.release()
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// roll はアクティブセグメントを off を基準とした新しいセグメントに切り替え、切り替えの頻度を確認します。
+func (l *Log) roll(off uint64) error {
+	sealed := l.activeSegment
+	if err := l.newSegment(off); err != nil {
+		return err
+	}
+	sealed.mu.Lock()
+	err := l.seal(sealed)
+	sealed.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	l.checkRollRate()
+	return nil
+}
+
+// seal は書き込まれなくなったセグメント s のストアから事前に確保したブロックの余りを解放し、
+// MmapStore が有効な場合に読み取り専用でメモリマッピングします。
+// 呼び出し側でセグメントの書き込みロックを取得しているか、s を他から参照できない状態である必要があります。
+func (l *Log) seal(s *segment) error {
+	if err := s.store.trim(); err != nil {
+		return err
+	}
+	if !l.Config.Segment.MmapStore {
+		return nil
+	}
+	return s.store.mapReadOnly()
+}
+
+// checkRollRate は直近 RollRateWindow の間のセグメントの切り替え頻度を計算し、
+// MaxRollRate を超えていれば OnExcessiveRolls を呼び出します。OnExcessiveRolls が未設定の場合は何もしません。
+func (l *Log) checkRollRate() {
+	window := l.Config.RollRateWindow
+	if l.Config.OnExcessiveRolls == nil || window <= 0 {
+		return
+	}
+	now := l.now()
+	l.rolls = append(l.rolls, now)
+	i := 0
+	for i < len(l.rolls) && now.Sub(l.rolls[i]) > window {
+		i++
+	}
+	l.rolls = l.rolls[i:]
+	rate := float64(len(l.rolls)) / window.Seconds()
+	if rate <= l.Config.MaxRollRate || now.Sub(l.lastRollAlert) < window {
+		return
+	}
+	l.lastRollAlert = now
+	l.Config.OnExcessiveRolls(rate)
+}
+
 // newSegment は指定されたオフセットを基準に新しいセグメントを作成し、現在のアクティブセグメントとして設定します。
 // セグメント作成に失敗した場合はエラーを返します。
 func (l *Log) newSegment(off uint64) error {
@@ -238,3 +661,46 @@ func (l *Log) newSegment(off uint64) error {
 	l.activeSegment = s
 	return nil
 }
+
+// openSegments は baseOffsets のセグメントを開き、ベースオフセットの順に segments に追加します。
+// Config.SetupConcurrency が 1 より大きい場合は、最大その数のセグメントを並行して開きます。
+// 開けないセグメントがあった場合は、開いたセグメントをすべて閉じて最初のエラーを返します。
+func (l *Log) openSegments(baseOffsets []uint64) error {
+	if len(baseOffsets) == 0 {
+		return nil
+	}
+	workers := l.Config.SetupConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	segments := make([]*segment, len(baseOffsets))
+	errs := make([]error, len(baseOffsets))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, off := range baseOffsets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, off uint64) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			segments[i], errs[i] = newSegment(l.Dir, off, l.Config)
+		}(i, off)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		for _, s := range segments {
+			if s != nil {
+				_ = s.Close()
+			}
+		}
+		return err
+	}
+	l.segments = append(l.segments, segments...)
+	l.activeSegment = l.segments[len(l.segments)-1]
+	return nil
+}
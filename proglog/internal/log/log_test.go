@@ -1,10 +1,17 @@
 package log
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	api "github.com/ishisaka/go_distribute/proglog/api/v1"
 	"github.com/stretchr/testify/require"
@@ -20,6 +27,12 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"truncate past end fails":           testTruncateInvalid,
+		"force truncate":                    testForceTruncate,
+		"defragment":                        testDefragment,
+		"truncate keeps unconsumed records": testTruncateUnconsumed,
+		"seal":                              testSeal,
+		"read into a reused record":         testReadInto,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := os.MkdirTemp("", "store-test")
@@ -36,6 +49,80 @@ func TestLog(t *testing.T) {
 	}
 }
 
+// TestLogMaxRecords は MaxRecords を設定した場合、バイト数の上限に達していなくても
+// レコード数が上限に達した時点で新しいセグメントが作成されることを検証します。
+func TestLogMaxRecords(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-max-records-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := Config{}
+	c.Segment.MaxRecords = 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	apiAppend := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(apiAppend)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, len(log.segments))
+
+	off, err := log.Append(apiAppend)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.Equal(t, 2, len(log.segments))
+	require.Equal(t, uint64(3), log.activeSegment.baseOffset)
+	require.NoError(t, log.Close())
+}
+
+// TestLogOffsetSpaceExhausted は、オフセットが uint64 の上限に近づいてもセグメントの切り替えで 0 に戻らず、
+// 上限に達した時点で ErrOffsetSpaceExhausted を返すことを検証します。
+func TestLogOffsetSpaceExhausted(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxRecords = 1
+	c.Segment.InitialOffset = math.MaxUint64 - 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer func() { _ = log.Close() }()
+
+	apiAppend := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for want := uint64(math.MaxUint64 - 2); want < math.MaxUint64; want++ {
+		off, err := log.Append(apiAppend)
+		require.NoError(t, err)
+		require.Equal(t, want, off)
+	}
+	_, err = log.Append(apiAppend)
+	require.ErrorIs(t, err, ErrOffsetSpaceExhausted)
+
+	read, err := log.Read(math.MaxUint64 - 1)
+	require.NoError(t, err)
+	require.Equal(t, apiAppend.Value, read.Value)
+
+	require.ErrorIs(t, log.ForceTruncate(math.MaxUint64), ErrOffsetSpaceExhausted)
+}
+
+// TestLogAppendWithMeta は、AppendWithMeta が返すセグメントのベースオフセットがセグメントの切り替えで変わることを検証します。
+func TestLogAppendWithMeta(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 3
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer func() { _ = log.Close() }()
+
+	for i, want := range []uint64{0, 0, 0, 3, 3} {
+		off, base, err := log.AppendWithMeta(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+		require.Equal(t, want, base)
+	}
+}
+
 func testAppendRead(t *testing.T, log *Log) {
 	apiAppend := &api.Record{
 		Value: []byte("hello world"),
@@ -122,3 +209,919 @@ func testTruncate(t *testing.T, log *Log) {
 	require.Error(t, err)
 	require.NoError(t, log.Close())
 }
+
+func testTruncateInvalid(t *testing.T, log *Log) {
+	apiAppend := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(apiAppend)
+		require.NoError(t, err)
+	}
+
+	err := log.Truncate(2)
+	require.Equal(t, ErrInvalidTruncate, err)
+	err = log.Truncate(10)
+	require.Equal(t, ErrInvalidTruncate, err)
+
+	// 拒否された場合はデータが残っている
+	_, err = log.Read(0)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+}
+
+func testForceTruncate(t *testing.T, log *Log) {
+	apiAppend := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(apiAppend)
+		require.NoError(t, err)
+	}
+
+	err := log.ForceTruncate(2)
+	require.NoError(t, err)
+
+	_, err = log.Read(2)
+	require.Error(t, err)
+
+	// 全て削除された後も、オフセットを引き継いで追記できる
+	off, err := log.Append(apiAppend)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, log.Close())
+}
+
+func testDefragment(t *testing.T, log *Log) {
+	apiAppend := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(apiAppend)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 5, len(log.segments))
+	// 削除済みのレコードは Truncate がセグメント単位で削除し、残ったセグメントを Defragment で詰め直す
+	require.NoError(t, log.Truncate(1))
+	require.Equal(t, 4, len(log.segments))
+	before := dirSize(t, log.Dir)
+	events, unsubscribe := log.Subscribe()
+	defer unsubscribe()
+
+	// セグメントの設定サイズを大きくしてから詰め直す
+	log.Config.Segment.MaxStoreBytes = 1024
+	require.NoError(t, log.Defragment())
+	require.Equal(t, 2, len(log.segments))
+	require.Less(t, dirSize(t, log.Dir), before)
+	require.Equal(t, Event{Type: EventCompacted, Offset: 7}, <-events)
+
+	// 詰め直してもセグメントの構成が変わらない場合は置き換えず、通知もしない
+	require.NoError(t, log.Defragment())
+	require.Equal(t, 2, len(log.segments))
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event: %v", e)
+	default:
+	}
+	_, err := os.Stat(filepath.Join(log.Dir, defragmentDir))
+	require.True(t, os.IsNotExist(err))
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	for i := uint64(2); i < 10; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+		require.Equal(t, apiAppend.Value, read.Value)
+	}
+	require.NoError(t, log.Close())
+
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	for i := uint64(2); i < 10; i++ {
+		_, err = n.Read(i)
+		require.NoError(t, err)
+	}
+	require.NoError(t, n.Close())
+}
+
+// dirSize はディレクトリ内のファイルサイズの合計を返します。
+func dirSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return size
+}
+
+func testTruncateUnconsumed(t *testing.T, log *Log) {
+	apiAppend := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(apiAppend)
+		require.NoError(t, err)
+	}
+	// まだ何も消費されていなければ何も削除しない
+	log.Config.MinConsumedOffsetFunc = func() uint64 { return 0 }
+	require.ErrorIs(t, log.Truncate(3), ErrNothingConsumed)
+	_, err := log.Read(0)
+	require.NoError(t, err)
+
+	// オフセット 2 以降はまだ消費されていない
+	log.Config.MinConsumedOffsetFunc = func() uint64 { return 2 }
+
+	err = log.Truncate(3)
+	require.NoError(t, err)
+
+	_, err = log.Read(0)
+	require.Error(t, err)
+	for off := uint64(2); off < 6; off++ {
+		_, err = log.Read(off)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+}
+
+func testSeal(t *testing.T, log *Log) {
+	// 空のアクティブセグメントの封印は何もしない
+	require.NoError(t, log.Seal())
+	require.Equal(t, 1, len(log.segments))
+
+	apiAppend := &api.Record{
+		Value: []byte("hello world"),
+	}
+	_, err := log.Append(apiAppend)
+	require.NoError(t, err)
+
+	sealed := log.activeSegment
+	require.NoError(t, log.Seal())
+	require.Equal(t, 2, len(log.segments))
+	require.NotSame(t, sealed, log.activeSegment)
+	require.Same(t, sealed, log.segments[0])
+	require.Equal(t, uint64(1), log.activeSegment.baseOffset)
+
+	off, err := log.Append(apiAppend)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.Equal(t, uint64(1), sealed.nextOffset)
+	require.NoError(t, log.Close())
+}
+
+// testReadInto は、同じレコードを再利用して ReadInto で読み出した場合でも、各オフセットのレコードを正しく読み出せることを検証します。
+func testReadInto(t *testing.T, log *Log) {
+	for _, value := range []string{"first", "second record", "3"} {
+		_, err := log.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+
+	record := &api.Record{}
+	for off, want := range []string{"first", "second record", "3"} {
+		require.NoError(t, log.ReadInto(uint64(off), record))
+		require.Equal(t, uint64(off), record.Offset)
+		require.Equal(t, want, string(record.Value))
+	}
+
+	err := log.ReadInto(3, record)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+	require.NoError(t, log.Close())
+}
+
+// benchmarkLog はベンチマーク用に n 件のレコードを書き込んだログを作成します。
+func benchmarkLog(b *testing.B, n int) *Log {
+	b.Helper()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024 * 1024
+	c.Segment.MaxIndexBytes = 1024 * 1024
+	log, err := NewLog(b.TempDir(), c)
+	require.NoError(b, err)
+	b.Cleanup(func() { _ = log.Close() })
+	for i := 0; i < n; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(b, err)
+	}
+	return log
+}
+
+// TestLogIdleSegments は、IdleTimeout を過ぎた封印済みセグメントのメモリマップが解放され、
+// 解放後も読み出すことができ、読み出した時点で再びマッピングされることを検証します。
+func TestLogIdleSegments(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 2
+	c.Segment.IdleTimeout = time.Minute
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer func() { _ = log.Close() }()
+	clock := time.Now()
+	log.now = func() time.Time { return clock }
+
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 3)
+
+	// タイムアウト前は解放しない
+	require.NoError(t, log.releaseIdle())
+	for _, s := range log.segments {
+		require.False(t, s.released.Load())
+	}
+
+	clock = clock.Add(2 * time.Minute)
+	require.NoError(t, log.releaseIdle())
+	for _, s := range log.segments[:2] {
+		require.True(t, s.released.Load())
+		require.Nil(t, s.index.mmap)
+	}
+	require.False(t, log.activeSegment.released.Load())
+	require.NotNil(t, log.activeSegment.index.mmap)
+
+	for off := uint64(0); off < 5; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	for _, s := range log.segments {
+		require.False(t, s.released.Load())
+		require.NotNil(t, s.index.mmap)
+	}
+}
+
+// TestLogTailAcrossRolls は、セグメントが頻繁に切り替わる中で書き込みと末尾の読み出しを並行して行った場合に、
+// 読み出し側が全てのオフセットを欠落や重複なく一度ずつ読み出せることを検証します。
+func TestLogTailAcrossRolls(t *testing.T) {
+	const n = 2000
+	c := Config{}
+	c.Segment.MaxRecords = 3
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer func() { _ = log.Close() }()
+
+	go func() {
+		for i := 0; i < n; i++ {
+			if _, err := log.Append(&api.Record{Value: []byte("hello world")}); err != nil {
+				return
+			}
+		}
+	}()
+
+	var seen []uint64
+	deadline := time.Now().Add(10 * time.Second)
+	for off := uint64(0); off < n; {
+		record, err := log.Read(off)
+		var outOfRange api.ErrOffsetOutOfRange
+		if errors.As(err, &outOfRange) {
+			// まだ書き込まれていないので、同じオフセットを読み直す
+			require.True(t, time.Now().Before(deadline), "timed out at offset %d", off)
+			continue
+		}
+		require.NoError(t, err)
+		seen = append(seen, record.Offset)
+		off++
+	}
+	for i, off := range seen {
+		require.Equal(t, uint64(i), off)
+	}
+}
+
+// TestLogExcessiveRolls は、小さなセグメントでセグメントが頻繁に切り替わった場合に、
+// OnExcessiveRolls が妥当な切り替え頻度とともに RollRateWindow ごとに 1 回だけ呼び出されることを検証します。
+func TestLogExcessiveRolls(t *testing.T) {
+	var rates []float64
+	c := Config{}
+	c.Segment.MaxRecords = 1
+	c.RollRateWindow = time.Second
+	c.MaxRollRate = 5
+	c.OnExcessiveRolls = func(rate float64) {
+		rates = append(rates, rate)
+	}
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer func() { _ = log.Close() }()
+	clock := time.Now()
+	log.now = func() time.Time { return clock }
+
+	appendRecord := func() {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		clock = clock.Add(100 * time.Millisecond)
+	}
+	// 100ms ごとに切り替わるので、6 回目の切り替えで 6 回/秒になる
+	for i := 0; i < 7; i++ {
+		appendRecord()
+	}
+	require.Equal(t, []float64{6}, rates)
+
+	// 同じ期間内には再度呼び出さない
+	for i := 0; i < 5; i++ {
+		appendRecord()
+	}
+	require.Len(t, rates, 1)
+
+	// 期間が過ぎた後も頻度が高ければ再度呼び出す
+	for i := 0; i < 5; i++ {
+		appendRecord()
+	}
+	require.Len(t, rates, 2)
+	require.Greater(t, rates[1], c.MaxRollRate)
+}
+
+// TestLogReadRef は、MmapStore を有効にしたログから ReadRef で読み出したバイト列がレコードと一致し、
+// 封印済みセグメントではメモリマップを参照していること、release するまでログを閉じられないことを検証します。
+func TestLogReadRef(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 2
+	c.Segment.MmapStore = true
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NotNil(t, log.segments[0].store.mmap)
+	require.Nil(t, log.activeSegment.store.mmap)
+
+	// 封印済みセグメントとアクティブセグメントのどちらからも読み出せる
+	for _, off := range []uint64{4, 1} {
+		b, release, err := log.ReadRef(off)
+		require.NoError(t, err)
+		record := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b, record))
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), record.Value)
+		release()
+	}
+
+	// アクティブセグメントのコピーはロックを保持しないため、release する前に同じセグメントへ書き込める
+	_, release, err := log.ReadRef(4)
+	require.NoError(t, err)
+	appended := make(chan error)
+	go func() {
+		_, err := log.Append(&api.Record{Value: []byte("record 5")})
+		appended <- err
+	}()
+	select {
+	case err = <-appended:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("append blocked by an outstanding ref to the active segment")
+	}
+	release()
+
+	b, release, err := log.ReadRef(0)
+	require.NoError(t, err)
+	mmap := log.segments[0].store.mmap
+	require.Same(t, &mmap[lenWidth], &b[0])
+
+	closed := make(chan error)
+	go func() {
+		closed <- log.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("log closed before release")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case err = <-closed:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("log did not close after release")
+	}
+}
+
+// TestLogPrefetch は、メモリマッピングされたストアと通常のストアのどちらのレコードも Prefetch でき、
+// 存在しないオフセットは無視され、プリフェッチした範囲がメモリに載った状態でその後の読み出しが成功することを検証します。
+func TestLogPrefetch(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 2
+	c.Segment.MmapStore = true
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer func() { _ = log.Close() }()
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, log.Prefetch([]uint64{0, 1, 2, 100}))
+	resident, err := log.segments[0].store.mmap.IsResident()
+	require.NoError(t, err)
+	require.True(t, resident[0])
+	for off := uint64(0); off < 3; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+}
+
+// TestLogConcurrentReadClose は、並行した読み出しの最中に Close してもパニックせず、
+// 閉じた後の読み書きが ErrLogClosed で失敗することを検証します。データ競合の検出には -race を指定して実行します。
+func TestLogConcurrentReadClose(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 4
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for off := uint64(0); ; off = (off + 1) % 20 {
+				_, err := log.Read(off)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, log.Close())
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.ErrorIs(t, err, ErrLogClosed)
+	}
+
+	_, err = log.Read(0)
+	require.ErrorIs(t, err, ErrLogClosed)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.ErrorIs(t, err, ErrLogClosed)
+	require.NoError(t, log.Close())
+}
+
+// TestLogReadValueRange は、ReadValueRange がレコードの値の指定した範囲だけを返し、
+// 値の長さを超える範囲を api.ErrInvalidArgument で拒否することを検証します。
+func TestLogReadValueRange(t *testing.T) {
+	log, err := NewLog(t.TempDir(), Config{})
+	require.NoError(t, err)
+	defer func() { _ = log.Close() }()
+	value := make([]byte, 200)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	_, err = log.Append(&api.Record{Value: nil, Headers: map[string]string{"k": "v"}})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: value, SchemaVersion: 2})
+	require.NoError(t, err)
+
+	b, err := log.ReadValueRange(1, 10, 10)
+	require.NoError(t, err)
+	require.Equal(t, value[10:20], b)
+	b, err = log.ReadValueRange(1, 190, 0)
+	require.NoError(t, err)
+	require.Equal(t, value[190:], b)
+
+	_, err = log.ReadValueRange(1, 195, 10)
+	require.ErrorAs(t, err, &api.ErrInvalidArgument{})
+	_, err = log.ReadValueRange(0, 1, 0)
+	require.ErrorAs(t, err, &api.ErrInvalidArgument{})
+	_, err = log.ReadValueRange(2, 0, 1)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+}
+
+// TestLogConcurrentReadTruncate は、複数のセグメントにまたがる並行した読み出しの最中に
+// 書き込みや Truncate によってセグメントが追加・削除されても、読み出しが範囲外のエラー以外で失敗しないことを検証します。
+// データ競合の検出には -race を指定して実行します。
+func TestLogConcurrentReadTruncate(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 4
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer func() { _ = log.Close() }()
+	for i := 0; i < 64; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for off := uint64(r); ; off = (off + 7) % 128 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				record, err := log.Read(off)
+				var outOfRange api.ErrOffsetOutOfRange
+				if errors.As(err, &outOfRange) {
+					continue
+				}
+				if err == nil && record.Offset != off {
+					err = fmt.Errorf("read offset %d, got %d", off, record.Offset)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(r)
+	}
+	for i := uint64(0); i < 32; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.NoError(t, log.Truncate(i*2))
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+// TestLogConcurrentMaintenance は、書き込みの最中に Defragment と Truncate を並行して実行しても、
+// セグメントが隙間なく連続し、最小から最大までの全てのオフセットを読み出せることを検証します。
+// データ競合の検出には -race を指定して実行します。
+func TestLogConcurrentMaintenance(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 4
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer func() { _ = log.Close() }()
+	for i := 0; i < 32; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	errs := make(chan error, 64)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 16; i++ {
+			if err := log.Defragment(); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := uint64(0); i < 16; i++ {
+			if err := log.Truncate(i * 2); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	for i := 0; i < 32; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	log.mu.RLock()
+	for i := 1; i < len(log.segments); i++ {
+		require.Equal(t, log.segments[i-1].nextOffset, log.segments[i].baseOffset)
+	}
+	log.mu.RUnlock()
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(63), highest)
+	for off := lowest; off <= highest; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+}
+
+// TestLogSetupConcurrency は、SetupConcurrency を指定してセグメントを並行して開いても、
+// セグメントがベースオフセットの順に並び、最後のセグメントがアクティブになることを検証します。
+func TestLogSetupConcurrency(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxRecords = 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 41; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	c.SetupConcurrency = 8
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer func() { _ = log.Close() }()
+
+	require.Len(t, log.segments, 21)
+	for i, s := range log.segments {
+		require.Equal(t, uint64(i*2), s.baseOffset)
+	}
+	require.Equal(t, log.segments[20], log.activeSegment)
+	for i := uint64(0); i < 41; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+	}
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(41), off)
+}
+
+// BenchmarkLogSetup は、2000 個のセグメントを持つログを開く時間を SetupConcurrency ごとに比較します。
+func BenchmarkLogSetup(b *testing.B) {
+	dir := b.TempDir()
+	c := Config{}
+	c.Segment.MaxRecords = 1
+	log, err := NewLog(dir, c)
+	require.NoError(b, err)
+	for i := 0; i < 2000; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(b, err)
+	}
+	require.NoError(b, log.Close())
+
+	for _, concurrency := range []int{1, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			c.SetupConcurrency = concurrency
+			for i := 0; i < b.N; i++ {
+				log, err := NewLog(dir, c)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				if err = log.Close(); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// TestLogMemoryUsage は、MemoryUsage が報告するメモリマップのバイト数がセグメントの数に比例して増えることを検証します。
+func TestLogMemoryUsage(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 1
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer func() { _ = log.Close() }()
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	one := log.MemoryUsage()
+	require.Equal(t, 1, one.Segments)
+	require.NotZero(t, one.MmapBytes)
+	require.NotZero(t, one.BufferBytes)
+
+	for i := 0; i < 4; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	five := log.MemoryUsage()
+	require.Equal(t, 5, five.Segments)
+	require.Equal(t, 5*one.MmapBytes, five.MmapBytes)
+}
+
+// TestLogExportImport は、複数のセグメントを持つログを Export して別のログに Import すると、
+// セグメントの境界とストア、インデックスのファイルが元のログとバイト単位で一致することを検証します。
+func TestLogExportImport(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 3
+	src, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = src.Append(&api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+		require.NoError(t, err)
+	}
+	var archive bytes.Buffer
+	require.NoError(t, src.Export(&archive))
+
+	dst, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	_, err = dst.Append(&api.Record{Value: []byte("replaced")})
+	require.NoError(t, err)
+	require.NoError(t, dst.Import(&archive))
+
+	require.Equal(t, src.Segments(), dst.Segments())
+	for i := uint64(0); i < 10; i++ {
+		read, err := dst.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record-%d", i)), read.Value)
+	}
+	require.NoError(t, src.Close())
+	require.NoError(t, dst.Close())
+
+	for _, info := range src.Segments() {
+		for _, ext := range []string{".store", ".index"} {
+			name := fmt.Sprintf("%d%s", info.BaseOffset, ext)
+			want, err := os.ReadFile(filepath.Join(src.Dir, name))
+			require.NoError(t, err)
+			got, err := os.ReadFile(filepath.Join(dst.Dir, name))
+			require.NoError(t, err)
+			require.Equal(t, want, got, name)
+		}
+	}
+
+	require.ErrorIs(t, dst.Import(bytes.NewReader([]byte("not an archive"))), ErrInvalidArchive)
+}
+
+// BenchmarkLogReadParallel は、多数のセグメントにまたがるオフセットを 32 個の読み出しゴルーチンから並行して読み出します。
+func BenchmarkLogReadParallel(b *testing.B) {
+	c := Config{}
+	c.Segment.MaxRecords = 16
+	log, err := NewLog(b.TempDir(), c)
+	require.NoError(b, err)
+	b.Cleanup(func() { _ = log.Close() })
+	for i := 0; i < 1024; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(b, err)
+	}
+	b.ReportAllocs()
+	b.SetParallelism(32)
+	b.ResetTimer()
+	var next atomic.Uint64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := log.Read(next.Add(1) % 1024); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestLogAppendContiguousAcrossRolls は、セグメントが何度切り替わってもオフセットが途切れずに連続し、
+// 各セグメントが直前のセグメントの次のオフセットから始まることを検証します。
+func TestLogAppendContiguousAcrossRolls(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 3
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer func() { _ = log.Close() }()
+
+	for i := uint64(0); i < 10; i++ {
+		off, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	require.Len(t, log.segments, 4)
+	for i, s := range log.segments {
+		require.Equal(t, uint64(i*3), s.baseOffset)
+	}
+}
+
+// BenchmarkLogAppend は、頻繁にセグメントが切り替わるログへの書き込みにかかる時間を計測します。
+func BenchmarkLogAppend(b *testing.B) {
+	c := Config{}
+	c.Segment.MaxRecords = 1024
+	log, err := NewLog(b.TempDir(), c)
+	require.NoError(b, err)
+	b.Cleanup(func() { _ = log.Close() })
+	record := &api.Record{Value: []byte("hello world")}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := log.Append(record); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLogRead(b *testing.B) {
+	log := benchmarkLog(b, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := log.Read(uint64(i % 1000)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLogReadInto(b *testing.B) {
+	log := benchmarkLog(b, 1000)
+	record := &api.Record{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := log.ReadInto(uint64(i%1000), record); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestLogNextSegmentOffset は、3 つのセグメントからなるログで各オフセットに対して次のセグメントの
+// ベースオフセットが返り、最後のセグメントと範囲外のオフセットでは次がないと報告されることを検証します。
+func TestLogNextSegmentOffset(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 3
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer func() { _ = log.Close() }()
+
+	for i := 0; i < 9; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, len(log.segments))
+
+	for off, want := range []uint64{3, 3, 3, 6, 6, 6} {
+		next, ok := log.NextSegmentOffset(uint64(off))
+		require.True(t, ok)
+		require.Equal(t, want, next)
+	}
+	for _, off := range []uint64{6, 8, 9, 100} {
+		_, ok := log.NextSegmentOffset(off)
+		require.False(t, ok)
+	}
+}
+
+// TestLogExists は、Exists が存在するオフセットに true を返し、最大オフセットより後ろのオフセット、
+// Truncate で削除したオフセット、およびログを閉じた後には false を返すことを検証します。
+func TestLogExists(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxRecords = 3
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+
+	for i := 0; i < 9; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	for off := uint64(0); off < 9; off++ {
+		require.True(t, log.Exists(off))
+	}
+	require.False(t, log.Exists(9))
+	require.False(t, log.Exists(100))
+
+	require.NoError(t, log.Truncate(2))
+	for off := uint64(0); off < 3; off++ {
+		require.False(t, log.Exists(off))
+	}
+	require.True(t, log.Exists(3))
+
+	require.NoError(t, log.Close())
+	require.False(t, log.Exists(3))
+}
+
+// TestLogRejectConsecutiveDuplicates は、RejectConsecutiveDuplicates を有効にしたログが直前と同じ値のレコードを
+// ErrDuplicateRecord で拒否し、別の値を挟んだ場合は受け付けること、ログを開き直した後やセグメントの切り替えを
+// またいでも最後のレコードと比較することを検証します。
+func TestLogRejectConsecutiveDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxRecords = 2
+	c.RejectConsecutiveDuplicates = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	a := &api.Record{Value: []byte("a")}
+	b := &api.Record{Value: []byte("b")}
+	for _, record := range []*api.Record{a, b, a} {
+		_, err = log.Append(record)
+		require.NoError(t, err)
+	}
+	_, err = log.Append(a)
+	require.ErrorIs(t, err, ErrDuplicateRecord)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+
+	_, err = log.Append(a)
+	require.ErrorIs(t, err, ErrDuplicateRecord)
+	off, err := log.Append(b)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// 最後のレコードがある封印済みセグメントの後ろに、空のアクティブセグメントがある状態で開き直す
+	require.NoError(t, log.Seal())
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer func() { _ = log.Close() }()
+	require.Equal(t, uint64(4), log.activeSegment.baseOffset)
+	_, err = log.Append(b)
+	require.ErrorIs(t, err, ErrDuplicateRecord)
+}
@@ -0,0 +1,39 @@
+package log
+
+// MemStats はログがメモリに保持しているデータの量です。
+// MmapBytes はメモリマッピングしているインデックスとストアのバイト数の合計で、
+// BufferBytes はストアが確保している書き込みバッファーのバイト数の合計です。
+type MemStats struct {
+	Segments    int
+	MmapBytes   uint64
+	BufferBytes uint64
+}
+
+// MemoryUsage は現在のセグメント全体がメモリに保持しているデータの量を返します。
+// 読み取りロックの中で全てのセグメントを合計するため、セグメントの切り替えや削除と競合しません。
+// アイドル状態で解放されたセグメントのメモリマップとバッファーは含みません。
+func (l *Log) MemoryUsage() MemStats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stats := MemStats{Segments: len(l.segments)}
+	for _, s := range l.segments {
+		s.mu.RLock()
+		mmap, buf := s.memoryUsage()
+		s.mu.RUnlock()
+		stats.MmapBytes += mmap
+		stats.BufferBytes += buf
+	}
+	return stats
+}
+
+// memoryUsage はセグメントがメモリマッピングしているバイト数と、書き込みバッファーのバイト数を返します。
+// 呼び出し側でセグメントの読み取りロックを取得している必要があります。
+func (s *segment) memoryUsage() (mmap, buf uint64) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	mmap = uint64(len(s.index.mmap)) + uint64(len(s.store.mmap))
+	if s.store.buf != nil {
+		buf = uint64(s.store.buf.Size())
+	}
+	return mmap, buf
+}
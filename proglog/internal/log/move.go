@@ -0,0 +1,146 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Move は停止中のログのデータディレクトリ oldDir を newDir へ移動します。
+// oldDir に対になった .store と .index のセグメントファイルがあることを検証してから移動します。
+// newDir が空でないディレクトリとして既に存在する場合は上書きせずにエラーを返します。
+// 同じファイルシステム内では名前の変更で移動し、ファイルシステムをまたぐ場合はコピーして内容を検証してから oldDir を削除します。
+func Move(oldDir, newDir string) error {
+	if err := checkSegments(oldDir); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(newDir)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case len(entries) > 0:
+		return fmt.Errorf("move log: target %s is not empty", newDir)
+	default:
+		// 空のディレクトリは名前の変更で置き換えられるように削除しておく
+		if err = os.Remove(newDir); err != nil {
+			return err
+		}
+	}
+	if err = os.MkdirAll(filepath.Dir(newDir), 0700); err != nil {
+		return err
+	}
+	err = os.Rename(oldDir, newDir)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	return moveByCopy(oldDir, newDir)
+}
+
+// checkSegments は dir にセグメントが 1 つ以上あり、全てのセグメントで .store と .index の対が揃っていることを確認します。
+func checkSegments(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	pairs := make(map[string]int)
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".store" && ext != ".index") {
+			continue
+		}
+		base := strings.TrimSuffix(e.Name(), ext)
+		if _, err = strconv.ParseUint(base, 10, 64); err != nil {
+			return fmt.Errorf("move log: invalid segment file %s", e.Name())
+		}
+		pairs[base]++
+	}
+	if len(pairs) == 0 {
+		return fmt.Errorf("move log: no segments in %s", dir)
+	}
+	for base, n := range pairs {
+		if n != 2 {
+			return fmt.Errorf("move log: segment %s is missing its store or index", base)
+		}
+	}
+	return nil
+}
+
+// moveByCopy は oldDir 内の全てのファイルを newDir へコピーし、内容が一致することを確認してから oldDir を削除します。
+// 中断された Defragment の一時ディレクトリなど、サブディレクトリがある場合はコピーせずにエラーを返します。
+// 途中で失敗した場合は newDir を削除し、oldDir をそのまま残します。
+func moveByCopy(oldDir, newDir string) (err error) {
+	entries, err := os.ReadDir(oldDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			return fmt.Errorf("move log: unexpected directory %s", e.Name())
+		}
+	}
+	if err = os.Mkdir(newDir, 0700); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(newDir)
+		}
+	}()
+	for _, e := range entries {
+		name := e.Name()
+		src := filepath.Join(oldDir, name)
+		dst := filepath.Join(newDir, name)
+		if err = copyFile(src, dst); err != nil {
+			return err
+		}
+		if err = verifyCopy(src, dst); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(oldDir)
+}
+
+// copyFile は src の内容を dst にコピーし、ディスクへ同期します。
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// verifyCopy は src と dst の内容が一致するかを確認し、一致しない場合はエラーを返します。
+func verifyCopy(src, dst string) error {
+	a, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(dst)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(a, b) {
+		return fmt.Errorf("move log: copy of %s does not match", filepath.Base(src))
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+func TestMove(t *testing.T) {
+	for scenario, move := range map[string]func(oldDir, newDir string) error{
+		"rename": Move,
+		"copy":   moveByCopy,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			oldDir := filepath.Join(t.TempDir(), "old")
+			newDir := filepath.Join(t.TempDir(), "new")
+			c := Config{}
+			c.Segment.MaxStoreBytes = 32
+			writeLog(t, oldDir, c, 5)
+
+			require.NoError(t, move(oldDir, newDir))
+			_, err := os.Stat(oldDir)
+			require.True(t, os.IsNotExist(err))
+
+			log, err := NewLog(newDir, c)
+			require.NoError(t, err)
+			defer func() { _ = log.Close() }()
+			for off := uint64(0); off < 5; off++ {
+				record, err := log.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, off, record.Offset)
+				require.Equal(t, []byte("hello world"), record.Value)
+			}
+		})
+	}
+}
+
+// TestMoveRefusesNonEmptyTarget は、移動先が空でない場合や移動元にセグメントがない場合に、
+// Move がどちらのディレクトリも変更せずにエラーを返すことを検証します。
+func TestMoveRefusesNonEmptyTarget(t *testing.T) {
+	oldDir := filepath.Join(t.TempDir(), "old")
+	newDir := t.TempDir()
+	writeLog(t, oldDir, Config{}, 1)
+	other := filepath.Join(newDir, "other")
+	require.NoError(t, os.WriteFile(other, []byte("keep"), 0600))
+
+	require.Error(t, Move(oldDir, newDir))
+	require.FileExists(t, other)
+	require.FileExists(t, filepath.Join(oldDir, "0.store"))
+
+	require.Error(t, Move(t.TempDir(), filepath.Join(t.TempDir(), "new")))
+}
+
+// writeLog は dir に n 件のレコードを書き込んだログを作成して閉じます。
+func writeLog(t *testing.T, dir string, c Config, n int) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(dir, 0700))
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+}
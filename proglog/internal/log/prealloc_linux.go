@@ -0,0 +1,23 @@
+//go:build linux
+
+package log
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize は fallocate でブロックを確保してもファイルサイズを変えないフラグ（FALLOC_FL_KEEP_SIZE）です。
+const fallocKeepSize = 0x1
+
+// preallocate はファイルサイズを変えずに、f の先頭から size バイトのブロックを確保します。
+// ファイルサイズは変わらないため、O_APPEND での追記やファイルサイズからのストアのサイズの復元には影響しません。
+// ファイルシステムが fallocate に対応していない場合は何もしません。
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return nil
+	}
+	return err
+}
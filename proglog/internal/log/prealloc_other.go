@@ -0,0 +1,10 @@
+//go:build !linux
+
+package log
+
+import "os"
+
+// preallocate は fallocate がないプラットフォームでは何もしません。
+func preallocate(_ *os.File, _ int64) error {
+	return nil
+}
@@ -2,7 +2,11 @@ package log
 
 import (
 	"context"
+	"encoding/json"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -10,19 +14,83 @@ import (
 	api "github.com/ishisaka/go_distribute/proglog/api/v1"
 )
 
+const (
+	// defaultReconnectBackoff は ReconnectBackoff が未設定の場合に、ストリームの再接続までに待機する時間です。
+	defaultReconnectBackoff = time.Second
+	// defaultCheckpointInterval は CheckpointInterval が未設定の場合に、チェックポイントを書き込む間隔です。
+	defaultCheckpointInterval = time.Second
+	// defaultLagWindow は LagWindow が未設定の場合に、遅延が MaxLag を超えた状態の継続を許容する時間です。
+	defaultLagWindow = 10 * time.Second
+	// defaultFetchInterval は FetchInterval が未設定の場合に、プルモードで末尾に追いついた後に次の Fetch まで待機する時間です。
+	defaultFetchInterval = 100 * time.Millisecond
+	// defaultAckInterval は AckInterval が未設定の場合に、適用済みのオフセットを複製元へ確認応答する間隔です。
+	defaultAckInterval = 100 * time.Millisecond
+)
+
+// ReplicationMode は Replicator がサーバからレコードを受け取る方法です。
+type ReplicationMode int
+
+const (
+	// ReplicationPush は ConsumeStream でサーバから送られてくるレコードを受信します。
+	ReplicationPush ReplicationMode = iota
+	// ReplicationPull は Fetch を繰り返し呼び出して、Replicator 側の間隔と量でレコードを取得します。
+	ReplicationPull
+)
+
 // Replicator は分散システムのレプリケーションを管理する型です。
 // gRPC を使用してデータのプロデュースおよび消費を行います。
 // サーバの追加・削除やレプリケーションの開始・停止を管理します。
+// ReconnectBackoff はストリームが失敗した後、再接続するまでに待機する時間です。
+// CheckpointPath を設定すると、サーバごとに適用済みのオフセットを CheckpointInterval ごとにそのファイルへ書き込み、
+// 起動時に読み込んでレプリケーションを再開します。
+// MaxLag を設定すると、サーバの最大オフセットとローカルに適用済みのオフセットの差（遅延）が MaxLag を超えた状態が
+// LagWindow 以上続いた場合に OnLagExceeded を呼び出し、遅延が MaxLag 以下に戻るまで Healthy が false を返します。
+// OnHealthChange を設定すると、Healthy の結果が変わるたびに変わった後の値を引数に呼び出し、ヘルスチェックに反映できるようにします。
+// BufferSize を設定すると、サーバから受信してまだローカルに保存していないレコードをメモリに BufferSize 件まで保持し、
+// 超えた分を SpillDir（空の場合は os.TempDir）の一時ファイルに書き出します。
+// ローカルへの保存が一時的に遅くなっても、サーバからの受信が止まらないようにするためです。
+// 0 の場合はバッファを持たず、保存が終わるまで次のレコードを受信しません。
+// Filter を設定すると、受信したレコードのうち Filter が true を返すものだけをローカルに保存します。
+// 保存しなかったレコードも適用済みとして扱うため、再接続やチェックポイントからの再開で再び受信することはありません。
+// AckName を設定すると、AckInterval ごとに最後に適用したレコードのオフセットを複製元のサーバにその名前で AckReplica し、
+// 複製元がどこまで複製されたか（ハイウォーターマーク）を求められるようにします。レコードごとには確認応答しません。
+// Mode に ReplicationPull を設定すると、ストリームの代わりに Fetch で 1 回あたり最大 FetchMaxBytes バイトずつ取得し、
+// ローカルに保存し終えてから次を取得します。末尾に追いついた場合は FetchInterval だけ待機してから再び取得します。
 type Replicator struct {
-	DialOptions []grpc.DialOption
-	LocalServer api.LogClient
+	DialOptions        []grpc.DialOption
+	LocalServer        api.LogClient
+	ReconnectBackoff   time.Duration
+	CheckpointPath     string
+	CheckpointInterval time.Duration
+	MaxLag             uint64
+	LagWindow          time.Duration
+	OnLagExceeded      func(name string, lag uint64)
+	OnHealthChange     func(healthy bool)
+	BufferSize         int
+	SpillDir           string
+	Filter             func(*api.Record) bool
+	AckName            string
+	AckInterval        time.Duration
+	Mode               ReplicationMode
+	FetchMaxBytes      uint64
+	FetchInterval      time.Duration
 
 	logger *zap.Logger
+	// spilled は一時ファイルに書き出したレコードの累計です。
+	spilled atomic.Uint64
+	// healthMu は OnHealthChange への通知を直列化し、reportedUnhealthy は最後に通知した状態を保持します。
+	healthMu          sync.Mutex
+	reportedUnhealthy bool
 
-	mu      sync.Mutex
-	servers map[string]chan struct{}
-	closed  bool
-	close   chan struct{}
+	mu          sync.Mutex
+	servers     map[string]chan struct{}
+	applied     map[string]uint64
+	lagSince    map[string]time.Time
+	lagging     map[string]bool
+	dirty       bool
+	checkpoints bool
+	closed      bool
+	close       chan struct{}
 }
 
 // Join は新しいサーバをレプリケーション対象に追加します。name はサーバ名、addr はサーバアドレスを指定します。
@@ -42,15 +110,16 @@ func (r *Replicator) Join(name, addr string) error {
 	}
 	r.servers[name] = make(chan struct{})
 
-	go r.replicate(addr, r.servers[name])
+	go r.replicate(name, addr, r.servers[name])
 
 	return nil
 }
 
 // replicate は指定されたアドレスのサーバと gRPC 接続を確立し、レプリケーションを実行するメソッドです。
 // 他のサーバからストリーム形式でレコードを受信し、それをローカルサーバへ保存します。
+// ストリームが失敗した場合は ReconnectBackoff だけ待機し、最後に適用したオフセットの次から再接続します。
 // close または leave チャネルが受信されると処理を停止します。
-func (r *Replicator) replicate(addr string, leave chan struct{}) {
+func (r *Replicator) replicate(name, addr string, leave chan struct{}) {
 	cc, err := grpc.NewClient(addr, r.DialOptions...)
 	if err != nil {
 		r.logError(err, "failed to dial", addr)
@@ -59,60 +128,412 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 	defer func() { _ = cc.Close() }()
 
 	client := api.NewLogClient(cc)
+	if r.AckName != "" {
+		stop := make(chan struct{})
+		defer close(stop)
+		go r.ackLoop(client, name, addr, stop)
+	}
+	for {
+		if r.Mode == ReplicationPull {
+			err = r.fetch(client, name, addr, leave)
+		} else {
+			err = r.consume(client, name, addr, leave)
+		}
+		if err == nil {
+			return
+		}
+		select {
+		case <-r.close:
+			return
+		case <-leave:
+			return
+		case <-time.After(r.ReconnectBackoff):
+		}
+	}
+}
 
-	ctx := context.Background()
+// consume は name のサーバからのストリームを 1 回開き、受信したレコードをローカルサーバへ保存します。
+// close または leave チャネルが受信された場合は nil を、ストリームや保存が失敗した場合はそのエラーを返します。
+func (r *Replicator) consume(
+	client api.LogClient,
+	name, addr string,
+	leave chan struct{},
+) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	stream, err := client.ConsumeStream(ctx,
 		&api.ConsumeRequest{
-			Offset: 0,
+			Offset: r.nextOffset(name),
 		},
 	)
 	if err != nil {
 		r.logError(err, "failed to consume", addr)
-		return
+		return err
 	}
 
-	records := make(chan *api.Record)
+	records := make(chan *api.ConsumeResponse)
+	errs := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case errs <- err:
+		case <-ctx.Done():
+		}
+	}
+	var q *spillQueue
+	if r.BufferSize > 0 {
+		q = newSpillQueue(r.BufferSize, r.SpillDir)
+		defer func() { _ = q.close() }()
+		go r.drain(ctx, q, records, fail)
+	}
 	go func() {
 		for {
 			recv, err := stream.Recv()
 			if err != nil {
-				r.logError(err, "failed to receive", addr)
+				fail(err)
+				return
+			}
+			if recv.Heartbeat {
+				continue
+			}
+			if q != nil {
+				spilled, err := q.push(recv)
+				if err != nil {
+					fail(err)
+					return
+				}
+				if spilled {
+					r.spilled.Add(1)
+				}
+				continue
+			}
+			select {
+			case records <- recv:
+			case <-ctx.Done():
 				return
 			}
-			records <- recv.Record
 		}
 	}()
 	for {
 		select {
 		case <-r.close:
-			return
+			return nil
+		case <-leave:
+			return nil
+		case err = <-errs:
+			r.logError(err, "failed to receive", addr)
+			return err
+		case recv := <-records:
+			if err = r.apply(ctx, name, addr, recv.Record, recv.HighestOffset); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// fetch は name のサーバに対して Fetch を繰り返し呼び出し、取得したレコードをローカルサーバへ保存します。
+// 取得したレコードを全て保存してから次の Fetch を呼び出すため、保存が遅い場合はサーバからの取得も遅くなります。
+// close または leave チャネルが受信された場合は nil を、取得や保存が失敗した場合はそのエラーを返します。
+func (r *Replicator) fetch(
+	client api.LogClient,
+	name, addr string,
+	leave chan struct{},
+) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for {
+		select {
+		case <-r.close:
+			return nil
 		case <-leave:
+			return nil
+		default:
+		}
+		res, err := client.Fetch(ctx, &api.FetchRequest{
+			Offset:   r.nextOffset(name),
+			MaxBytes: r.FetchMaxBytes,
+		})
+		if err != nil {
+			r.logError(err, "failed to fetch", addr)
+			return err
+		}
+		for _, record := range res.Records {
+			if err = r.apply(ctx, name, addr, record, res.HighestOffset); err != nil {
+				return err
+			}
+		}
+		if len(res.Records) > 0 {
+			continue
+		}
+		select {
+		case <-r.close:
+			return nil
+		case <-leave:
+			return nil
+		case <-time.After(r.FetchInterval):
+		}
+	}
+}
+
+// apply は name のサーバから受信したレコードをローカルサーバへ保存し、適用済みとして記録します。
+// highest との差を遅延として記録します。
+func (r *Replicator) apply(
+	ctx context.Context,
+	name, addr string,
+	record *api.Record,
+	highest uint64,
+) error {
+	off := record.Offset
+	if r.Filter == nil || r.Filter(record) {
+		_, err := r.LocalServer.Produce(ctx,
+			&api.ProduceRequest{
+				Record: record,
+			},
+		)
+		if err != nil {
+			r.logError(err, "failed to produce", addr)
+			return err
+		}
+	}
+	r.markApplied(name, off)
+	if highest > off {
+		r.checkLag(name, highest-off)
+	} else {
+		r.checkLag(name, 0)
+	}
+	return nil
+}
+
+// ackLoop は stop が閉じられるか Replicator が閉じられるまで、AckInterval ごとに name のサーバから最後に適用したオフセットを
+// そのサーバへ AckReplica します。前回から進んでいない場合は確認応答しません。失敗した場合は次の間隔で再試行します。
+func (r *Replicator) ackLoop(client api.LogClient, name, addr string, stop chan struct{}) {
+	ticker := time.NewTicker(r.AckInterval)
+	defer ticker.Stop()
+	acked, hasAcked := uint64(0), false
+	for {
+		select {
+		case <-r.close:
 			return
-		case record := <-records:
-			_, err = r.LocalServer.Produce(ctx,
-				&api.ProduceRequest{
-					Record: record,
-				},
-			)
-			if err != nil {
-				r.logError(err, "failed to produce", addr)
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		off, ok := r.applied[name]
+		r.mu.Unlock()
+		if !ok || (hasAcked && off == acked) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), r.AckInterval)
+		_, err := client.AckReplica(ctx, &api.AckReplicaRequest{ReplicaName: r.AckName, Offset: off})
+		cancel()
+		if err != nil {
+			r.logError(err, "failed to ack", addr)
+			continue
+		}
+		acked, hasAcked = off, true
+	}
+}
+
+// drain は q から受信順にレコードを取り出して records に送ります。
+// ctx が終了するまで続け、一時ファイルの読み込みに失敗した場合は fail を呼び出して終了します。
+func (r *Replicator) drain(
+	ctx context.Context,
+	q *spillQueue,
+	records chan<- *api.ConsumeResponse,
+	fail func(error),
+) {
+	for {
+		recv, ok, err := q.pop()
+		if err != nil {
+			fail(err)
+			return
+		}
+		if !ok {
+			select {
+			case <-q.ready:
+				continue
+			case <-ctx.Done():
 				return
 			}
 		}
+		select {
+		case records <- recv:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// nextOffset は name のサーバからレプリケーションを再開するオフセットを返します。
+// まだ 1 件も適用していない場合は 0 を返します。
+func (r *Replicator) nextOffset(name string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	off, ok := r.applied[name]
+	if !ok {
+		return 0
+	}
+	return off + 1
+}
+
+// markApplied は name のサーバから受信したオフセット off のレコードを、ローカルに適用済みとして記録します。
+func (r *Replicator) markApplied(name string, off uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.applied[name] = off
+	r.dirty = true
+}
+
+// checkLag は name のサーバに対する遅延 lag を記録します。MaxLag が 0 の場合は何もしません。
+// 遅延が MaxLag を超えた状態が LagWindow 以上続いた場合、その状態が解消されるまでの間に一度だけ OnLagExceeded を呼び出します。
+func (r *Replicator) checkLag(name string, lag uint64) {
+	if r.MaxLag == 0 {
+		return
+	}
+	r.mu.Lock()
+	if lag <= r.MaxLag {
+		delete(r.lagSince, name)
+		recovered := r.lagging[name]
+		delete(r.lagging, name)
+		r.mu.Unlock()
+		if recovered {
+			r.reportHealth()
+		}
+		return
+	}
+	since, ok := r.lagSince[name]
+	if !ok {
+		since = time.Now()
+		r.lagSince[name] = since
+	}
+	exceeded := !r.lagging[name] && time.Since(since) >= r.LagWindow
+	if exceeded {
+		r.lagging[name] = true
+	}
+	r.mu.Unlock()
+
+	if exceeded {
+		r.logger.Warn(
+			"replication lag exceeded",
+			zap.String("name", name),
+			zap.Uint64("lag", lag),
+		)
+		if r.OnLagExceeded != nil {
+			r.OnLagExceeded(name, lag)
+		}
+	}
+	if exceeded {
+		r.reportHealth()
+	}
+}
+
+// reportHealth は Healthy の結果が前回通知した値から変わっていれば、OnHealthChange に変わった後の値を通知します。
+// 並行して状態が変わっても最後に通知した値が現在の状態と一致するように、通知の直前に状態を読み直します。
+// OnHealthChange から Replicator のメソッドを呼び出せるように、r.mu のロックを取得せずに呼び出す必要があります。
+func (r *Replicator) reportHealth() {
+	if r.OnHealthChange == nil {
+		return
+	}
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+	healthy := r.Healthy()
+	if healthy == !r.reportedUnhealthy {
+		return
+	}
+	r.reportedUnhealthy = !healthy
+	r.OnHealthChange(healthy)
+}
+
+// Healthy は、遅延が MaxLag を超えた状態が LagWindow 以上続いているサーバがない場合に true を返します。
+func (r *Replicator) Healthy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.lagging) == 0
+}
+
+// loadCheckpoint は CheckpointPath から適用済みのオフセットを読み込みます。ファイルが存在しない場合は何もしません。
+func (r *Replicator) loadCheckpoint() error {
+	b, err := os.ReadFile(r.CheckpointPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &r.applied)
+}
+
+// writeCheckpoint は前回の書き込み以降に更新された適用済みのオフセットを CheckpointPath に書き込みます。
+// 一時ファイルに書き込んで同期してから置き換えるため、途中で停止しても以前のチェックポイントが残ります。
+// 呼び出し側で r.mu のロックを取得している必要があります。
+func (r *Replicator) writeCheckpoint() error {
+	if !r.dirty {
+		return nil
+	}
+	b, err := json.Marshal(r.applied)
+	if err != nil {
+		return err
+	}
+	tmp := r.CheckpointPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, r.CheckpointPath); err != nil {
+		return err
+	}
+	r.dirty = false
+	return nil
+}
+
+// checkpointLoop は Replicator が閉じられるまで、CheckpointInterval ごとにチェックポイントを書き込みます。
+func (r *Replicator) checkpointLoop() {
+	ticker := time.NewTicker(r.CheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			if err := r.writeCheckpoint(); err != nil {
+				r.logger.Error("failed to write checkpoint", zap.Error(err))
+			}
+			r.mu.Unlock()
+		}
 	}
 }
 
 // Leave は指定された名前のサーバをレプリケーション対象から削除します。
 // サーバが存在しない場合は何もせずに終了します。
+// 遅延していたサーバが削除されて遅延しているサーバがなくなった場合は、OnHealthChange に正常に戻ったことを通知します。
 func (r *Replicator) Leave(name string) error {
 	r.mu.Lock()
-	defer r.mu.Unlock()
 	r.init()
 	if _, ok := r.servers[name]; !ok {
+		r.mu.Unlock()
 		return nil
 	}
 	close(r.servers[name])
 	delete(r.servers, name)
+	delete(r.lagSince, name)
+	recovered := r.lagging[name]
+	delete(r.lagging, name)
+	r.mu.Unlock()
+	if recovered {
+		r.reportHealth()
+	}
 	return nil
 }
 
@@ -124,12 +545,42 @@ func (r *Replicator) init() {
 	if r.servers == nil {
 		r.servers = make(map[string]chan struct{})
 	}
+	if r.applied == nil {
+		r.applied = make(map[string]uint64)
+	}
+	if r.lagSince == nil {
+		r.lagSince = make(map[string]time.Time)
+		r.lagging = make(map[string]bool)
+	}
+	if r.LagWindow == 0 {
+		r.LagWindow = defaultLagWindow
+	}
+	if r.ReconnectBackoff == 0 {
+		r.ReconnectBackoff = defaultReconnectBackoff
+	}
+	if r.FetchInterval == 0 {
+		r.FetchInterval = defaultFetchInterval
+	}
+	if r.AckInterval == 0 {
+		r.AckInterval = defaultAckInterval
+	}
 	if r.close == nil {
 		r.close = make(chan struct{})
 	}
+	if r.CheckpointPath != "" && !r.checkpoints {
+		r.checkpoints = true
+		if err := r.loadCheckpoint(); err != nil {
+			r.logger.Error("failed to load checkpoint", zap.Error(err))
+		}
+		if r.CheckpointInterval == 0 {
+			r.CheckpointInterval = defaultCheckpointInterval
+		}
+		go r.checkpointLoop()
+	}
 }
 
 // Close は Replicator を閉じるメソッドです。内部リソースを解放し、今後の操作を無効化します。
+// CheckpointPath が設定されている場合は、最後のチェックポイントを書き込みます。
 // 閉じた状態で再度呼び出してもエラーは返されません。
 func (r *Replicator) Close() error {
 	r.mu.Lock()
@@ -141,6 +592,9 @@ func (r *Replicator) Close() error {
 	}
 	r.closed = true
 	close(r.close)
+	if r.CheckpointPath != "" {
+		return r.writeCheckpoint()
+	}
 	return nil
 }
 
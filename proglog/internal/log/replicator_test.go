@@ -0,0 +1,298 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// TestReplicatorResumesAfterStreamError は、レコードを 5 件適用した後にストリームが失敗した場合、
+// Replicator が 0 からではなく、最後に適用したオフセットの次から再接続することを検証します。
+func TestReplicatorResumesAfterStreamError(t *testing.T) {
+	peer := &failingPeer{requests: make(chan uint64, 2)}
+	addr := startPeer(t, peer)
+
+	local := &recordingLocal{}
+	r := &Replicator{
+		DialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
+		LocalServer:      local,
+		ReconnectBackoff: 10 * time.Millisecond,
+	}
+	require.NoError(t, r.Join("peer", addr))
+	defer func() { _ = r.Close() }()
+
+	require.Equal(t, uint64(0), <-peer.requests)
+	select {
+	case off := <-peer.requests:
+		require.Equal(t, uint64(6), off)
+	case <-time.After(3 * time.Second):
+		t.Fatal("replicator did not reconnect")
+	}
+	require.Equal(t, []uint64{1, 2, 3, 4, 5}, local.offsets())
+}
+
+// TestReplicatorResumesFromCheckpoint は、Replicator を閉じて同じチェックポイントファイルで作り直した場合に、
+// チェックポイントに記録された適用済みオフセットの次からレプリケーションを再開することを検証します。
+func TestReplicatorResumesFromCheckpoint(t *testing.T) {
+	peer := &failingPeer{requests: make(chan uint64, 3)}
+	addr := startPeer(t, peer)
+	path := filepath.Join(t.TempDir(), "replication.checkpoint")
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+
+	local := &recordingLocal{}
+	r := &Replicator{
+		DialOptions:      opts,
+		LocalServer:      local,
+		ReconnectBackoff: 10 * time.Millisecond,
+		CheckpointPath:   path,
+	}
+	require.NoError(t, r.Join("peer", addr))
+	require.Equal(t, uint64(0), <-peer.requests)
+	require.Equal(t, uint64(6), <-peer.requests)
+	require.NoError(t, r.Close())
+
+	// 再起動を模して、同じチェックポイントファイルから Replicator を作り直す
+	r = &Replicator{
+		DialOptions:    opts,
+		LocalServer:    &recordingLocal{},
+		CheckpointPath: path,
+	}
+	require.NoError(t, r.Join("peer", addr))
+	defer func() { _ = r.Close() }()
+
+	select {
+	case off := <-peer.requests:
+		require.Equal(t, uint64(6), off)
+	case <-time.After(3 * time.Second):
+		t.Fatal("replicator did not connect")
+	}
+	require.Equal(t, []uint64{1, 2, 3, 4, 5}, local.offsets())
+}
+
+// TestReplicatorLagExceeded は、ローカルへの書き込みが遅くサーバの最大オフセットとの差が MaxLag を超え続けた場合に、
+// OnLagExceeded が一度だけ呼び出され、Replicator が unhealthy になることと、
+// 状態が変わるたびに OnHealthChange が呼び出されることを検証します。
+func TestReplicatorLagExceeded(t *testing.T) {
+	addr := startPeer(t, &laggingPeer{highest: 1000})
+
+	var fired atomic.Int32
+	var lastLag atomic.Uint64
+	var mu sync.Mutex
+	var changes []bool
+	healthChanges := func() []bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]bool(nil), changes...)
+	}
+	r := &Replicator{
+		DialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
+		LocalServer: &recordingLocal{delay: 20 * time.Millisecond},
+		MaxLag:      10,
+		LagWindow:   100 * time.Millisecond,
+		OnLagExceeded: func(name string, lag uint64) {
+			if name == "peer" {
+				lastLag.Store(lag)
+				fired.Add(1)
+			}
+		},
+		OnHealthChange: func(healthy bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, healthy)
+		},
+	}
+	require.True(t, r.Healthy())
+	require.NoError(t, r.Join("peer", addr))
+	defer func() { _ = r.Close() }()
+
+	require.Eventually(t, func() bool {
+		return fired.Load() > 0
+	}, 3*time.Second, 10*time.Millisecond)
+	require.False(t, r.Healthy())
+	require.Greater(t, lastLag.Load(), uint64(10))
+	require.Eventually(t, func() bool {
+		return len(healthChanges()) > 0
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []bool{false}, healthChanges())
+
+	// 遅延が続いている間は再度呼び出されない
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, int32(1), fired.Load())
+
+	require.NoError(t, r.Leave("peer"))
+	require.True(t, r.Healthy())
+	require.Equal(t, []bool{false, true}, healthChanges())
+}
+
+// TestReplicatorSpillsToDisk は、ローカルへの保存が遅い場合に受信したレコードが BufferSize を超えた分だけ一時ファイルに書き出され、
+// 最終的に全てのレコードが受信順にローカルへ保存され、閉じた後に一時ファイルが残らないことを検証します。
+func TestReplicatorSpillsToDisk(t *testing.T) {
+	const highest = 199
+	addr := startPeer(t, &laggingPeer{highest: highest})
+	dir := t.TempDir()
+
+	local := &recordingLocal{delay: time.Millisecond}
+	r := &Replicator{
+		DialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
+		LocalServer: local,
+		BufferSize:  10,
+		SpillDir:    dir,
+	}
+	require.NoError(t, r.Join("peer", addr))
+
+	require.Eventually(t, func() bool {
+		return len(local.offsets()) == highest+1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Greater(t, r.spilled.Load(), uint64(0))
+	for i, off := range local.offsets() {
+		require.Equal(t, uint64(i), off)
+	}
+
+	require.NoError(t, r.Close())
+	require.Eventually(t, func() bool {
+		entries, err := os.ReadDir(dir)
+		return err == nil && len(entries) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestReplicatorFilter は、Filter を設定した場合に Filter が true を返したレコードだけがローカルに保存され、
+// 保存しなかったレコードも含めて最後に受信したオフセットまで適用済みとして扱われることを検証します。
+func TestReplicatorFilter(t *testing.T) {
+	const highest = 9
+	addr := startPeer(t, &laggingPeer{highest: highest})
+
+	local := &recordingLocal{}
+	r := &Replicator{
+		DialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
+		LocalServer: local,
+		Filter: func(record *api.Record) bool {
+			return record.Offset%2 == 0
+		},
+	}
+	require.NoError(t, r.Join("peer", addr))
+	defer func() { _ = r.Close() }()
+
+	require.Eventually(t, func() bool {
+		return r.nextOffset("peer") == highest+1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []uint64{0, 2, 4, 6, 8}, local.offsets())
+}
+
+// startPeer は srv を登録した gRPC サーバーを起動し、そのアドレスを返します。
+func startPeer(t *testing.T, srv api.LogServer) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	gsrv := grpc.NewServer()
+	api.RegisterLogServer(gsrv, srv)
+	go func() {
+		_ = gsrv.Serve(l)
+	}()
+	t.Cleanup(gsrv.Stop)
+	return l.Addr().String()
+}
+
+// failingPeer は最初の ConsumeStream でオフセット 1 から 5 のレコードを送信した後に失敗する、レプリケーション元のサーバーです。
+// 2 回目以降の ConsumeStream はクライアントが切断するまで待機します。
+// 受け付けた ConsumeRequest のオフセットを requests に送信します。
+type failingPeer struct {
+	api.UnimplementedLogServer
+	requests chan uint64
+	calls    atomic.Int32
+}
+
+// ConsumeStream は受け付けたオフセットを記録し、初回のみレコードを送信してからエラーを返します。
+func (p *failingPeer) ConsumeStream(
+	req *api.ConsumeRequest,
+	stream api.Log_ConsumeStreamServer,
+) error {
+	p.requests <- req.Offset
+	if p.calls.Add(1) > 1 {
+		<-stream.Context().Done()
+		return nil
+	}
+	for off := uint64(1); off <= 5; off++ {
+		if err := stream.Send(&api.ConsumeResponse{
+			Record: &api.Record{Value: []byte("hello world"), Offset: off},
+		}); err != nil {
+			return err
+		}
+	}
+	// 全レコードが適用されるのを待ってからストリームを失敗させる
+	time.Sleep(100 * time.Millisecond)
+	return errors.New("stream broken")
+}
+
+// laggingPeer は最大オフセットが highest であると応答しながら、オフセット 0 から順にレコードを送信し続けるサーバーです。
+type laggingPeer struct {
+	api.UnimplementedLogServer
+	highest uint64
+}
+
+// ConsumeStream はクライアントが切断するか highest に達するまで、要求されたオフセットからレコードを送信します。
+func (p *laggingPeer) ConsumeStream(
+	req *api.ConsumeRequest,
+	stream api.Log_ConsumeStreamServer,
+) error {
+	for off := req.Offset; off <= p.highest; off++ {
+		if err := stream.Send(&api.ConsumeResponse{
+			Record:        &api.Record{Value: []byte("hello world"), Offset: off},
+			HighestOffset: p.highest,
+		}); err != nil {
+			return err
+		}
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+// recordingLocal は Produce されたレコードのオフセットを記録する、ローカルサーバーのクライアントです。
+// delay を設定すると、Produce ごとにその時間だけ待機します。
+type recordingLocal struct {
+	api.LogClient
+	delay   time.Duration
+	mu      sync.Mutex
+	applied []uint64
+}
+
+// Produce はレコードのオフセットを記録します。
+func (l *recordingLocal) Produce(
+	_ context.Context,
+	req *api.ProduceRequest,
+	_ ...grpc.CallOption,
+) (*api.ProduceResponse, error) {
+	time.Sleep(l.delay)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.applied = append(l.applied, req.Record.Offset)
+	return &api.ProduceResponse{Offset: uint64(len(l.applied) - 1)}, nil
+}
+
+// offsets は記録されたオフセットのコピーを返します。
+func (l *recordingLocal) offsets() []uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]uint64(nil), l.applied...)
+}
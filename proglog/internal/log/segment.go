@@ -1,11 +1,18 @@
 package log
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -13,11 +20,16 @@ import (
 // データ保存用の store とインデックス管理用の index を内部に持ちます。
 // baseOffset はセグメントの開始オフセットを示し、nextOffset は次に書き込むオフセットを示します。
 // config はセグメントに関連する設定を保持します。
+// mu はセグメント単位の読み書きロックで、Log がレコードの読み出し中に他の操作がセグメントを変更したり閉じたりしないように使用します。
+// lastUsed は最後に読み書きした時刻（UNIX ナノ秒）で、released はメモリマップとバッファを解放済みかを示します。
 type segment struct {
+	mu                     sync.RWMutex
 	store                  *store
 	index                  *index
 	baseOffset, nextOffset uint64
 	config                 Config
+	lastUsed               atomic.Int64
+	released               atomic.Bool
 }
 
 // newSegment は新しいログセグメントを作成し、初期化された segment 構造体ポインタを返します。
@@ -29,9 +41,13 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		baseOffset: baseOffset,
 		config:     c,
 	}
+	flag := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if c.Segment.DirectSync {
+		flag |= oDSync
+	}
 	storeFile, err := os.OpenFile(
 		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		flag,
 		0600,
 	)
 	if err != nil {
@@ -40,6 +56,14 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.store, err = newStore(storeFile); err != nil {
 		return nil, err
 	}
+	s.store.align = c.Segment.AlignBytes
+	s.store.directSync = c.Segment.DirectSync
+	if c.Segment.PreallocStore && s.store.size < c.Segment.MaxStoreBytes {
+		if err = preallocate(storeFile, int64(c.Segment.MaxStoreBytes)); err != nil {
+			return nil, err
+		}
+		s.store.prealloc = true
+	}
 	indexFile, err := os.OpenFile(
 		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
 		os.O_RDWR|os.O_CREATE,
@@ -54,16 +78,27 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if off, _, err := s.index.Read(-1); err != nil {
 		s.nextOffset = baseOffset
 	} else {
-		s.nextOffset = baseOffset + uint64(off) + 1
+		s.nextOffset = baseOffset + off + 1
 	}
+	s.touch(time.Now())
 	return s, nil
 }
 
 // Append はレコードをセグメントに追加し、そのオフセットとエラーを返します。
+// 追加すると nextOffset が uint64 の上限を超えて 0 に戻ってしまう場合は ErrOffsetSpaceExhausted を返します。
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	cur := s.nextOffset
+	if cur == math.MaxUint64 {
+		return 0, ErrOffsetSpaceExhausted
+	}
 	record.Offset = cur
-	p, err := proto.Marshal(record)
+	stored := record
+	if s.config.Segment.Encryptor != nil {
+		if stored, err = s.encrypt(record); err != nil {
+			return 0, err
+		}
+	}
+	p, err := proto.Marshal(stored)
 	if err != nil {
 		return 0, err
 	}
@@ -73,7 +108,7 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	}
 	if err = s.index.Write(
 		// インデックスのオフセットは、ベースオフセットからの相対
-		uint32(s.nextOffset-uint64(s.baseOffset)),
+		s.nextOffset-uint64(s.baseOffset),
 		pos,
 	); err != nil {
 		return 0, err
@@ -93,15 +128,173 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 		return nil, err
 	}
 	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	if err = proto.Unmarshal(p, record); err != nil {
+		return nil, err
+	}
+	if err = s.decrypt(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// ReadInto は Read と同様に指定されたオフセットのレコードを読み取りますが、レコードを record に、
+// ストアのデータを buf に読み込んで再利用します。次回の buf として再利用できるスライスを返します。
+func (s *segment) ReadInto(off uint64, record *api.Record, buf []byte) ([]byte, error) {
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return buf, err
+	}
+	buf, err = s.store.ReadInto(pos, buf)
+	if err != nil {
+		return buf, err
+	}
+	if err = proto.Unmarshal(buf, record); err != nil {
+		return buf, err
+	}
+	return buf, s.decrypt(record)
+}
+
+// ReadRef は指定されたオフセットのレコードをエンコードしたバイト列を返します。
+// ストアがメモリマッピングされている場合はコピーせずにメモリマップを参照するスライスを、そうでない場合はコピーを返します。
+// shared はメモリマップを参照している場合に true で、その間はセグメントを閉じてはいけません。
+// Encryptor を設定している場合は、復号したレコードをエンコードし直したコピーを返します。
+func (s *segment) ReadRef(off uint64) (b []byte, shared bool, err error) {
+	if s.config.Segment.Encryptor != nil {
+		record, err := s.Read(off)
+		if err != nil {
+			return nil, false, err
+		}
+		b, err = proto.Marshal(record)
+		return b, false, err
+	}
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return nil, false, err
+	}
+	if b, ok := s.store.ReadRef(pos); ok {
+		return b, true, nil
+	}
+	b, err = s.store.Read(pos)
+	return b, false, err
+}
+
+// ReadValueRange は指定されたオフセットのレコードの値のうち、start から length バイトだけをストアから読み出します。
+// length が 0 の場合は値の末尾までを読み出します。
+// レコードの先頭にある値のフィールドのヘッダーだけを解析して位置を求めるため、レコード全体は読み込みません。
+// 範囲が値の長さを超える場合は api.ErrInvalidArgument を返します。
+// Encryptor を設定している場合は値を復号する必要があるため、レコード全体を読み込みます。
+func (s *segment) ReadValueRange(off, start, length uint64) ([]byte, error) {
+	if s.config.Segment.Encryptor != nil {
+		record, err := s.Read(off)
+		if err != nil {
+			return nil, err
+		}
+		length, err = valueRangeLength(uint64(len(record.Value)), start, length)
+		if err != nil {
+			return nil, err
+		}
+		return record.Value[start : start+length], nil
+	}
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, lenWidth+protowire.SizeTag(1)+binary.MaxVarintLen64)
+	n, err := s.store.ReadAt(head, int64(pos))
+	if n < lenWidth {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	rec := head[lenWidth:min(uint64(n), lenWidth+recordLen(head[:lenWidth]))]
+	// Record は value (フィールド番号 1) から順にエンコードされ、値が空の場合はフィールドごと省略される
+	var valueStart, valueLen uint64
+	if num, typ, k := protowire.ConsumeTag(rec); k > 0 && num == 1 && typ == protowire.BytesType {
+		v, m := protowire.ConsumeVarint(rec[k:])
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		valueStart, valueLen = uint64(k+m), v
+	}
+	if length, err = valueRangeLength(valueLen, start, length); err != nil {
+		return nil, err
+	}
+	b := make([]byte, length)
+	if _, err = s.store.ReadAt(b, int64(pos+lenWidth+valueStart+start)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// valueRangeLength は長さ valueLen の値のうち start から length バイトの範囲を検証し、実際に読み出す長さを返します。
+// length が 0 の場合は値の末尾までの長さを返します。
+func valueRangeLength(valueLen, start, length uint64) (uint64, error) {
+	if start > valueLen {
+		return 0, api.ErrInvalidArgument{Field: "value_offset", Reason: "exceeds the value length"}
+	}
+	if length == 0 {
+		length = valueLen - start
+	}
+	if length > valueLen-start {
+		return 0, api.ErrInvalidArgument{Field: "value_length", Reason: "exceeds the value length"}
+	}
+	return length, nil
+}
+
+// prefetch は指定されたオフセットのレコードをストアから OS のページキャッシュに読み込むよう促します。
+func (s *segment) prefetch(off uint64) error {
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return err
+	}
+	return s.store.prefetch(pos)
+}
+
+// touch はセグメントを最後に使用した時刻を now に更新します。
+func (s *segment) touch(now time.Time) {
+	s.lastUsed.Store(now.UnixNano())
+}
+
+// idle は now の時点で、セグメントが timeout 以上使用されていないかを判定します。
+func (s *segment) idle(now time.Time, timeout time.Duration) bool {
+	return now.Sub(time.Unix(0, s.lastUsed.Load())) >= timeout
+}
+
+// release はインデックスのメモリマップとストアのバッファを解放します。
+// 解放後も読み出しはファイル I/O で行えますが、通常は Log が次の読み出しの前に reopen します。
+// 呼び出し側でセグメントの書き込みロックを取得している必要があります。
+func (s *segment) release() error {
+	if err := s.store.release(); err != nil {
+		return err
+	}
+	if err := s.index.release(); err != nil {
+		return err
+	}
+	s.released.Store(true)
+	return nil
+}
+
+// reopen は release で解放したインデックスと、MmapStore が有効な場合はストアを再びメモリにマッピングします。
+// 呼び出し側でセグメントの書き込みロックを取得している必要があります。
+func (s *segment) reopen() {
+	if !s.config.Segment.NoMmap {
+		s.index.remap()
+	}
+	if s.config.Segment.MmapStore {
+		// マッピングできなかった場合は ReadRef がコピーで読み出す
+		_ = s.store.mapReadOnly()
+	}
+	s.released.Store(false)
 }
 
-// IsMaxed は、セグメントの保存容量またはインデックス容量が設定された上限に達しているかを判定します。
+// IsMaxed は、セグメントの保存容量、インデックス容量、またはレコード数が設定された上限に達しているかを判定します。
 func (s *segment) IsMaxed() bool {
+	maxRecords := s.config.Segment.MaxRecords
 	return s.store.size >= s.config.Segment.MaxStoreBytes ||
 		s.index.size >= s.config.Segment.MaxIndexBytes ||
-		s.index.isMaxed()
+		s.index.isMaxed() ||
+		(maxRecords > 0 && s.nextOffset-s.baseOffset >= maxRecords)
 }
 
 // Remove はセグメントを削除します。内部のリソースを閉じた後、関連するファイルを削除します。エラーを返す場合があります。
@@ -0,0 +1,71 @@
+//go:build linux
+
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSegmentPreallocStore は、PreallocStore を有効にしたセグメントのストアのファイルに MaxStoreBytes までのブロックが
+// ファイルサイズを変えずに確保され、そのまま読み書きできること、Close で確保した余りが解放されることを検証します。
+func TestSegmentPreallocStore(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.PreallocStore = true
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	path := filepath.Join(dir, "0.store")
+	size, allocated := storeFileSize(t, path)
+	require.Equal(t, int64(0), size)
+	require.GreaterOrEqual(t, allocated, int64(c.Segment.MaxStoreBytes))
+
+	want := &api.Record{Value: []byte("hello world")}
+	for i := uint64(0); i < 3; i++ {
+		off, err := s.Append(want)
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	for i := uint64(0); i < 3; i++ {
+		got, err := s.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+	storeSize := s.store.size
+	require.NoError(t, s.Close())
+
+	size, allocated = storeFileSize(t, path)
+	require.Equal(t, int64(storeSize), size)
+	require.Less(t, allocated, int64(c.Segment.MaxStoreBytes))
+
+	// 切り詰めたストアを開き直してもレコードを読み出せ、続きに追記できる
+	c.Segment.PreallocStore = false
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+	require.Equal(t, storeSize, s.store.size)
+	off, err := s.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	for i := uint64(0); i <= off; i++ {
+		got, err := s.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+}
+
+// storeFileSize は path のファイルサイズと、ファイルシステム上で確保されているバイト数を返します。
+func storeFileSize(t *testing.T, path string) (size, allocated int64) {
+	t.Helper()
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	return fi.Size(), fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
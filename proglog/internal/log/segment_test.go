@@ -1,8 +1,15 @@
 package log
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
 
 	api "github.com/ishisaka/go_distribute/proglog/api/v1"
@@ -60,3 +67,131 @@ func TestSegment(t *testing.T) {
 	require.False(t, s.IsMaxed())
 	require.NoError(t, s.Close())
 }
+
+// TestSegmentDirectSync は、DirectSync を有効にしたセグメントでは Append から戻った時点で
+// レコードがストアのファイルに書き込まれており、フラッシュや Close を待たずに読み出せることを検証します。
+func TestSegmentDirectSync(t *testing.T) {
+	if !dsyncSupported {
+		t.Skip("O_DSYNC is not supported on this platform")
+	}
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = entWidth * 3
+	c.Segment.DirectSync = true
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+
+	record := &api.Record{Value: []byte("hello world")}
+	_, err = s.Append(record)
+	require.NoError(t, err)
+
+	// セグメントとは別にファイルを開き、バッファに残らずにディスクへ書き込まれていることを確認する
+	b, err := os.ReadFile(filepath.Join(dir, "0.store"))
+	require.NoError(t, err)
+	require.Equal(t, s.store.size, uint64(len(b)))
+	got := &api.Record{}
+	require.NoError(t, proto.Unmarshal(b[lenWidth:], got))
+	require.Equal(t, record.Value, got.Value)
+}
+
+// testEncryptor は AES-GCM で暗号化するテスト用の Encryptor です。current の鍵で暗号化し、keys の鍵で復号します。
+type testEncryptor struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (e *testEncryptor) aead(keyID string) (cipher.AEAD, error) {
+	key, ok := e.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", keyID)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (e *testEncryptor) Encrypt(plaintext []byte) ([]byte, string, error) {
+	aead, err := e.aead(e.current)
+	if err != nil {
+		return nil, "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), e.current, nil
+}
+
+func (e *testEncryptor) Decrypt(ciphertext []byte, keyID string) ([]byte, error) {
+	aead, err := e.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+// TestSegmentEncryption は、Encryptor を設定したセグメントがレコードの値を暗号化して保存し、
+// 鍵のローテーション後も再オープンしたセグメントから各レコードを復号できること、
+// 誤った鍵では ErrDecryption を返すことを検証します。
+func TestSegmentEncryption(t *testing.T) {
+	dir := t.TempDir()
+	k1, k2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	enc := &testEncryptor{current: "k1", keys: map[string][]byte{"k1": k1}}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = entWidth * 3
+	c.Segment.Encryptor = enc
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	first := &api.Record{Value: []byte("first secret")}
+	_, err = s.Append(first)
+	require.NoError(t, err)
+	// 鍵をローテーションしても、古い鍵で暗号化したレコードは記録された鍵の ID で復号できる
+	enc.current, enc.keys["k2"] = "k2", k2
+	second := &api.Record{Value: []byte("second secret")}
+	_, err = s.Append(second)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first secret"), first.Value)
+	require.NoError(t, s.Close())
+
+	b, err := os.ReadFile(filepath.Join(dir, "0.store"))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(b, []byte("secret")))
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	for off, want := range []*api.Record{first, second} {
+		got, err := s.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Empty(t, got.Headers)
+	}
+	part, err := s.ReadValueRange(1, 7, 6)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), part)
+	require.NoError(t, s.Close())
+
+	c.Segment.Encryptor = &testEncryptor{
+		current: "k2",
+		keys:    map[string][]byte{"k1": bytes.Repeat([]byte{9}, 32), "k2": k2},
+	}
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+	_, err = s.Read(0)
+	require.ErrorIs(t, err, ErrDecryption)
+	require.ErrorContains(t, err, `key "k1"`)
+	got, err := s.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, second.Value, got.Value)
+}
@@ -0,0 +1,131 @@
+package log
+
+import (
+	"os"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// spillQueue は、メモリ上に max 件までのレスポンスを保持し、それを超えた分を dir の一時ファイルに書き出す FIFO のキューです。
+// 一時ファイルにレスポンスが残っている間は、順序を保つために新しいレスポンスも一時ファイルに書き出します。
+// 一時ファイルが空になった時点でファイルを切り詰め、再びメモリに保持します。
+type spillQueue struct {
+	mu       sync.Mutex
+	max      int
+	dir      string
+	mem      []*api.ConsumeResponse
+	file     *os.File
+	readPos  int64
+	writePos int64
+	onDisk   int
+	closed   bool
+	// ready はキューにレスポンスが追加されたことを通知します。
+	ready chan struct{}
+}
+
+// newSpillQueue はメモリ上に max 件まで保持し、超えた分を dir に書き出すキューを作成します。
+// dir が空の場合は os.TempDir を使用します。
+func newSpillQueue(max int, dir string) *spillQueue {
+	return &spillQueue{
+		max:   max,
+		dir:   dir,
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// push は res をキューの末尾に追加し、一時ファイルに書き出した場合は spilled に true を返します。
+// close の後に呼び出された場合は何もしません。
+func (q *spillQueue) push(res *api.ConsumeResponse) (spilled bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false, nil
+	}
+	defer q.notify()
+	if q.onDisk == 0 && len(q.mem) < q.max {
+		q.mem = append(q.mem, res)
+		return false, nil
+	}
+	if q.file == nil {
+		if q.file, err = os.CreateTemp(q.dir, "replicator-spill-*"); err != nil {
+			return false, err
+		}
+	}
+	b, err := proto.Marshal(res)
+	if err != nil {
+		return false, err
+	}
+	p := make([]byte, lenWidth+len(b))
+	enc.PutUint64(p, uint64(len(b)))
+	copy(p[lenWidth:], b)
+	if _, err = q.file.WriteAt(p, q.writePos); err != nil {
+		return false, err
+	}
+	q.writePos += int64(len(p))
+	q.onDisk++
+	return true, nil
+}
+
+// pop はキューの先頭のレスポンスを取り出します。キューが空の場合は ok に false を返します。
+func (q *spillQueue) pop() (res *api.ConsumeResponse, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.mem) > 0 {
+		res = q.mem[0]
+		q.mem[0] = nil
+		q.mem = q.mem[1:]
+		return res, true, nil
+	}
+	if q.onDisk == 0 {
+		return nil, false, nil
+	}
+	size := make([]byte, lenWidth)
+	if _, err = q.file.ReadAt(size, q.readPos); err != nil {
+		return nil, false, err
+	}
+	b := make([]byte, enc.Uint64(size))
+	if _, err = q.file.ReadAt(b, q.readPos+lenWidth); err != nil {
+		return nil, false, err
+	}
+	q.readPos += lenWidth + int64(len(b))
+	q.onDisk--
+	if q.onDisk == 0 {
+		// 全て読み出したら、ファイルが大きくなり続けないように切り詰める
+		if err = q.file.Truncate(0); err != nil {
+			return nil, false, err
+		}
+		q.readPos, q.writePos = 0, 0
+	}
+	res = &api.ConsumeResponse{}
+	if err = proto.Unmarshal(b, res); err != nil {
+		return nil, false, err
+	}
+	return res, true, nil
+}
+
+// notify は ready に通知を送ります。既に通知が溜まっている場合は何もしません。
+func (q *spillQueue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// close はキューを閉じ、一時ファイルがあれば削除します。
+func (q *spillQueue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.mem = nil
+	q.onDisk = 0
+	if q.file == nil {
+		return nil
+	}
+	if err := q.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(q.file.Name())
+}
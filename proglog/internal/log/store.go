@@ -3,8 +3,12 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"io"
 	"os"
 	"sync"
+
+	"github.com/tysonmote/gommap"
 )
 
 var (
@@ -13,16 +17,32 @@ var (
 
 const (
 	lenWidth = 8
+	// padShift は、長さのヘッダーのうちパディングのバイト数を格納する上位ビットの位置です。
+	padShift = 48
+	lenMask  = 1<<padShift - 1
+	// MaxAlignBytes は Segment.AlignBytes に指定できる最大値です。パディングは長さのヘッダーの上位 16 ビットに格納します。
+	MaxAlignBytes = 1 << (64 - padShift)
 )
 
 // store はファイル操作を扱うための構造体です。
 // os.File を埋め込み、排他制御とバッファリング機能を提供します。
 // size フィールドでファイルサイズを管理します。
+// mmap は封印済みセグメントのストアを読み取り専用でメモリマッピングしたもので、マッピングしていない場合は nil です。
+// align が 0 より大きい場合、各レコードの後ろをパディングして次のレコードの開始位置を align の倍数に揃えます。
+// パディングのバイト数は長さのヘッダーの上位ビットに格納するため、ストアを先頭から順に読む場合も読み飛ばせます。
+// directSync が true の場合、Append はバッファを経由せずにファイルへ書き込み、永続化が完了してから戻ります。
+// prealloc はファイルの末尾より後ろに事前に確保したブロックがあるかを表し、trim または Close で解放します。
+// failed はバッファの書き出しに失敗した場合のエラーで、設定されると以降の読み書きは全てこのエラーを返します。
 type store struct {
 	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
-	size uint64
+	mu         sync.Mutex
+	buf        *bufio.Writer
+	size       uint64
+	mmap       gommap.MMap
+	align      uint64
+	directSync bool
+	prealloc   bool
+	failed     error
 }
 
 // newStore は指定された os.File を元に store 構造体を初期化して返します。
@@ -41,48 +61,158 @@ func newStore(f *os.File) (*store, error) {
 }
 
 // Append はデータ p をバッファに書き込み、書き込んだバイト数、開始位置、およびエラーを返します。
+// align が設定されている場合、書き込んだバイト数にはパディングを含みます。
+// directSync が設定されている場合は、データを永続化してから戻ります。
+// バッファが解放されている場合は新しく確保します。
+// 書き込みに失敗した場合や書き込めたバイト数が足りない場合は、途中まで書き込んだデータを取り消して size を元に戻すため、
+// 続く Append は失敗したレコードの位置から書き込みます。
+// ただし、それ以前にバッファに溜めたレコードの書き出しに失敗した場合は、取り消せないためストアを使用できなくし、ErrStoreFailed を返します。
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.failed != nil {
+		return 0, 0, s.failed
+	}
+	if s.buf == nil {
+		s.buf = bufio.NewWriter(s.File)
+	}
 	pos = s.size
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
-		return 0, 0, err
+	pad := s.padding(pos + lenWidth + uint64(len(p)))
+	w := lenWidth + len(p) + int(pad)
+	// 取り消すときにこのレコードのデータだけを捨てられるよう、収まらない場合は先にバッファを空にしておく
+	if s.buf.Available() < w && s.buf.Buffered() > 0 {
+		if err = s.flush(); err != nil {
+			return 0, 0, err
+		}
+	}
+	var header [lenWidth]byte
+	enc.PutUint64(header[:], pad<<padShift|uint64(len(p)))
+	if err = s.write(header[:]); err == nil {
+		err = s.write(p)
+	}
+	if err == nil && pad > 0 {
+		err = s.write(make([]byte, pad))
+	}
+	if err == nil && s.directSync {
+		err = s.syncAppend()
 	}
-	w, err := s.buf.Write(p)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, s.rollback(pos, err)
 	}
-	w += lenWidth
 	s.size += uint64(w)
 	return uint64(w), pos, nil
 }
 
+// write は b をバッファに書き込み、書き込めたバイト数が b の長さに満たない場合は io.ErrShortWrite を返します。
+func (s *store) write(b []byte) error {
+	n, err := s.buf.Write(b)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// rollback は書き込みに失敗したレコードのデータをバッファから捨て、ファイルに書き込まれた分を pos まで切り詰めて、
+// size を pos に戻します。次の書き込み位置もファイルの末尾に戻し、バッファは次の Append で新しく確保します。err に切り詰めの失敗を加えて返します。
+// 呼び出し側で s.mu のロックを取得しており、レコードを書き込む前のバッファが空である必要があります。
+func (s *store) rollback(pos uint64, err error) error {
+	s.buf = nil
+	s.size = pos
+	fi, statErr := s.File.Stat()
+	if statErr != nil {
+		return errors.Join(err, statErr)
+	}
+	if uint64(fi.Size()) > pos {
+		if truncErr := s.File.Truncate(int64(pos)); truncErr != nil {
+			return errors.Join(err, truncErr)
+		}
+	}
+	// O_APPEND で開いていないファイルでも、次の書き込みが切り詰めた末尾から始まるようにする
+	if _, seekErr := s.File.Seek(int64(pos), io.SeekStart); seekErr != nil {
+		return errors.Join(err, seekErr)
+	}
+	return err
+}
+
+// syncAppend はバッファをファイルに書き出し、書き込んだデータを永続化します。
+// ファイルを O_DSYNC で開いている場合は書き込みの完了が永続化を意味するため、fsync を呼び出しません。
+func (s *store) syncAppend() error {
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if dsyncSupported {
+		return nil
+	}
+	return s.File.Sync()
+}
+
+// padding は end の位置から次の align の倍数までのバイト数を返します。align が設定されていない場合は 0 を返します。
+func (s *store) padding(end uint64) uint64 {
+	if s.align == 0 {
+		return 0
+	}
+	return (s.align - end%s.align) % s.align
+}
+
+// recordLen は長さのヘッダー h からパディングを除いたレコードのバイト数を返します。
+func recordLen(h []byte) uint64 {
+	return enc.Uint64(h) & lenMask
+}
+
 // Read は指定された位置 pos からデータを読み出し、デコードしたバイトスライスとエラーを返します。
 // ファイルロックとバッファフラッシュを行い、整合性を確保します。
 // エラーが発生した場合は空のスライスとエラーを返します。
 func (s *store) Read(pos uint64) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
+	if err := s.flush(); err != nil {
 		return nil, err
 	}
 	size := make([]byte, lenWidth)
 	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
 		return nil, err
 	}
-	b := make([]byte, enc.Uint64(size))
+	b := make([]byte, recordLen(size))
 	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
 		return nil, err
 	}
 	return b, nil
 }
 
+// ReadInto は Read と同様に位置 pos からデータを読み出しますが、buf の容量が足りる場合は buf を再利用して読み込みます。
+// 読み込んだデータを格納したスライスを返します。呼び出し側は返されたスライスを次回の buf として再利用できます。
+func (s *store) ReadInto(pos uint64, buf []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return buf, err
+	}
+	if cap(buf) < lenWidth {
+		buf = make([]byte, lenWidth)
+	}
+	if _, err := s.File.ReadAt(buf[:lenWidth], int64(pos)); err != nil {
+		return buf, err
+	}
+	n := recordLen(buf[:lenWidth])
+	if uint64(cap(buf)) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	if _, err := s.File.ReadAt(buf, int64(pos+lenWidth)); err != nil {
+		return buf, err
+	}
+	return buf, nil
+}
+
 // ReadAt は指定されたオフセット off からバイトスライス p にデータを読み込み、読み取ったバイト数とエラーを返します。
 // 排他制御とバッファフラッシュを行い、データ整合性を確保します。
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
+	if err := s.flush(); err != nil {
 		return 0, err
 	}
 	return s.File.ReadAt(p, off)
@@ -92,9 +222,127 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	err := s.buf.Flush()
+	err := s.flush()
 	if err != nil {
+		// 使用できなくなったストアでもファイルは閉じる
+		return errors.Join(err, s.File.Close())
+	}
+	if err = s.truncatePrealloc(); err != nil {
+		return err
+	}
+	if err = s.unmap(); err != nil {
 		return err
 	}
 	return s.File.Close()
-}
\ No newline at end of file
+}
+
+// trim はバッファをフラッシュしてから、事前に確保したブロックのうちファイルの末尾より後ろの分を解放します。
+// 書き込まれなくなった封印済みセグメントのストアに使用します。
+func (s *store) trim() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.truncatePrealloc()
+}
+
+// release はバッファをフラッシュしてから解放し、読み取り専用のメモリマップがあれば解放します。
+// 次に Append したときに新しいバッファを確保します。
+func (s *store) release() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	s.buf = nil
+	return s.unmap()
+}
+
+// mapReadOnly はバッファをフラッシュしてから、ストアのファイルを読み取り専用でメモリにマッピングします。
+// 以降に追記されたデータはマッピングに含まれないため、書き込まれなくなった封印済みセグメントのストアにだけ使用します。
+func (s *store) mapReadOnly() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mmap != nil || s.size == 0 {
+		return nil
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	mmap, err := gommap.Map(s.File.Fd(), gommap.PROT_READ, gommap.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	s.mmap = mmap
+	return nil
+}
+
+// ReadRef は位置 pos のデータを、コピーせずにメモリマップを参照するスライスとして返します。
+// メモリマップがない場合や pos がマッピングの範囲外の場合は ok に false を返します。
+// 返したスライスはメモリマップが解放されるまでの間だけ有効で、書き換えてはいけません。
+func (s *store) ReadRef(pos uint64) (b []byte, ok bool) {
+	if s.mmap == nil || uint64(len(s.mmap)) < pos+lenWidth {
+		return nil, false
+	}
+	n := recordLen(s.mmap[pos : pos+lenWidth])
+	if uint64(len(s.mmap)) < pos+lenWidth+n {
+		return nil, false
+	}
+	return s.mmap[pos+lenWidth : pos+lenWidth+n], true
+}
+
+// prefetch は位置 pos のレコードを OS のページキャッシュに読み込むよう促します。
+// メモリマップがある場合はその範囲に MADV_WILLNEED を指定し、ない場合は読み出した内容を捨てます。
+func (s *store) prefetch(pos uint64) error {
+	if s.mmap != nil && pos+lenWidth <= uint64(len(s.mmap)) {
+		end := min(pos+lenWidth+recordLen(s.mmap[pos:pos+lenWidth]), uint64(len(s.mmap)))
+		// madvise にはページ境界に揃えたアドレスを渡す必要がある
+		start := pos &^ (uint64(os.Getpagesize()) - 1)
+		return s.mmap[start:end].Advise(gommap.MADV_WILLNEED)
+	}
+	_, err := s.Read(pos)
+	return err
+}
+
+// unmap は読み取り専用のメモリマップがあれば解放します。呼び出し側で s.mu のロックを取得している必要があります。
+func (s *store) unmap() error {
+	if s.mmap == nil {
+		return nil
+	}
+	if err := s.mmap.UnsafeUnmap(); err != nil {
+		return err
+	}
+	s.mmap = nil
+	return nil
+}
+
+// truncatePrealloc は事前に確保したブロックがあれば、ファイルを現在のサイズに切り詰めて末尾より後ろの分を解放します。
+// バッファはフラッシュ済みで、呼び出し側で s.mu のロックを取得している必要があります。
+func (s *store) truncatePrealloc() error {
+	if !s.prealloc {
+		return nil
+	}
+	if err := s.File.Truncate(int64(s.size)); err != nil {
+		return err
+	}
+	s.prealloc = false
+	return nil
+}
+
+// flush はバッファがあればフラッシュします。呼び出し側で s.mu のロックを取得している必要があります。
+// フラッシュに失敗した場合はストアを使用できなくし、ErrStoreFailed を含むエラーを返します。
+func (s *store) flush() error {
+	if s.failed != nil {
+		return s.failed
+	}
+	if s.buf == nil {
+		return nil
+	}
+	if err := s.buf.Flush(); err != nil {
+		// 書き出せなかったレコードはすでに size とインデックスに反映されているため、取り消さずにストアを使用できなくする
+		s.failed = errors.Join(ErrStoreFailed, err)
+		return s.failed
+	}
+	return nil
+}
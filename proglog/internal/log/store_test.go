@@ -1,6 +1,10 @@
 package log
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
 	"os"
 	"testing"
 
@@ -78,6 +82,141 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+// TestStoreAlign は、align を設定したストアで各レコードの開始位置が align の倍数に揃い、
+// 位置を指定した読み出しと、ヘッダーのパディングを読み飛ばしながら先頭から順に読む場合の両方で正しく読めることを検証します。
+func TestStoreAlign(t *testing.T) {
+	const align = 512
+	f, err := os.CreateTemp("", "store_align_test")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(f.Name()) }()
+	s, err := newStore(f)
+	require.NoError(t, err)
+	s.align = align
+
+	records := [][]byte{write, bytes.Repeat([]byte("a"), 600), {1}, bytes.Repeat([]byte("b"), align-lenWidth)}
+	var positions []uint64
+	for _, record := range records {
+		n, pos, err := s.Append(record)
+		require.NoError(t, err)
+		require.Zero(t, pos%align)
+		require.Zero(t, (pos+n)%align)
+		positions = append(positions, pos)
+	}
+	for i, pos := range positions {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, records[i], read)
+	}
+
+	var off int64
+	for _, record := range records {
+		h := make([]byte, lenWidth)
+		_, err = s.ReadAt(h, off)
+		require.NoError(t, err)
+		n, pad := recordLen(h), enc.Uint64(h)>>padShift
+		b := make([]byte, n)
+		_, err = s.ReadAt(b, off+lenWidth)
+		require.NoError(t, err)
+		require.Equal(t, record, b)
+		off += int64(lenWidth + n + pad)
+	}
+	require.Equal(t, int64(s.size), off)
+	require.NoError(t, s.Close())
+}
+
+// shortWriter は最初の n バイトだけを w に書き込み、それ以降は書き込んだバイト数を短く返す io.Writer です。
+type shortWriter struct {
+	w io.Writer
+	n int
+}
+
+func (sw *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > sw.n {
+		p = p[:sw.n]
+	}
+	n, err := sw.w.Write(p)
+	sw.n -= n
+	return n, err
+}
+
+// TestStoreAppendShortWrite は、書き込みが途中で止まった Append がエラーを返して size を元に戻し、
+// ファイルに書き込まれた途中までのデータを取り消して、続く Append と Read が正しい位置で動作することを検証します。
+func TestStoreAppendShortWrite(t *testing.T) {
+	f, err := os.CreateTemp("", "store_short_write_test")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(f.Name()) }()
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+
+	_, first, err := s.Append(write)
+	require.NoError(t, err)
+	size := s.size
+	require.NoError(t, s.flush())
+
+	// バッファより大きなレコードはファイルに直接書き込まれるため、書き込みの途中で失敗させられる
+	s.buf = bufio.NewWriterSize(&shortWriter{w: s.File, n: 5}, 16)
+	_, _, err = s.Append(bytes.Repeat([]byte("a"), 100))
+	require.ErrorIs(t, err, io.ErrShortWrite)
+	require.Equal(t, size, s.size)
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(size), fi.Size())
+
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, size, pos)
+	for _, p := range []uint64{first, pos} {
+		read, err := s.Read(p)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+}
+
+// errWriter は常に err を返す io.Writer です。
+type errWriter struct {
+	err error
+}
+
+func (w errWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
+
+// TestStoreFlushFailure は、バッファに溜めたレコードの書き出しに失敗した場合に、ストアが ErrStoreFailed で使用できなくなり、
+// 書き出せなかったレコードを捨てたりファイルに穴を空けたりせずに、以降の読み書きが全て失敗することを検証します。
+func TestStoreFlushFailure(t *testing.T) {
+	f, err := os.CreateTemp("", "store_flush_failure_test")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(f.Name()) }()
+	s, err := newStore(f)
+	require.NoError(t, err)
+
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.flush())
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	flushed := fi.Size()
+
+	errDisk := errors.New("disk failure")
+	s.buf = bufio.NewWriterSize(errWriter{err: errDisk}, 64)
+	_, buffered, err := s.Append(write)
+	require.NoError(t, err)
+	// 次のレコードはバッファに収まらないため、先にバッファを書き出そうとして失敗する
+	_, _, err = s.Append(bytes.Repeat([]byte("a"), 100))
+	require.ErrorIs(t, err, ErrStoreFailed)
+	require.ErrorIs(t, err, errDisk)
+
+	_, _, err = s.Append(write)
+	require.ErrorIs(t, err, ErrStoreFailed)
+	_, err = s.Read(buffered)
+	require.ErrorIs(t, err, ErrStoreFailed)
+	fi, err = os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, flushed, fi.Size())
+	require.ErrorIs(t, s.Close(), ErrStoreFailed)
+}
+
 // TestStoreClose は store 構造体の Close メソッドの動作をテストします。
 // ファイルクローズ後のサイズの変化をチェックし、適切な動作を検証します。
 func TestStoreClose(t *testing.T) {
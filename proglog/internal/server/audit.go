@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+	"github.com/ishisaka/go_distribute/proglog/internal/log"
+)
+
+// truncater は、指定したオフセット以下のレコードを削除できる CommitLog が実装するインターフェースです。
+type truncater interface {
+	Truncate(lowest uint64) error
+}
+
+// Truncate は lowest 以下のレコードをログから削除する管理操作です。
+// admin の権限が必要で、実行した主体とパラメーターを監査ログに記録します。
+// RequireMaintenance が設定されている場合は、メンテナンスモードでなければ FailedPrecondition のエラーを返します。
+// CommitLog が削除に対応していない場合は Unimplemented のエラーを、
+// まだ何も消費されておらず何も削除できない場合は FailedPrecondition のエラーを、
+// lowest が最大オフセット以上でアクティブセグメントまで削除されてしまう場合は InvalidArgument のエラーを、
+// ログが閉じられている場合は Unavailable のエラーを返します。
+func (s *grpcServer) Truncate(ctx context.Context, req *api.TruncateRequest) (
+	*api.TruncateResponse, error) {
+	if err := s.authorize(ctx, adminAction); err != nil {
+		return nil, err
+	}
+	if err := s.requireMaintenance(); err != nil {
+		return nil, err
+	}
+	t, ok := s.CommitLog.(truncater)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log does not support truncate")
+	}
+	if err := t.Truncate(req.Lowest); err != nil {
+		switch {
+		case errors.Is(err, log.ErrNothingConsumed):
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		case errors.Is(err, log.ErrInvalidTruncate):
+			return nil, api.ErrInvalidArgument{Field: "lowest", Reason: err.Error()}
+		case errors.Is(err, log.ErrLogClosed):
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		return nil, err
+	}
+	if err := s.audit(ctx, "truncate", map[string]string{
+		"lowest": strconv.FormatUint(req.Lowest, 10),
+	}); err != nil {
+		return nil, err
+	}
+	return &api.TruncateResponse{}, nil
+}
+
+// SetLogLevel は LogLevel を req.Level に変更し、変更前のレベルを返す管理操作です。admin の権限が必要です。
+// 再起動せずに本番環境の障害調査でデバッグログを有効にするために使用します。
+// LogLevel が設定されていない場合は FailedPrecondition を、不正なレベルの場合は InvalidArgument を返します。
+func (s *grpcServer) SetLogLevel(ctx context.Context, req *api.SetLogLevelRequest) (
+	*api.SetLogLevelResponse, error) {
+	if err := s.authorize(ctx, adminAction); err != nil {
+		return nil, err
+	}
+	if s.LogLevel == nil {
+		return nil, status.Error(codes.FailedPrecondition, "log level is not configurable")
+	}
+	level, err := zapcore.ParseLevel(req.Level)
+	if err != nil {
+		return nil, api.ErrInvalidArgument{Field: "level", Reason: err.Error()}
+	}
+	previous := s.LogLevel.Level()
+	s.LogLevel.SetLevel(level)
+	if err = s.audit(ctx, "set_log_level", map[string]string{
+		"level": level.String(),
+	}); err != nil {
+		return nil, err
+	}
+	return &api.SetLogLevelResponse{Previous: previous.String()}, nil
+}
+
+// GetAuditLog は監査ログに記録された管理操作を古い順に返します。admin の権限が必要です。
+// AuditLog が設定されていない場合は空の一覧を返します。
+func (s *grpcServer) GetAuditLog(ctx context.Context, _ *api.GetAuditLogRequest) (
+	*api.GetAuditLogResponse, error) {
+	if err := s.authorize(ctx, adminAction); err != nil {
+		return nil, err
+	}
+	res := &api.GetAuditLogResponse{}
+	if s.AuditLog == nil {
+		return res, nil
+	}
+	for off := uint64(0); ; off++ {
+		record, err := s.AuditLog.Read(off)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			return res, nil
+		default:
+			return nil, err
+		}
+		entry := &api.AuditEntry{}
+		if err = proto.Unmarshal(record.Value, entry); err != nil {
+			return nil, err
+		}
+		res.Entries = append(res.Entries, entry)
+	}
+}
+
+// audit は管理操作 operation を、実行した主体、時刻、パラメーターとともに AuditLog に追記します。
+// AuditLog が設定されていない場合は何もしません。
+func (s *grpcServer) audit(ctx context.Context, operation string, params map[string]string) error {
+	if s.AuditLog == nil {
+		return nil
+	}
+	b, err := proto.Marshal(&api.AuditEntry{
+		TimeUnixNano: time.Now().UnixNano(),
+		Subject:      subject(ctx),
+		Operation:    operation,
+		Parameters:   params,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.AuditLog.Append(&api.Record{Value: b})
+	return err
+}
@@ -0,0 +1,45 @@
+package server
+
+import "context"
+
+// AttributePeerAddress は、リクエストを送信したクライアントのアドレスを格納する Attributes のキーです。
+const AttributePeerAddress = "peer.address"
+
+// Attributes は、接続元のアドレスなど、認可の判断に使用できるリクエストの属性です。
+// authenticate がリクエストごとにコンテキストへ格納します。
+type Attributes map[string]string
+
+// AttributeAuthorizer は、主体、対象、アクションに加えてリクエストの属性を使って認可する Authorizer です。
+// 時間帯や接続元のアドレスなど、属性に基づくアクセス制御に使用します。
+type AttributeAuthorizer interface {
+	Authorizer
+
+	// AuthorizeAttributes は attrs を考慮してアクセス権を確認し、許可しない場合はエラーを返します。
+	AuthorizeAttributes(subject, object, action string, attrs Attributes) error
+}
+
+// attributesContextKey は、コンテキストに Attributes を格納するためのキーです。
+type attributesContextKey struct{}
+
+// attributes はコンテキストに格納されたリクエストの属性を返します。格納されていない場合は nil を返します。
+func attributes(ctx context.Context) Attributes {
+	attrs, _ := ctx.Value(attributesContextKey{}).(Attributes)
+	return attrs
+}
+
+// authorize は、設定された全ての Authorizer を順番に評価し、いずれかが拒否した場合はそのエラーを返します。
+// AttributeAuthorizer を実装する Authorizer にはリクエストの属性も渡します。
+func (s *grpcServer) authorize(ctx context.Context, action string) error {
+	for _, a := range s.authorizers {
+		var err error
+		if aa, ok := a.(AttributeAuthorizer); ok {
+			err = aa.AuthorizeAttributes(subject(ctx), objectWildcard, action, attributes(ctx))
+		} else {
+			err = a.Authorize(subject(ctx), objectWildcard, action)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
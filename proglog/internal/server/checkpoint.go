@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// checkpoints はコンシューマー名ごとに、次に配信するオフセットをサーバー側で保持します。
+// 位置は Ack で確認応答されたオフセットの次に進み、確認応答されていないレコードは再接続時に再び配信されます。
+// acked はコンシューマーごとに最後に Ack した時刻で、evictIdle で放置されたコンシューマーを判定するために使用します。
+type checkpoints struct {
+	mu    sync.Mutex
+	next  map[string]uint64
+	acked map[string]time.Time
+	now   func() time.Time
+}
+
+// newCheckpoints は空の checkpoints を作成します。
+func newCheckpoints() *checkpoints {
+	return &checkpoints{
+		next:  make(map[string]uint64),
+		acked: make(map[string]time.Time),
+		now:   time.Now,
+	}
+}
+
+// get は name のコンシューマーが次に読み出すオフセットを返します。未登録の場合は 0 を返します。
+func (c *checkpoints) get(name string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.next[name]
+}
+
+// ack は name のコンシューマーが off までを処理したことを記録し、位置を off の次に進めます。
+// すでにそれより先まで進んでいる場合は位置を戻しませんが、Ack した時刻は更新します。
+func (c *checkpoints) ack(name string, off uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.acked[name] = c.now()
+	if next := off + 1; next > c.next[name] {
+		c.next[name] = next
+	}
+}
+
+// evictIdle は ttl より長い間 Ack していないコンシューマーの位置を削除し、削除したコンシューマーの名前と位置を返します。
+// ttl 以内に Ack したコンシューマーは削除しません。
+func (c *checkpoints) evictIdle(ttl time.Duration) map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	evicted := make(map[string]uint64)
+	for name, acked := range c.acked {
+		if now.Sub(acked) <= ttl {
+			continue
+		}
+		evicted[name] = c.next[name]
+		delete(c.next, name)
+		delete(c.acked, name)
+	}
+	return evicted
+}
+
+// evictIdleConsumersLoop は Shutdown が閉じられるまで、ConsumerOffsetTTL ごとに放置されたコンシューマーの位置を削除します。
+func (s *grpcServer) evictIdleConsumersLoop() {
+	ticker := time.NewTicker(s.ConsumerOffsetTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.Shutdown:
+			return
+		case <-ticker.C:
+			s.evictIdleConsumers()
+		}
+	}
+}
+
+// evictIdleConsumers は ConsumerOffsetTTL より長い間 Ack していないコンシューマーの位置を削除し、削除したことをログに出力します。
+func (s *grpcServer) evictIdleConsumers() {
+	for name, next := range s.checkpoints.evictIdle(s.ConsumerOffsetTTL) {
+		s.logger.Info("evicted idle consumer offset",
+			zap.String("consumer", name),
+			zap.Uint64("next_offset", next),
+		)
+	}
+}
+
+// resolveConsumer は req に ConsumerName が指定されている場合、そのコンシューマーの位置を Offset に設定した複製を返します。
+// 指定されていない場合は req をそのまま返します。
+func (s *grpcServer) resolveConsumer(req *api.ConsumeRequest) *api.ConsumeRequest {
+	if req.ConsumerName == "" {
+		return req
+	}
+	resolved := proto.Clone(req).(*api.ConsumeRequest)
+	resolved.Offset = s.checkpoints.get(req.ConsumerName)
+	resolved.ConsumerName = ""
+	return resolved
+}
+
+// Ack は名前付きコンシューマーが offset までのレコードを処理したことをサーバーに記録します。
+// 同じ ConsumerName で Consume や ConsumeStream を呼び出すと、記録した位置の次から読み出します。
+// consume の権限が必要で、ConsumerName が空の場合は InvalidArgument のエラーを返します。
+func (s *grpcServer) Ack(ctx context.Context, req *api.AckRequest) (*api.AckResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	if req.ConsumerName == "" {
+		return nil, api.ErrInvalidArgument{
+			Field:  "consumer_name",
+			Reason: "must not be empty",
+		}
+	}
+	s.checkpoints.ack(req.ConsumerName, req.Offset)
+	return &api.AckResponse{}, nil
+}
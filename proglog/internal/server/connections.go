@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/stats"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// connRegistry は stats.Handler としてサーバーに登録し、接続中のクライアントとそのストリームの数を記録します。
+// 接続は TagConn で登録して ConnEnd で削除し、ストリームの数は RPC の Begin と End で増減させます。
+type connRegistry struct {
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[uint64]*connInfo
+}
+
+// connInfo は 1 つの接続について ListConnections で返す情報です。
+// subject は最初の RPC で TLS の証明書から取得するため、RPC を呼び出していない接続では空です。
+type connInfo struct {
+	peerAddr string
+	subject  string
+	started  time.Time
+	streams  uint64
+}
+
+// connContextKey は接続のコンテキストに接続の ID を保持するためのキーです。
+type connContextKey struct{}
+
+// rpcContextKey は RPC のコンテキストに、その RPC をストリームとして数えたかを保持するためのキーです。
+type rpcContextKey struct{}
+
+// rpcState は 1 つの RPC について、開始時にストリームとして数えたかを記録します。
+type rpcState struct {
+	stream bool
+}
+
+var _ stats.Handler = (*connRegistry)(nil)
+
+// newConnRegistry は空の connRegistry を作成します。
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: make(map[uint64]*connInfo)}
+}
+
+// TagConn は新しい接続を登録し、その ID をコンテキストに設定します。
+func (r *connRegistry) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	conn := &connInfo{started: time.Now()}
+	if info.RemoteAddr != nil {
+		conn.peerAddr = info.RemoteAddr.String()
+	}
+	r.conns[r.nextID] = conn
+	return context.WithValue(ctx, connContextKey{}, r.nextID)
+}
+
+// HandleConn は接続が終了した場合に、その接続を登録から削除します。
+func (r *connRegistry) HandleConn(ctx context.Context, s stats.ConnStats) {
+	if _, ok := s.(*stats.ConnEnd); !ok {
+		return
+	}
+	id, ok := ctx.Value(connContextKey{}).(uint64)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, id)
+}
+
+// TagRPC は接続の主体がまだ分かっていない場合に、TLS の証明書のコモンネームを接続の主体として記録します。
+func (r *connRegistry) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	ctx = context.WithValue(ctx, rpcContextKey{}, &rpcState{})
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 {
+		return ctx
+	}
+	r.update(ctx, func(conn *connInfo) {
+		if conn.subject == "" {
+			conn.subject = tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+		}
+	})
+	return ctx
+}
+
+// HandleRPC はストリーミング RPC の開始と終了に合わせて、接続のストリームの数を増減させます。
+func (r *connRegistry) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	state, ok := ctx.Value(rpcContextKey{}).(*rpcState)
+	if !ok {
+		return
+	}
+	switch s := s.(type) {
+	case *stats.Begin:
+		if !s.IsClientStream && !s.IsServerStream {
+			return
+		}
+		state.stream = true
+		r.update(ctx, func(conn *connInfo) { conn.streams++ })
+	case *stats.End:
+		if !state.stream {
+			return
+		}
+		r.update(ctx, func(conn *connInfo) { conn.streams-- })
+	}
+}
+
+// update はコンテキストの接続が登録されている場合に、その情報を fn で更新します。
+func (r *connRegistry) update(ctx context.Context, fn func(*connInfo)) {
+	id, ok := ctx.Value(connContextKey{}).(uint64)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if conn, ok := r.conns[id]; ok {
+		fn(conn)
+	}
+}
+
+// list は接続中の全ての接続の情報を、接続した順に返します。
+func (r *connRegistry) list() []*api.Connection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conns := make([]*connInfo, 0, len(r.conns))
+	for _, conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].started.Before(conns[j].started)
+	})
+	res := make([]*api.Connection, 0, len(conns))
+	for _, conn := range conns {
+		res = append(res, &api.Connection{
+			Subject:       conn.subject,
+			PeerAddr:      conn.peerAddr,
+			ActiveStreams: conn.streams,
+			AgeMs:         uint64(time.Since(conn.started).Milliseconds()),
+		})
+	}
+	return res
+}
+
+// ListConnections はこのサーバーに接続中のクライアントごとに、主体、アドレス、実行中のストリームの数、接続してからの時間を返します。
+// admin の権限が必要です。
+func (s *grpcServer) ListConnections(ctx context.Context, _ *api.ListConnectionsRequest) (
+	*api.ListConnectionsResponse, error) {
+	if err := s.authorize(ctx, adminAction); err != nil {
+		return nil, err
+	}
+	return &api.ListConnectionsResponse{Connections: s.connections.list()}, nil
+}
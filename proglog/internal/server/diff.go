@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+	"github.com/ishisaka/go_distribute/proglog/internal/log"
+)
+
+// Diff はこのサーバーのログと PeerAddr のサーバーのログを From から To までレコードごとに比較し、
+// 一致しなかったオフセットとその理由をストリームで返す管理操作です。admin の権限が必要です。
+// リーダーとフォロワーのレプリケーションが正しく行われているかの検証に使用します。
+func (s *grpcServer) Diff(req *api.DiffRequest, stream api.Log_DiffServer) error {
+	ctx := stream.Context()
+	if err := s.authorize(ctx, adminAction); err != nil {
+		return err
+	}
+	src, ok := s.CommitLog.(*log.Log)
+	if !ok {
+		return status.Error(codes.Unimplemented, "commit log does not support diff")
+	}
+	if req.To < req.From {
+		return api.ErrInvalidArgument{Field: "to", Reason: "must not be less than from"}
+	}
+	cc, err := grpc.NewClient(req.PeerAddr, s.PeerDialOptions...)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = cc.Close() }()
+	dst := remoteLog{ctx: ctx, client: api.NewLogClient(cc)}
+	return log.Diff(src, dst, req.From, req.To, func(m log.Mismatch) error {
+		return stream.Send(&api.DiffResponse{Offset: m.Offset, Reason: m.Reason})
+	})
+}
+
+// remoteLog は gRPC クライアントを通じて他のサーバーのログを読み出す log.RecordReader です。
+type remoteLog struct {
+	ctx    context.Context
+	client api.LogClient
+}
+
+// Read は他のサーバーから指定されたオフセットのレコードを読み出します。
+func (r remoteLog) Read(off uint64) (*api.Record, error) {
+	res, err := r.client.Consume(r.ctx, &api.ConsumeRequest{Offset: off})
+	if err != nil {
+		return nil, err
+	}
+	return res.Record, nil
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+	"github.com/ishisaka/go_distribute/proglog/internal/log"
+)
+
+// eventSubscriber は、切り詰めやコンパクションのイベントを購読できる CommitLog が実装するインターフェースです。
+type eventSubscriber interface {
+	Subscribe() (<-chan log.Event, func())
+}
+
+// subscribeEvents は req.IncludeEvents が指定されている場合にログのイベントを購読し、
+// イベントのチャネルと購読を解除する関数を返します。指定されていない場合は nil のチャネルを返します。
+// CommitLog が対応していない場合は Unimplemented のエラーを返します。
+func (s *grpcServer) subscribeEvents(req *api.ConsumeRequest) (<-chan log.Event, func(), error) {
+	if !req.IncludeEvents {
+		return nil, func() {}, nil
+	}
+	sub, ok := s.CommitLog.(eventSubscriber)
+	if !ok {
+		return nil, nil, status.Error(codes.Unimplemented,
+			"commit log does not support events")
+	}
+	events, unsubscribe := sub.Subscribe()
+	return events, unsubscribe, nil
+}
+
+// sendEvents は events に溜まっているイベントをブロックせずにすべてストリームへ送信します。
+func sendEvents(stream api.Log_ConsumeStreamServer, events <-chan log.Event) error {
+	for {
+		select {
+		case e := <-events:
+			if err := stream.Send(&api.ConsumeResponse{Event: &api.LogEvent{
+				Type:   string(e.Type),
+				Offset: e.Offset,
+			}}); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// existenceChecker は、レコードを読み出さずにオフセットが存在するかを判定できる CommitLog が実装するインターフェースです。
+type existenceChecker interface {
+	Exists(off uint64) bool
+}
+
+// Exists は指定されたオフセットのレコードがログに存在するかを、レコードを読み出さずに返します。
+// 値の大きなレコードを Consume する前に存在を確認するためのもので、consume の権限が必要です。
+// CommitLog が対応していない場合は Unimplemented のエラーを返します。
+func (s *grpcServer) Exists(ctx context.Context, req *api.ExistsRequest) (
+	*api.ExistsResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	c, ok := s.CommitLog.(existenceChecker)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log does not support exists")
+	}
+	return &api.ExistsResponse{Exists: c.Exists(req.Offset)}, nil
+}
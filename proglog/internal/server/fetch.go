@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// defaultFetchMaxBytes は MaxBytes が未指定の場合に Fetch が 1 回で返すレコードの合計サイズの上限です。
+const defaultFetchMaxBytes = 1 << 20
+
+// Fetch は offset から順に、エンコードしたサイズの合計が MaxBytes を超えない範囲でレコードを返します。
+// 先頭のレコードだけで MaxBytes を超える場合も、複製が進むようにそのレコードは返します。
+// ログの末尾に達した場合は待たずに返すため、呼び出し側が次に取得する時期と量を決められます。
+// consume の権限が必要です。
+func (s *grpcServer) Fetch(ctx context.Context, req *api.FetchRequest) (
+	*api.FetchResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	limit := req.MaxBytes
+	if limit == 0 {
+		limit = defaultFetchMaxBytes
+	}
+	res := &api.FetchResponse{}
+	var size uint64
+	for off := req.Offset; ; off++ {
+		record, err := s.CommitLog.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		size += uint64(proto.Size(record))
+		if size > limit && len(res.Records) > 0 {
+			break
+		}
+		res.Records = append(res.Records, record)
+		if size >= limit {
+			break
+		}
+	}
+	if h, ok := s.CommitLog.(highestOffsetter); ok {
+		highest, err := h.HighestOffset()
+		if err != nil {
+			return nil, err
+		}
+		res.HighestOffset = highest
+	}
+	return res, nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// highWatermarker は、複製済みの最大オフセット（ハイウォーターマーク）を保持できる CommitLog が実装するインターフェースです。
+type highWatermarker interface {
+	HighestOffset() (uint64, error)
+	HighWatermark() uint64
+	SetHighWatermark(off uint64)
+}
+
+// replicaAcks はレプリカ名ごとに、そのレプリカが複製を確認応答した最大のオフセットを保持します。
+// 名前付きコンシューマーの位置とは別に保持し、consume の権限だけではハイウォーターマークを動かせないようにします。
+type replicaAcks struct {
+	mu      sync.Mutex
+	offsets map[string]uint64
+}
+
+// newReplicaAcks は空の replicaAcks を作成します。
+func newReplicaAcks() *replicaAcks {
+	return &replicaAcks{offsets: make(map[string]uint64)}
+}
+
+// ack は name のレプリカが off までを複製したことを記録します。すでにそれより先まで記録している場合は戻しません。
+func (a *replicaAcks) ack(name string, off uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if prev, ok := a.offsets[name]; !ok || off > prev {
+		a.offsets[name] = off
+	}
+}
+
+// minimum は names の全てのレプリカが複製を確認応答したオフセットの最小値を返します。
+// まだ確認応答していないレプリカがある場合は false を返します。
+func (a *replicaAcks) minimum(names []string) (uint64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var hwm uint64
+	for i, name := range names {
+		off, ok := a.offsets[name]
+		if !ok {
+			return 0, false
+		}
+		if i == 0 || off < hwm {
+			hwm = off
+		}
+	}
+	return hwm, true
+}
+
+// replicaNames は ReplicaNames が返すレプリカの名前を返します。ReplicaNames が nil の場合は nil を返します。
+func (s *grpcServer) replicaNames() []string {
+	if s.ReplicaNames == nil {
+		return nil
+	}
+	return s.ReplicaNames()
+}
+
+// GetHighWatermark はこのサーバーのログのハイウォーターマークと最大オフセットを返します。
+// レプリカがない場合は、書き込み済みのレコードは全て確定しているため最大オフセットをハイウォーターマークとして返します。
+// consume の権限が必要です。CommitLog がハイウォーターマークを保持できない場合は Unimplemented のエラーを返します。
+func (s *grpcServer) GetHighWatermark(ctx context.Context, _ *api.GetHighWatermarkRequest) (
+	*api.GetHighWatermarkResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	h, ok := s.CommitLog.(highWatermarker)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log does not track a high-watermark")
+	}
+	highest, err := h.HighestOffset()
+	if err != nil {
+		return nil, err
+	}
+	hwm := highest
+	if len(s.replicaNames()) > 0 {
+		hwm = h.HighWatermark()
+	}
+	return &api.GetHighWatermarkResponse{
+		HighWatermark: hwm,
+		HighestOffset: highest,
+	}, nil
+}
+
+// AckReplica はレプリカが offset までを複製したことを記録し、ReplicaNames の全てのレプリカが確認応答したオフセットの最小値を
+// ログのハイウォーターマークとして記録します。記録した後のハイウォーターマークを返します。
+// ハイウォーターマークを動かせるのは複製するノードだけにするため、replicate の権限が必要です。
+// ReplicaName が空の場合は InvalidArgument のエラーを返します。
+func (s *grpcServer) AckReplica(ctx context.Context, req *api.AckReplicaRequest) (
+	*api.AckReplicaResponse, error) {
+	if err := s.authorize(ctx, replicateAction); err != nil {
+		return nil, err
+	}
+	if req.ReplicaName == "" {
+		return nil, api.ErrInvalidArgument{
+			Field:  "replica_name",
+			Reason: "must not be empty",
+		}
+	}
+	s.replicaAcks.ack(req.ReplicaName, req.Offset)
+	h, ok := s.CommitLog.(highWatermarker)
+	if !ok {
+		return &api.AckReplicaResponse{}, nil
+	}
+	names := s.replicaNames()
+	if hwm, ok := s.replicaAcks.minimum(names); ok && len(names) > 0 {
+		h.SetHighWatermark(hwm)
+	}
+	return &api.AckReplicaResponse{HighWatermark: h.HighWatermark()}, nil
+}
+
+// committedOffset は CommittedOnly の読み出しで確定済みとして扱う最大オフセットを返します。
+// HighWatermarkFunc が設定されている場合はその値を使用し、設定されていない場合は CommitLog のハイウォーターマークを使用します。
+// レプリカがない場合は最大オフセットまでを確定済みとし、確認応答していないレプリカがある場合は false を返します。
+// どちらも使用できない場合は FailedPrecondition のエラーを返します。
+func (s *grpcServer) committedOffset() (uint64, bool, error) {
+	if s.HighWatermarkFunc != nil {
+		hwm, ok := s.HighWatermarkFunc()
+		return hwm, ok, nil
+	}
+	h, ok := s.CommitLog.(highWatermarker)
+	if !ok {
+		return 0, false, status.Error(codes.FailedPrecondition, "high-watermark is not tracked")
+	}
+	names := s.replicaNames()
+	if len(names) == 0 {
+		highest, err := h.HighestOffset()
+		return highest, true, err
+	}
+	if _, ok = s.replicaAcks.minimum(names); !ok {
+		return 0, false, nil
+	}
+	return h.HighWatermark(), true, nil
+}
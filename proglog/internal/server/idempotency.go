@@ -0,0 +1,49 @@
+package server
+
+import "sync"
+
+// defaultIdempotencyCacheSize は IdempotencyCacheSize が未設定の場合に保持する冪等キーの数です。
+const defaultIdempotencyCacheSize = 1024
+
+// idempotencyCache は冪等キーと、そのキーで書き込まれたレコードのオフセットの対応を保持するキャッシュです。
+// 上限を超えた場合は、古いキーから順に破棄します。
+type idempotencyCache struct {
+	mu      sync.Mutex
+	size    int
+	offsets map[string]uint64
+	order   []string
+}
+
+// newIdempotencyCache は最大 size 件のキーを保持する idempotencyCache を作成します。
+// size が 0 以下の場合はデフォルト値を使用します。
+func newIdempotencyCache(size int) *idempotencyCache {
+	if size <= 0 {
+		size = defaultIdempotencyCacheSize
+	}
+	return &idempotencyCache{
+		size:    size,
+		offsets: make(map[string]uint64),
+	}
+}
+
+// appendOnce は key が未登録の場合だけ appendFn を呼び出してレコードを書き込み、そのオフセットを記録します。
+// key が登録済みの場合は書き込みを行わず、記録済みのオフセットと duplicate=true を返します。
+func (c *idempotencyCache) appendOnce(key string, appendFn func() (uint64, error)) (
+	offset uint64, duplicate bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if off, ok := c.offsets[key]; ok {
+		return off, true, nil
+	}
+	offset, err = appendFn()
+	if err != nil {
+		return 0, false, err
+	}
+	if len(c.order) >= c.size {
+		delete(c.offsets, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.offsets[key] = offset
+	c.order = append(c.order, key)
+	return offset, false, nil
+}
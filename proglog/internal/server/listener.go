@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net"
+)
+
+// noDelayListener は受け付けた TCP 接続に TCP_NODELAY を設定するリスナーです。
+type noDelayListener struct {
+	net.Listener
+	noDelay bool
+}
+
+// WrapListener は config の TCPNoDelay に従って、受け付けた TCP 接続の TCP_NODELAY を設定するリスナーを返します。
+// TCPNoDelay が nil の場合は有効にします。gRPC サーバーの Serve には返したリスナーを渡します。
+func WrapListener(config *Config, ln net.Listener) net.Listener {
+	noDelay := true
+	if config.TCPNoDelay != nil {
+		noDelay = *config.TCPNoDelay
+	}
+	return &noDelayListener{Listener: ln, noDelay: noDelay}
+}
+
+// Accept は次の接続を受け付け、TCP 接続であれば TCP_NODELAY を設定して返します。
+func (l *noDelayListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		// 設定に失敗しても接続はそのまま使用できるため、接続を閉じずに受け付ける
+		_ = tcp.SetNoDelay(l.noDelay)
+	}
+	return conn, nil
+}
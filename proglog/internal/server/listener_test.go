@@ -0,0 +1,106 @@
+//go:build linux
+
+package server
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+	"github.com/ishisaka/go_distribute/proglog/internal/log"
+)
+
+// TestWrapListener は、WrapListener で包んだリスナーが受け付けた接続に TCPNoDelay の設定どおり TCP_NODELAY が設定され、
+// その接続で Produce と Consume ができることを検証します。
+func TestWrapListener(t *testing.T) {
+	disabled := false
+	for scenario, noDelay := range map[string]*bool{
+		"default":  nil,
+		"disabled": &disabled,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			clog, err := log.NewLog(t.TempDir(), log.Config{})
+			require.NoError(t, err)
+			defer func() { _ = clog.Close() }()
+			config := &Config{
+				CommitLog:      clog,
+				AllowAnonymous: true,
+				TCPNoDelay:     noDelay,
+			}
+			srv, err := NewGRPCServer(config)
+			require.NoError(t, err)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			accepted := &acceptedListener{
+				Listener: WrapListener(config, l),
+				conns:    make(chan net.Conn, 1),
+			}
+			go func() {
+				_ = srv.Serve(accepted)
+			}()
+			defer srv.Stop()
+
+			conn, err := grpc.NewClient(
+				l.Addr().String(),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+			client := api.NewLogClient(conn)
+			ctx := context.Background()
+			produce, err := client.Produce(ctx, &api.ProduceRequest{
+				Record: &api.Record{Value: []byte("hello world")},
+			})
+			require.NoError(t, err)
+			consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+			require.NoError(t, err)
+			require.Equal(t, []byte("hello world"), consume.Record.Value)
+
+			want := 1
+			if noDelay != nil && !*noDelay {
+				want = 0
+			}
+			require.Equal(t, want, tcpNoDelay(t, <-accepted.conns))
+		})
+	}
+}
+
+// acceptedListener は受け付けた接続を conns に送るリスナーです。
+type acceptedListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+// Accept は次の接続を受け付け、conns に空きがあればその接続を送ります。
+func (l *acceptedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case l.conns <- conn:
+	default:
+	}
+	return conn, nil
+}
+
+// tcpNoDelay は conn のソケットに設定されている TCP_NODELAY の値を返します。
+func tcpNoDelay(t *testing.T, conn net.Conn) int {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var v int
+	var optErr error
+	err = raw.Control(func(fd uintptr) {
+		v, optErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	})
+	require.NoError(t, err)
+	require.NoError(t, optErr)
+	return v
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// errNotInMaintenance は RequireMaintenance が設定されたサーバーで、メンテナンスモード外に破壊的な管理操作を実行しようとした場合に返すエラーです。
+var errNotInMaintenance = status.Error(codes.FailedPrecondition, "server is not in maintenance mode")
+
+// SetMaintenance はメンテナンスモードを req.On に切り替え、切り替える前の状態を返す管理操作です。
+// admin の権限が必要で、実行した主体とパラメーターを監査ログに記録します。
+// RequireMaintenance が設定されている場合、Truncate などの破壊的な管理操作はメンテナンスモードの間だけ実行できます。
+func (s *grpcServer) SetMaintenance(ctx context.Context, req *api.SetMaintenanceRequest) (
+	*api.SetMaintenanceResponse, error) {
+	if err := s.authorize(ctx, adminAction); err != nil {
+		return nil, err
+	}
+	previous := s.maintenance.Swap(req.On)
+	if err := s.audit(ctx, "set_maintenance", map[string]string{
+		"on": strconv.FormatBool(req.On),
+	}); err != nil {
+		return nil, err
+	}
+	return &api.SetMaintenanceResponse{Previous: previous}, nil
+}
+
+// requireMaintenance は RequireMaintenance が設定されていてメンテナンスモードでない場合に errNotInMaintenance を返します。
+// 破壊的な管理操作の最初に呼び出します。
+func (s *grpcServer) requireMaintenance() error {
+	if s.RequireMaintenance && !s.maintenance.Load() {
+		return errNotInMaintenance
+	}
+	return nil
+}
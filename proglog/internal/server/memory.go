@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+
+	"go.opencensus.io/metric"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricproducer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+	"github.com/ishisaka/go_distribute/proglog/internal/log"
+)
+
+// memoryReporter は、メモリに保持しているデータの量を返せる CommitLog が実装するインターフェースです。
+type memoryReporter interface {
+	MemoryUsage() log.MemStats
+}
+
+// GetMemoryUsage はこのサーバーのログがメモリマッピングしているバイト数と、書き込みバッファーのバイト数を返します。
+// admin の権限が必要です。CommitLog が対応していない場合は Unimplemented のエラーを返します。
+func (s *grpcServer) GetMemoryUsage(ctx context.Context, _ *api.GetMemoryUsageRequest) (
+	*api.GetMemoryUsageResponse, error) {
+	if err := s.authorize(ctx, adminAction); err != nil {
+		return nil, err
+	}
+	r, ok := s.CommitLog.(memoryReporter)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log does not report memory usage")
+	}
+	stats := r.MemoryUsage()
+	return &api.GetMemoryUsageResponse{
+		Segments:    uint64(stats.Segments),
+		MmapBytes:   stats.MmapBytes,
+		BufferBytes: stats.BufferBytes,
+	}, nil
+}
+
+// registerMemoryGauge は CommitLog のメモリ使用量を OpenCensus のゲージ proglog/log/memory_bytes として登録します。
+// ゲージは kind ラベルで mmap と buffer を区別し、収集のたびに MemoryUsage を呼び出して値を求めます。
+// CommitLog が対応していない場合は何も登録しません。
+func registerMemoryGauge(commitLog CommitLog) error {
+	r, ok := commitLog.(memoryReporter)
+	if !ok {
+		return nil
+	}
+	registry := metric.NewRegistry()
+	gauge, err := registry.AddInt64DerivedGauge(
+		"proglog/log/memory_bytes",
+		metric.WithDescription("Bytes of log data held in memory"),
+		metric.WithUnit(metricdata.UnitBytes),
+		metric.WithLabelKeys("kind"),
+	)
+	if err != nil {
+		return err
+	}
+	if err = gauge.UpsertEntry(func() int64 {
+		return int64(r.MemoryUsage().MmapBytes)
+	}, metricdata.NewLabelValue("mmap")); err != nil {
+		return err
+	}
+	if err = gauge.UpsertEntry(func() int64 {
+		return int64(r.MemoryUsage().BufferBytes)
+	}, metricdata.NewLabelValue("buffer")); err != nil {
+		return err
+	}
+	metricproducer.GlobalManager().AddProducer(registry)
+	return nil
+}
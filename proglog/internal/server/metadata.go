@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+
+	grpcAuth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// requireMetadata は、keys の全てのメタデータが空でない値で指定されていることを確認する認証関数を返します。
+// 不足しているキーがある場合は、ハンドラーを呼び出す前に InvalidArgument のエラーを返します。
+func requireMetadata(keys []string) grpcAuth.AuthFunc {
+	return func(ctx context.Context) (context.Context, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, key := range keys {
+			found := false
+			for _, v := range md.Get(key) {
+				if v != "" {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return ctx, status.Errorf(
+					codes.InvalidArgument,
+					"missing required metadata: %s",
+					key,
+				)
+			}
+		}
+		return ctx, nil
+	}
+}
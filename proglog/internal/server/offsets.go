@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// clusterOffsetsTimeout は GetClusterOffsets が各メンバーの応答を待つ時間です。
+const clusterOffsetsTimeout = 2 * time.Second
+
+// offsetRanger は、ログの最小と最大のオフセットを返せる CommitLog が実装するインターフェースです。
+type offsetRanger interface {
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+}
+
+// GetOffsets はこのサーバーのログの最小と最大のオフセットを返します。consume の権限が必要です。
+// レコードを読み出さずにログの範囲だけを調べるための軽量な RPC です。
+// CommitLog がオフセットの範囲を返せない場合は Unimplemented のエラーを返します。
+func (s *grpcServer) GetOffsets(ctx context.Context, _ *api.GetOffsetsRequest) (
+	*api.GetOffsetsResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	r, ok := s.CommitLog.(offsetRanger)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log does not report offsets")
+	}
+	lowest, err := r.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	highest, err := r.HighestOffset()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetOffsetsResponse{Lowest: lowest, Highest: highest}, nil
+}
+
+// GetClusterOffsets は ClusterMembers の全てのメンバーに GetOffsets を問い合わせ、ノード名ごとのオフセットの範囲を返します。
+// consume の権限が必要です。応答しないメンバーがあっても全体を失敗させず、そのノードの Error にエラーを設定します。
+// ClusterMembers が設定されていない場合は FailedPrecondition のエラーを返します。
+func (s *grpcServer) GetClusterOffsets(ctx context.Context, _ *api.GetClusterOffsetsRequest) (
+	*api.GetClusterOffsetsResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	if s.ClusterMembers == nil {
+		return nil, status.Error(codes.FailedPrecondition, "cluster membership is not configured")
+	}
+	res := &api.GetClusterOffsetsResponse{Nodes: make(map[string]*api.NodeOffsets)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, addr := range s.ClusterMembers() {
+		wg.Add(1)
+		go func(name, addr string) {
+			defer wg.Done()
+			offsets := s.nodeOffsets(ctx, addr)
+			mu.Lock()
+			res.Nodes[name] = offsets
+			mu.Unlock()
+		}(name, addr)
+	}
+	wg.Wait()
+	return res, nil
+}
+
+// nodeOffsets は addr のサーバーにオフセットの範囲を問い合わせます。失敗した場合は Error を設定した結果を返します。
+func (s *grpcServer) nodeOffsets(ctx context.Context, addr string) *api.NodeOffsets {
+	ctx, cancel := context.WithTimeout(ctx, clusterOffsetsTimeout)
+	defer cancel()
+	cc, err := grpc.NewClient(addr, s.PeerDialOptions...)
+	if err != nil {
+		return &api.NodeOffsets{Error: err.Error()}
+	}
+	defer func() { _ = cc.Close() }()
+	res, err := api.NewLogClient(cc).GetOffsets(ctx, &api.GetOffsetsRequest{})
+	if err != nil {
+		return &api.NodeOffsets{Error: err.Error()}
+	}
+	return &api.NodeOffsets{Lowest: res.Lowest, Highest: res.Highest}
+}
+
+// resetInvalidOffset は req のオフセットが切り詰めによって削除されている場合に、OnInvalidOffset に従って
+// 最小か最大のオフセットに置き換えた複製を返します。OnInvalidOffset が ERROR の場合やオフセットが有効な場合は req をそのまま返します。
+// CommitLog がオフセットの範囲を返せない場合は Unimplemented のエラーを返します。
+func (s *grpcServer) resetInvalidOffset(req *api.ConsumeRequest) (*api.ConsumeRequest, error) {
+	if req.OnInvalidOffset == api.InvalidOffsetPolicy_ERROR {
+		return req, nil
+	}
+	r, ok := s.CommitLog.(offsetRanger)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log does not report offsets")
+	}
+	lowest, err := r.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	if req.Offset >= lowest {
+		return req, nil
+	}
+	resolved := proto.Clone(req).(*api.ConsumeRequest)
+	resolved.Offset = lowest
+	if req.OnInvalidOffset == api.InvalidOffsetPolicy_LATEST {
+		if resolved.Offset, err = r.HighestOffset(); err != nil {
+			return nil, err
+		}
+	}
+	return resolved, nil
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// maxPrefetchOffsets は 1 回の Prefetch で指定できるオフセットの最大数です。
+const maxPrefetchOffsets = 1024
+
+// prefetcher は、レコードを事前に OS のページキャッシュへ読み込める CommitLog が実装するインターフェースです。
+type prefetcher interface {
+	Prefetch(offsets []uint64) error
+}
+
+// Prefetch は、クライアントが近いうちに読み出す予定のオフセットのレコードを事前にページキャッシュへ読み込むよう
+// サーバーに依頼します。consume の権限が必要で、レコードの内容は返しません。
+// CommitLog が対応していない場合は Unimplemented のエラーを返します。
+func (s *grpcServer) Prefetch(ctx context.Context, req *api.PrefetchRequest) (
+	*api.PrefetchResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	if len(req.Offsets) > maxPrefetchOffsets {
+		return nil, api.ErrInvalidArgument{
+			Field:  "offsets",
+			Reason: "must not contain more than " + strconv.Itoa(maxPrefetchOffsets) + " offsets",
+		}
+	}
+	p, ok := s.CommitLog.(prefetcher)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log does not support prefetch")
+	}
+	if err := p.Prefetch(req.Offsets); err != nil {
+		return nil, err
+	}
+	return &api.PrefetchResponse{}, nil
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// errNotJSONObject は、射影するレコードの値が JSON のオブジェクトではない場合のエラーです。
+var errNotJSONObject = errors.New("value is not a JSON object")
+
+// validateJSONPaths は ConsumeRequest の JsonPaths を検証します。
+// パスはドットで区切ったオブジェクトのキーの並びで、空のキーを含むパスと、値の範囲の指定との併用は api.ErrInvalidArgument で拒否します。
+func validateJSONPaths(req *api.ConsumeRequest) error {
+	if len(req.JsonPaths) == 0 {
+		return nil
+	}
+	if req.ValueOffset != 0 || req.ValueLength != 0 {
+		return api.ErrInvalidArgument{
+			Field:  "json_paths",
+			Reason: "cannot be combined with value_offset or value_length",
+		}
+	}
+	for _, path := range req.JsonPaths {
+		for _, key := range strings.Split(path, ".") {
+			if key == "" {
+				return api.ErrInvalidArgument{
+					Field:  "json_paths",
+					Reason: fmt.Sprintf("path %q contains an empty key", path),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// projectRecord は req に JsonPaths が指定されている場合に、record の値をそれらのパスだけを含む JSON のオブジェクトに置き換えます。
+// 値が JSON のオブジェクトでない場合やパスが値に存在しない場合、StrictJsonPaths が指定されていれば FailedPrecondition のエラーを返し、
+// 指定されていなければ値をそのまま返します。
+func projectRecord(req *api.ConsumeRequest, record *api.Record) error {
+	if len(req.JsonPaths) == 0 {
+		return nil
+	}
+	value, err := projectJSON(record.Value, req.JsonPaths)
+	if err != nil {
+		if req.StrictJsonPaths {
+			return status.Errorf(codes.FailedPrecondition, "cannot project record %d: %v", record.Offset, err)
+		}
+		return nil
+	}
+	record.Value = value
+	return nil
+}
+
+// projectJSON は JSON のオブジェクト value から paths の値だけを取り出し、元と同じ入れ子の構造のオブジェクトとして返します。
+// あるパスが別のパスの途中までと一致する場合は、短いパスの値全体を含めます。
+func projectJSON(value []byte, paths []string) ([]byte, error) {
+	projected := make(map[string]any)
+	for _, path := range paths {
+		keys := strings.Split(path, ".")
+		raw, err := lookupJSON(value, keys)
+		if err != nil {
+			return nil, fmt.Errorf("path %q: %w", path, err)
+		}
+		insertJSON(projected, keys, raw)
+	}
+	return json.Marshal(projected)
+}
+
+// lookupJSON は JSON のオブジェクト value を keys の順にたどり、見つかった値を返します。
+func lookupJSON(value json.RawMessage, keys []string) (json.RawMessage, error) {
+	for i, key := range keys {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(value, &obj); err != nil || obj == nil {
+			if i == 0 {
+				return nil, errNotJSONObject
+			}
+			return nil, fmt.Errorf("%q is not a JSON object", strings.Join(keys[:i], "."))
+		}
+		var ok bool
+		if value, ok = obj[key]; !ok {
+			return nil, errors.New("not found")
+		}
+	}
+	return value, nil
+}
+
+// insertJSON は projected の keys の位置に raw を設定し、途中のオブジェクトがなければ作成します。
+func insertJSON(projected map[string]any, keys []string, raw json.RawMessage) {
+	last := len(keys) - 1
+	for _, key := range keys[:last] {
+		switch child := projected[key].(type) {
+		case map[string]any:
+			projected = child
+		case json.RawMessage:
+			// 短いパスで値全体を含めているため、その一部を追加する必要はない
+			return
+		default:
+			next := make(map[string]any)
+			projected[key] = next
+			projected = next
+		}
+	}
+	projected[keys[last]] = raw
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultWriteQuotaWindow は WriteQuotaWindow が未設定の場合に、書き込み量を集計する期間です。
+const defaultWriteQuotaWindow = time.Minute
+
+// writeQuota は主体ごとの書き込み量を一定期間ごとに集計し、上限を超える書き込みを拒否するための構造体です。
+// 集計は期間が過ぎるたびに全ての主体についてリセットされます。
+type writeQuota struct {
+	mu     sync.Mutex
+	limit  int64
+	window time.Duration
+	start  time.Time
+	used   map[string]int64
+}
+
+// newWriteQuota は期間 window あたり主体ごとに limit バイトまでの書き込みを許可する writeQuota を作成します。
+// window が 0 以下の場合はデフォルト値を使用します。
+func newWriteQuota(limit int64, window time.Duration) *writeQuota {
+	if window <= 0 {
+		window = defaultWriteQuotaWindow
+	}
+	return &writeQuota{
+		limit:  limit,
+		window: window,
+		start:  time.Now(),
+		used:   make(map[string]int64),
+	}
+}
+
+// allow は subject が n バイトを書き込めるかを判定し、書き込める場合はその分を集計に加えて true を返します。
+// 上限を超える場合は集計に加えずに false を返します。
+func (q *writeQuota) allow(subject string, n int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if now := time.Now(); now.Sub(q.start) >= q.window {
+		q.start = now
+		clear(q.used)
+	}
+	if q.used[subject]+n > q.limit {
+		return false
+	}
+	q.used[subject] += n
+	return true
+}
+
+// refund は allow で subject の集計に加えた n バイトを取り消します。
+// その間に期間が過ぎて集計がリセットされている場合でも、集計が負にならないようにします。
+func (q *writeQuota) refund(subject string, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used[subject] = max(q.used[subject]-n, 0)
+}
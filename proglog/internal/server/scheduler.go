@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"sync"
+)
+
+// defaultFairSchedulingQuota は FairSchedulingQuota が未設定の場合に使用する、1 回の順番で読み出すレコード数です。
+const defaultFairSchedulingQuota = 16
+
+// fairScheduler は複数の ConsumeStream 間で読み出しの順番をラウンドロビンで割り当てるスケジューラーです。
+// 順番を待つストリームは到着順に並び、順番を終えたストリームは列の末尾に並び直します。
+type fairScheduler struct {
+	mu      sync.Mutex
+	quota   int
+	busy    bool
+	waiters []chan struct{}
+}
+
+// newFairScheduler は 1 回の順番で読み出せるレコード数 quota を指定して fairScheduler を作成します。
+// quota が 0 以下の場合はデフォルト値を使用します。
+func newFairScheduler(quota int) *fairScheduler {
+	if quota <= 0 {
+		quota = defaultFairSchedulingQuota
+	}
+	return &fairScheduler{quota: quota}
+}
+
+// acquire は読み出しの順番が回ってくるまで待機します。
+// コンテキストが既に終了している場合や、順番を待っている間に終了した場合は、コンテキストのエラーを返します。
+func (f *fairScheduler) acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	if !f.busy {
+		f.busy = true
+		f.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	f.waiters = append(f.waiters, ch)
+	f.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		f.mu.Lock()
+		for i, w := range f.waiters {
+			if w == ch {
+				f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+				f.mu.Unlock()
+				return ctx.Err()
+			}
+		}
+		f.mu.Unlock()
+		// 既に順番が渡されていたので、次の待機者に譲る
+		f.release()
+		return ctx.Err()
+	}
+}
+
+// release は現在の順番を終了し、待機している次のストリームに順番を渡します。
+func (f *fairScheduler) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.waiters) == 0 {
+		f.busy = false
+		return
+	}
+	next := f.waiters[0]
+	f.waiters = f.waiters[1:]
+	close(next)
+}
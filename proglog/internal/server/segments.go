@@ -0,0 +1,44 @@
+package server
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+	"github.com/ishisaka/go_distribute/proglog/internal/log"
+)
+
+// ConsumeBySegment はログの全レコードを、それぞれが保存されているセグメントのベースオフセットとともにストリームで返す管理操作です。
+// admin の権限が必要です。バックアップや検証のツールが、セグメントの境界を把握しながらレコードを読み出すために使用します。
+// 読み出し中に削除されたセグメントのレコードは返しません。
+func (s *grpcServer) ConsumeBySegment(
+	_ *api.ConsumeBySegmentRequest,
+	stream api.Log_ConsumeBySegmentServer,
+) error {
+	ctx := stream.Context()
+	if err := s.authorize(ctx, adminAction); err != nil {
+		return err
+	}
+	l, ok := s.CommitLog.(*log.Log)
+	if !ok {
+		return status.Error(codes.Unimplemented, "commit log does not support segments")
+	}
+	for _, segment := range l.Segments() {
+		for off := segment.BaseOffset; off < segment.NextOffset; off++ {
+			record, err := l.Read(off)
+			if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err = stream.Send(&api.ConsumeBySegmentResponse{
+				Record:            record,
+				SegmentBaseOffset: segment.BaseOffset,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// sequenceTracker は主体ごとに、最後に書き込んだレコードのシーケンス番号を保持します。
+type sequenceTracker struct {
+	mu   sync.Mutex
+	last map[string]uint64
+}
+
+// newSequenceTracker は空の sequenceTracker を作成します。
+func newSequenceTracker() *sequenceTracker {
+	return &sequenceTracker{last: make(map[string]uint64)}
+}
+
+// appendInOrder は seq が key の主体が最後に書き込んだシーケンス番号の次である場合だけ appendFn を呼び出し、
+// 書き込みに成功したら seq を記録します。key の主体が初めて書き込む場合は seq をそのまま受け付けます。
+// 次でない場合は書き込みを行わず、期待したシーケンス番号を含む api.ErrOutOfSequence を返します。
+func (t *sequenceTracker) appendInOrder(key, header string, seq uint64, appendFn func() (uint64, error)) (
+	uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if last, ok := t.last[key]; ok && seq != last+1 {
+		return 0, api.ErrOutOfSequence{Header: header, Expected: last + 1, Got: seq}
+	}
+	offset, err := appendFn()
+	if err != nil {
+		return 0, err
+	}
+	t.last[key] = seq
+	return offset, nil
+}
+
+// sequenceOf はレコードの header ヘッダーからシーケンス番号を読み取ります。
+// ヘッダーがない場合や符号なし整数でない場合は InvalidArgument のエラーを返します。
+func sequenceOf(record *api.Record, header string) (uint64, error) {
+	field := "record.headers[" + header + "]"
+	v, ok := record.GetHeaders()[header]
+	if !ok {
+		return 0, api.ErrInvalidArgument{Field: field, Reason: "sequence header is required"}
+	}
+	seq, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, api.ErrInvalidArgument{Field: field, Reason: "must be an unsigned integer"}
+	}
+	return seq, nil
+}
@@ -2,9 +2,15 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
 	"time"
 
 	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+	"github.com/ishisaka/go_distribute/proglog/internal/log"
+	"github.com/ishisaka/go_distribute/proglog/internal/version"
 
 	grpcMiddleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpcAuth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
@@ -20,21 +26,112 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	// クライアントが gzip で圧縮したストリームを使えるように圧縮方式を登録する
+	_ "google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
 )
 
 // Config は gRPC サーバー構築時に必要な設定情報を保持する構造体です。
 // CommitLog と Authorizer を管理します。
+// Authorizer が nil の場合、AllowAnonymous が設定されていれば全ての操作を許可し、設定されていなければサーバーを作成しません。
+// Authorizers を設定すると、Authorizer に続けてそれらを順番に評価し、全てが許可した場合だけ操作を許可します。
+// IdempotencyCacheSize は重複排除のために保持する冪等キーの数で、0 の場合はデフォルト値を使用します。
+// FairScheduling を有効にすると、ConsumeStream 間の読み出しをラウンドロビンで公平に割り当てます。
+// FairSchedulingQuota は 1 回の順番で読み出すレコード数で、0 の場合はデフォルト値を使用します。
+// StreamHeartbeatInterval を設定すると、ConsumeStream がログの末尾で待機している間、その間隔でハートビートを送信します。
+// HighWatermarkFunc はクォーラムに複製済みの最大オフセット（ハイウォーターマーク）を返す関数で、
+// 複製済みのレコードがない場合は false を返します。CommittedOnly を指定した読み出しはハイウォーターマークまでに制限されます。
+// HighWatermarkFunc が nil の場合は、CommitLog が保持するハイウォーターマークを使用します。
+// MinSchemaVersion を設定すると、SchemaVersion がそれより小さいレコードの書き込みを FailedPrecondition で拒否します。
+// WriteQuotaBytes を設定すると、主体ごとに WriteQuotaWindow（0 の場合はデフォルト値）あたりに書き込めるレコードの値のバイト数を制限し、
+// 超過した書き込みを ResourceExhausted で拒否します。
+// LogLevel はロガーの構築時に設定したログレベルで、設定すると SetLogLevel で実行中に変更できます。
+// PeerDialOptions は Diff や GetClusterOffsets が他のサーバーに接続する際に使用するダイアルオプションです。
+// ClusterMembers はクラスターのメンバーのノード名と RPC アドレスを返す関数で、GetClusterOffsets の問い合わせ先になります。
+// TraceExporter を設定すると、RPC ごとのスパンをそのエクスポーターへ送信します。nil の場合はスパンを送信しません。
+// TracingEndpoint を設定すると、OpenCensus のスパンを OpenTelemetry に橋渡しし、RPC ごとのスパンを OTLP/HTTP でその URL
+// （例えば http://localhost:4318/v1/traces）のコレクターへ送信します。空の場合は送信しません。
+// 橋渡しはプロセス全体の OpenCensus のトレーサーを置き換えて元に戻さないため、TraceExporter と同時には設定できません。
+// TraceExporter は Shutdown が閉じられたら登録を解除し、TracingEndpoint は送信待ちのスパンを Shutdown が閉じられたときに送信してから止めます。
+// どちらかを設定する場合は Shutdown も設定し、TracingEndpoint の最後のスパンを失わないように、プロセスの終了前に Shutdown を閉じる必要があります。
+// AuditLog を設定すると、Truncate などの管理操作を実行した主体、時刻、パラメーターをそのログに記録します。
+// RecordProducerSubject を有効にすると、書き込むレコードの log.ProducerSubjectHeader ヘッダーに書き込んだ主体を記録します。
+// MaxInFlightProduces を設定すると、ProduceStream ごとに受信済みで応答していないリクエストの数をその値までに制限します。
+// 0 の場合は 1 件ずつ受信と書き込みを交互に行います。
+// RequiredMetadata を設定すると、そのキーのメタデータがないリクエストを InvalidArgument で拒否します。
+// WriteBufferSize、ReadBufferSize、InitialWindowSize はトランスポートの書き込み・読み込みバッファーと
+// ストリームの初期ウィンドウのバイト数で、0 の場合は gRPC のデフォルト値を使用します。
+// MaxStreamDuration を設定すると、ConsumeStream と ProduceStream を開始からその時間が経過した時点で
+// Unavailable のエラーで終了させ、クライアントに再接続させます。0 の場合は無制限です。
+// Shutdown はサーバーの停止処理を始めるときに閉じるチャネルで、閉じると実行中の ConsumeStream を
+// 停止処理による終了としてトレーラーに理由を設定して終了させます。
+// ThrottleQueueDepth を設定すると、ログへの書き込みを待っている Produce がその数を超えた場合に、
+// 超えた数に ThrottleBackoff（0 の場合はデフォルト値）を掛けた待機時間を ProduceResponse の ThrottleHint で提案します。
+// RequireMaintenance を有効にすると、Truncate などの破壊的な管理操作を SetMaintenance でメンテナンスモードにしている間だけ許可し、
+// それ以外では FailedPrecondition で拒否します。ACL に加えて誤操作によるデータの消失を防ぐためのものです。
+// StreamSendTimeout を設定すると、ConsumeStream の送信がクライアントの受信待ちでその時間内に終わらない場合に、
+// ストリームを DeadlineExceeded で終了させます。受信を止めたクライアントがサーバーのゴルーチンを保持し続けないようにします。
+// 送信を打ち切るために grpc.InTapHandle を使用します。
+// InTapHandle はストリームの開始時に呼び出す独自の tap.ServerInHandle で、StreamSendTimeout を設定した場合はその処理と合成して設定します。
+// gRPC のサーバーには InTapHandle を 1 つしか設定できないため、独自の InTapHandle は grpc.InTapHandle のオプションではなくこのフィールドで指定します。
+// オプションで指定した場合に StreamSendTimeout か InTapHandle を設定すると、サーバーを作成せずにエラーを返します。
+// ConsumerOffsetTTL を設定すると、その時間より長く Ack していないコンシューマーの位置をバックグラウンドで削除し、
+// 削除したことをログに出力します。削除は Shutdown が閉じられるまで ConsumerOffsetTTL ごとに行います。
+// 削除を止められなくなるため、Shutdown を設定せずに ConsumerOffsetTTL を設定した場合はサーバーを作成しません。
+// ReplicaNames はこのサーバーから複製するレプリカの名前を返す関数です。レプリカは複製したオフセットをその名前で AckReplica し、
+// 全てのレプリカが確認応答したオフセットの最小値をログのハイウォーターマークとして記録します。
+// nil またはレプリカがない場合は、最大オフセットをハイウォーターマークとして扱います。
+// TCPNoDelay は WrapListener で包んだリスナーが受け付けた接続に TCP_NODELAY を設定するかで、nil の場合は有効にします。
+// 1 件ずつの Produce や Consume が Nagle のアルゴリズムで遅延しないようにするためのものです。
+// SequenceHeader を設定すると、書き込むレコードのそのヘッダーをクライアントが付けたシーケンス番号として扱い、
+// 主体ごとに直前に書き込んだ番号の次でない書き込みを、期待した番号をエラーの詳細に含めて FailedPrecondition で拒否します。
 type Config struct {
-	CommitLog  CommitLog
-	Authorizer Authorizer
+	CommitLog               CommitLog
+	Authorizer              Authorizer
+	AllowAnonymous          bool
+	IdempotencyCacheSize    int
+	FairScheduling          bool
+	FairSchedulingQuota     int
+	StreamHeartbeatInterval time.Duration
+	AuditLog                CommitLog
+	HighWatermarkFunc       func() (uint64, bool)
+	MinSchemaVersion        uint32
+	TraceExporter           trace.Exporter
+	TracingEndpoint         string
+	WriteQuotaBytes         int64
+	WriteQuotaWindow        time.Duration
+	PeerDialOptions         []grpc.DialOption
+	LogLevel                *zap.AtomicLevel
+	WriteBufferSize         int
+	ReadBufferSize          int
+	InitialWindowSize       int32
+	RecordProducerSubject   bool
+	MaxInFlightProduces     int
+	RequiredMetadata        []string
+	ClusterMembers          func() map[string]string
+	Authorizers             []Authorizer
+	Shutdown                <-chan struct{}
+	MaxStreamDuration       time.Duration
+	ThrottleQueueDepth      int
+	ThrottleBackoff         time.Duration
+	RequireMaintenance      bool
+	StreamSendTimeout       time.Duration
+	ConsumerOffsetTTL       time.Duration
+	ReplicaNames            func() []string
+	TCPNoDelay              *bool
+	SequenceHeader          string
+	InTapHandle             tap.ServerInHandle
 }
 
 const (
 	objectWildcard = "*"
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	adminAction    = "admin"
+	// replicateAction はレプリカが複製したオフセットを AckReplica で確認応答するための権限です。
+	replicateAction = "replicate"
 )
 
 // Authorizer インターフェースは、特定の主題、対象、アクションに対するアクセスを許可または拒否する機能を提供します。
@@ -45,14 +142,37 @@ type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
 
+// allowAll は全ての操作を許可する Authorizer です。信頼できるネットワークで AllowAnonymous を設定した場合に使用します。
+type allowAll struct{}
+
+// Authorize は常に nil を返し、全ての操作を許可します。
+func (allowAll) Authorize(_, _, _ string) error {
+	return nil
+}
+
 var _ api.LogServer = (*grpcServer)(nil)
 
+// log.Log が CommitLog として使えること、つまりサーバーとログが同じ api.Record を扱うことをコンパイル時に確認する
+var _ CommitLog = (*log.Log)(nil)
+
 // grpcServer は gRPC サーバーの主要な構造体です。
 // api.UnimplementedLogServer を埋め込み、LogServer インターフェースに準拠します。
 // Config を利用してログ操作を管理します。
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+
+	authorizers []Authorizer
+	scheduler   *fairScheduler
+	idempotency *idempotencyCache
+	checkpoints *checkpoints
+	quota       *writeQuota
+	writeQueue  *writeQueue
+	sequences   *sequenceTracker
+	replicaAcks *replicaAcks
+	maintenance atomic.Bool
+	connections *connRegistry
+	logger      *zap.Logger
 }
 
 // CommitLog は、ログへのデータの追加と読み取りを管理するインターフェースです。
@@ -68,6 +188,12 @@ type CommitLog interface {
 	Read(uint64) (*api.Record, error)
 }
 
+// highestOffsetter は、ログの最大オフセットを返せる CommitLog が実装するインターフェースです。
+// CommitLog がこれを実装している場合、Consume の応答に最大オフセットを含め、フォロワーがレプリケーションの遅延を計算できるようにします。
+type highestOffsetter interface {
+	HighestOffset() (uint64, error)
+}
+
 // NewGRPCServer は、新しい gRPC サーバーを作成して返す関数です。
 // 指定された設定および任意の gRPC サーバーオプションを使用して初期化されます。
 // Config 構造体に基づいて grpcServer を生成し、LogServer として登録します。
@@ -75,6 +201,16 @@ type CommitLog interface {
 func NewGRPCServer(config *Config, grpcOpts ...grpc.ServerOption) (
 	*grpc.Server,
 	error,
+) {
+	return NewGRPCServerWith(config, nil, grpcOpts...)
+}
+
+// NewGRPCServerWith は NewGRPCServer と同様にサーバーを作成し、LogServer を登録した後に register を呼び出します。
+// register で登録したサービスは Log と同じポートで提供され、認証やログのインターセプターも共有します。
+// register が nil の場合は NewGRPCServer と同じです。
+func NewGRPCServerWith(config *Config, register func(*grpc.Server), grpcOpts ...grpc.ServerOption) (
+	*grpc.Server,
+	error,
 ) {
 	// Zapの設定
 	logger := zap.L().Named("server")
@@ -97,83 +233,323 @@ func NewGRPCServer(config *Config, grpcOpts ...grpc.ServerOption) (
 		return nil, err
 	}
 
-	grpcOpts = append(grpcOpts, grpc.StreamInterceptor(
-		grpcMiddleware.ChainStreamServer(
-			// インターセプターとしてZapログを組み込む
-			grpcCtxtags.StreamServerInterceptor(),
-			grpcZap.StreamServerInterceptor(logger, zapOpts...),
-			// インターセプターとしてauthenticateを組み込む
-			grpcAuth.StreamServerInterceptor(authenticate),
-		)), grpc.UnaryInterceptor(grpcMiddleware.ChainUnaryServer(
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		// インターセプターとしてZapログを組み込む
+		grpcCtxtags.StreamServerInterceptor(),
+		grpcZap.StreamServerInterceptor(logger, zapOpts...),
+		// インターセプターとしてauthenticateを組み込む
+		grpcAuth.StreamServerInterceptor(authenticate),
+	}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
 		grpcCtxtags.UnaryServerInterceptor(),
 		grpcZap.UnaryServerInterceptor(logger, zapOpts...),
 		grpcAuth.UnaryServerInterceptor(authenticate),
-	)),
+	}
+	if len(config.RequiredMetadata) > 0 {
+		// 必須のメタデータがないリクエストはハンドラーに渡す前に拒否する
+		streamInterceptors = append(streamInterceptors,
+			grpcAuth.StreamServerInterceptor(requireMetadata(config.RequiredMetadata)))
+		unaryInterceptors = append(unaryInterceptors,
+			grpcAuth.UnaryServerInterceptor(requireMetadata(config.RequiredMetadata)))
+	}
+	srv, err := newgrpcServer(config)
+	if err != nil {
+		return nil, err
+	}
+	if err = registerTraceExporters(config); err != nil {
+		return nil, err
+	}
+	grpcOpts = append(grpcOpts,
+		grpc.StreamInterceptor(grpcMiddleware.ChainStreamServer(streamInterceptors...)),
+		grpc.UnaryInterceptor(grpcMiddleware.ChainUnaryServer(unaryInterceptors...)),
 		grpc.StatsHandler(&ocgrpc.ServerHandler{}),
+		// ListConnections のために接続とストリームを記録する
+		grpc.StatsHandler(srv.connections),
 	)
-	gsrv := grpc.NewServer(grpcOpts...)
-	srv, err := newgrpcServer(config)
+	grpcOpts = append(grpcOpts, transportOptions(config)...)
+	tapHandle := config.InTapHandle
+	if config.StreamSendTimeout > 0 {
+		// 送信が止まったストリームを打ち切れるように、ストリームのコンテキストをキャンセル可能にする
+		tapHandle = cancelableStream(tapHandle)
+	}
+	if tapHandle != nil {
+		grpcOpts = append(grpcOpts, grpc.InTapHandle(tapHandle))
+	}
+	gsrv, err := newServer(grpcOpts)
 	if err != nil {
 		return nil, err
 	}
+	if err = registerMemoryGauge(config.CommitLog); err != nil {
+		return nil, err
+	}
 	api.RegisterLogServer(gsrv, srv)
+	if register != nil {
+		register(gsrv)
+	}
 	return gsrv, nil
 }
 
+// newServer は grpcOpts で gRPC のサーバーを作成します。
+// InTapHandle のように 1 つしか設定できないオプションが重複している場合、grpc.NewServer は panic するため、エラーに変換して返します。
+func newServer(grpcOpts []grpc.ServerOption) (gsrv *grpc.Server, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid server options: %v", r)
+		}
+	}()
+	return grpc.NewServer(grpcOpts...), nil
+}
+
+// transportOptions は Config で設定されたバッファーとウィンドウのサイズを gRPC のサーバーオプションに変換します。
+// 設定されていない値はオプションに含めず、gRPC のデフォルト値のままにします。
+func transportOptions(config *Config) []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if config.WriteBufferSize > 0 {
+		opts = append(opts, grpc.WriteBufferSize(config.WriteBufferSize))
+	}
+	if config.ReadBufferSize > 0 {
+		opts = append(opts, grpc.ReadBufferSize(config.ReadBufferSize))
+	}
+	if config.InitialWindowSize > 0 {
+		opts = append(opts, grpc.InitialWindowSize(config.InitialWindowSize))
+	}
+	return opts
+}
+
 // newgrpcServer は、新しい gRPC サーバーを作成し、初期化します。
 // Config 構造体を受け取り、その設定を使用して grpcServer を生成します。
+// Authorizer と Authorizers のどちらも設定されておらず、AllowAnonymous も設定されていない場合はエラーを返します。
+// ConsumerOffsetTTL を設定して Shutdown を設定していない場合もエラーを返します。
 // nolint:all
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
+	if config.ConsumerOffsetTTL > 0 && config.Shutdown == nil {
+		// 削除のゴルーチンを止める手段がなく、サーバーを停止してもリークするため拒否する
+		return nil, errors.New("shutdown is required when ConsumerOffsetTTL is set")
+	}
+	var authorizers []Authorizer
+	if config.Authorizer != nil {
+		authorizers = append(authorizers, config.Authorizer)
+	}
+	if config.Authorizer == nil && len(config.Authorizers) == 0 {
+		if !config.AllowAnonymous {
+			return nil, errors.New("authorizer is required unless AllowAnonymous is set")
+		}
+		// 呼び出し側の Config は書き換えず、このサーバーだけで全ての操作を許可する
+		authorizers = append(authorizers, allowAll{})
+	}
 	srv = &grpcServer{
-		Config: config,
+		Config:      config,
+		authorizers: append(authorizers, config.Authorizers...),
+		idempotency: newIdempotencyCache(config.IdempotencyCacheSize),
+		checkpoints: newCheckpoints(),
+		replicaAcks: newReplicaAcks(),
+		connections: newConnRegistry(),
+		logger:      zap.L().Named("server"),
+	}
+	if config.FairScheduling {
+		srv.scheduler = newFairScheduler(config.FairSchedulingQuota)
+	}
+	if config.WriteQuotaBytes > 0 {
+		srv.quota = newWriteQuota(config.WriteQuotaBytes, config.WriteQuotaWindow)
+	}
+	if config.ThrottleQueueDepth > 0 {
+		srv.writeQueue = newWriteQueue(config.ThrottleQueueDepth, config.ThrottleBackoff)
+	}
+	if config.ConsumerOffsetTTL > 0 {
+		go srv.evictIdleConsumersLoop()
+	}
+	if config.SequenceHeader != "" {
+		srv.sequences = newSequenceTracker()
 	}
 	return srv, nil
 }
 
 // Produce メソッドは、指定されたリクエストに基づき新しいレコードをログに追加し、結果のオフセットをレスポンスとして返します。
+// レコードのスキーマバージョンが MinSchemaVersion より古い場合は FailedPrecondition のエラーを返します。
+// 主体の書き込み量が WriteQuotaBytes を超える場合は ResourceExhausted のエラーを返します。
+// 書き込み量に数えるのは新たに書き込んだレコードだけで、冪等キーによる重複やエラーになった書き込みの分は取り消します。
+// 冪等キーが指定され、同じ主体から同じキーで書き込み済みの場合は、新たに書き込まずに記録済みのオフセットと Duplicate を返します。
+// 書き込みを待っている Produce が ThrottleQueueDepth を超えている場合は、応答の ThrottleHint に待機時間を設定します。
+// SequenceHeader のシーケンス番号が主体の直前の書き込みの次でない場合は FailedPrecondition のエラーを返します。
 // コンテキストを受け取り、エラーが発生した場合は nil とエラーを返します。
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
 	*api.ProduceResponse, error) {
 	// 認可できるのかの確認
-	if err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		produceAction,
-	); err != nil {
+	if err := s.authorize(ctx, produceAction); err != nil {
 		return nil, err
 	}
-	offset, err := s.CommitLog.Append(req.Record)
+	if req.Record.GetSchemaVersion() < s.MinSchemaVersion {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"schema version %d is older than the minimum %d",
+			req.Record.GetSchemaVersion(),
+			s.MinSchemaVersion,
+		)
+	}
+	appended := false
+	if s.quota != nil {
+		key, n := subject(ctx), int64(len(req.Record.GetValue()))
+		if !s.quota.allow(key, n) {
+			return nil, status.Error(codes.ResourceExhausted, "write quota exceeded")
+		}
+		// 上限を超えないように書き込む前に集計に加え、新たに書き込まなかった場合は取り消す
+		defer func() {
+			if !appended {
+				s.quota.refund(key, n)
+			}
+		}()
+	}
+	if s.RecordProducerSubject && req.Record != nil {
+		// クライアントが指定した値は信用せず、認証された主体で上書きする
+		if req.Record.Headers == nil {
+			req.Record.Headers = make(map[string]string)
+		}
+		req.Record.Headers[log.ProducerSubjectHeader] = subject(ctx)
+	}
+	appendRecord := func() (uint64, error) {
+		return s.CommitLog.Append(req.Record)
+	}
+	if s.sequences != nil {
+		seq, err := sequenceOf(req.Record, s.SequenceHeader)
+		if err != nil {
+			return nil, err
+		}
+		// 冪等キーによる再送は記録済みのオフセットを返すため、シーケンス番号は書き込む場合だけ確認する
+		key, appendFn := subject(ctx), appendRecord
+		appendRecord = func() (uint64, error) {
+			return s.sequences.appendInOrder(key, s.SequenceHeader, seq, appendFn)
+		}
+	}
+	var hint *api.ThrottleHint
+	if s.writeQueue != nil {
+		hint = s.writeQueue.enter()
+		defer s.writeQueue.leave()
+	}
+	if req.IdempotencyKey != "" {
+		// 冪等キーは主体ごとに区別する
+		key := subject(ctx) + "/" + req.IdempotencyKey
+		offset, duplicate, err := s.idempotency.appendOnce(key, appendRecord)
+		if err != nil {
+			return nil, err
+		}
+		appended = !duplicate
+		return &api.ProduceResponse{Offset: offset, Duplicate: duplicate, ThrottleHint: hint}, nil
+	}
+	offset, err := appendRecord()
 	if err != nil {
 		return nil, err
 	}
-	return &api.ProduceResponse{Offset: offset}, nil
+	appended = true
+	s.logger.Debug("produced record", zap.Uint64("offset", offset))
+	return &api.ProduceResponse{Offset: offset, ThrottleHint: hint}, nil
 }
 
 // Consume メソッドは指定されたオフセットからログレコードを読み取り、レスポンスとして返します。
+// CommitLog が最大オフセットを返せる場合は、応答の HighestOffset に設定します。
+// リクエストのフィールドが不正な場合は、範囲外のオフセットとは区別して InvalidArgument のエラーを返します。
+// CommittedOnly を指定した場合、ハイウォーターマークより後のオフセットは範囲外として扱います。
+// ValueOffset か ValueLength を指定した場合は、レコードの値のその範囲だけを返します。
+// ConsumerName を指定した場合は、Offset の代わりにそのコンシューマーが Ack した位置の次のレコードを返します。
+// オフセットが切り詰めによって削除されている場合、OnInvalidOffset が EARLIEST なら最小の、LATEST なら最大のオフセットのレコードを返します。
+// JsonPaths を指定した場合は、JSON のオブジェクトであるレコードの値をそれらのパスだけを含むオブジェクトに絞り込んで返します。
 // エラーが発生した場合は nil とエラーを返します。
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	*api.ConsumeResponse, error) {
 	// 認可できるかの確認
-	if err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		consumeAction,
-	); err != nil {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	req = s.resolveConsumer(req)
+	if err := validateConsumeRequest(req); err != nil {
+		return nil, err
+	}
+	req, err := s.resetInvalidOffset(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.CommittedOnly {
+		hwm, ok, err := s.committedOffset()
+		if err != nil {
+			return nil, err
+		}
+		// 複製が完了していないレコードは、まだ存在しないものとして扱う
+		if !ok || req.Offset > hwm {
+			return nil, api.ErrOffsetOutOfRange{Offset: req.Offset}
+		}
+	}
+	record, err := s.read(req)
+	if err != nil {
+		return nil, err
+	}
+	if err = projectRecord(req, record); err != nil {
 		return nil, err
 	}
-	record, err := s.CommitLog.Read(req.Offset)
+	res := &api.ConsumeResponse{Record: record}
+	if h, ok := s.CommitLog.(highestOffsetter); ok {
+		if res.HighestOffset, err = h.HighestOffset(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// valueRangeReader は、レコードの値の一部だけを読み出せる CommitLog が実装するインターフェースです。
+type valueRangeReader interface {
+	ReadValueRange(off, start, length uint64) ([]byte, error)
+}
+
+// read は req のオフセットのレコードを読み出します。
+// ValueOffset か ValueLength が指定されている場合は、値のその範囲だけをストアから読み出し、
+// オフセットと値の範囲だけを設定したレコードを返します。CommitLog が対応していない場合は Unimplemented のエラーを返します。
+func (s *grpcServer) read(req *api.ConsumeRequest) (*api.Record, error) {
+	if req.ValueOffset == 0 && req.ValueLength == 0 {
+		return s.CommitLog.Read(req.Offset)
+	}
+	r, ok := s.CommitLog.(valueRangeReader)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log does not support value ranges")
+	}
+	value, err := r.ReadValueRange(req.Offset, req.ValueOffset, req.ValueLength)
 	if err != nil {
 		return nil, err
 	}
-	return &api.ConsumeResponse{Record: record}, nil
+	return &api.Record{Offset: req.Offset, Value: value}, nil
+}
+
+// validateConsumeRequest は ConsumeRequest のフィールドを検証し、不正なフィールドがあれば api.ErrInvalidArgument を返します。
+func validateConsumeRequest(req *api.ConsumeRequest) error {
+	if math.IsNaN(req.SampleRate) || req.SampleRate < 0 || req.SampleRate > 1 {
+		return api.ErrInvalidArgument{
+			Field:  "sample_rate",
+			Reason: "must be between 0 and 1",
+		}
+	}
+	if _, ok := api.InvalidOffsetPolicy_name[int32(req.OnInvalidOffset)]; !ok {
+		return api.ErrInvalidArgument{
+			Field:  "on_invalid_offset",
+			Reason: "unknown policy",
+		}
+	}
+	if req.EndOffset != 0 && req.EndOffset < req.Offset {
+		return api.ErrInvalidArgument{
+			Field:  "end_offset",
+			Reason: "must not be less than offset",
+		}
+	}
+	return validateJSONPaths(req)
 }
 
 // ProduceStream は双方向ストリーミングを実現する RPC メソッドです。リクエストを受信しレスポンスを送信します。
 // ストリーム内でエラーが発生した場合、その時点で処理を終了しエラーを返却します。
 // 各リクエストは Produce メソッドを呼び出すことで処理されます。
+// MaxInFlightProduces を設定すると、受信と書き込みを並行して行い、応答していないリクエストがその数に達した時点で受信を止めます。
+// MaxStreamDuration を設定すると、その時間が経過した時点で終了の理由をトレーラーに設定してストリームを終了します。
 func (s *grpcServer) ProduceStream(
 	stream api.Log_ProduceStreamServer,
 ) error {
+	if s.MaxInFlightProduces > 0 || s.MaxStreamDuration > 0 {
+		return s.produceStreamBounded(stream)
+	}
 	for {
 		req, err := stream.Recv()
 		if err != nil {
@@ -189,38 +565,392 @@ func (s *grpcServer) ProduceStream(
 	}
 }
 
+// produceStreamBounded は MaxInFlightProduces が設定されている場合の ProduceStream の処理です。
+// 受信したリクエストは別のゴルーチンで順番に書き込み、応答を返すまでを 1 件の処理中として数えます。
+// 処理中のリクエストが上限に達すると受信を止めるため、書き込みが遅い場合でもサーバーがリクエストを溜め込まず、
+// HTTP/2 のフロー制御によってクライアントの送信が抑えられます。
+// 受信を別のゴルーチンで行うため、MaxStreamDuration が設定されている場合も受信待ちの間にストリームを終了できます。
+// MaxInFlightProduces が設定されていない場合は、1 件ずつ処理します。
+func (s *grpcServer) produceStreamBounded(stream api.Log_ProduceStreamServer) error {
+	limit := max(s.MaxInFlightProduces, 1)
+	slots := make(chan struct{}, limit)
+	reqs := make(chan *api.ProduceRequest, limit)
+	recvErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(reqs)
+		for {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			// 空きがある場合だけ受信しているため、ここでブロックすることはない
+			reqs <- req
+		}
+	}()
+	expired, stop := s.streamTimer()
+	defer stop()
+	for {
+		var req *api.ProduceRequest
+		select {
+		case <-expired:
+			return endStream(stream, api.StreamEndMaxDuration, errMaxStreamDuration)
+		case r, ok := <-reqs:
+			if !ok {
+				return <-recvErr
+			}
+			req = r
+		}
+		res, err := s.Produce(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+		<-slots
+	}
+}
+
 // ConsumeStream はサーバーストリーミング RPC を処理し、指定されたオフセットのログレコードを継続的に送信します。
 // クライアントがストリームを終了させると、処理を終了して nil を返します。
 // 無効なオフセットの場合、適切なエラーハンドリングを行い、処理を続行します。
+// SampleRate が 0 より大きく 1 未満の場合は、その割合のレコードだけをオフセットから決定的に選んで送信します。
+// SampleRate が 0 から 1 の範囲外の場合は InvalidArgument のエラーを返します。
+// IncludeEvents が指定されている場合は、ログの切り詰めやコンパクションのイベントもレコードの間に送信します。
+// ConsumerName が指定されている場合は、そのコンシューマーが Ack した位置の次から送信します。
+// 読み出し位置が切り詰めによって削除された場合、OnInvalidOffset が ERROR でなければストリームを終了せず、
+// その方針に従って最小か最大のオフセットから送信を続けます。
+// EndOffset が指定されている場合は、その直前のオフセットまで送信したところでストリームを終了します。
+// EndOffset が Offset より小さい場合は、終了の理由を設定せずに InvalidArgument のエラーを返します。
+// クライアントが gzip の圧縮を指定した場合もレコードはメッセージごとに圧縮して送信するため、
+// 圧縮のバッファーに溜まって配信が遅れることはありません。
+// ストリームを終了する場合は、終了した理由をトレーラーの api.StreamEndReasonKey に設定します。
+// 理由は EndOffset への到達、切り詰めによる読み出し位置の削除、権限の喪失、サーバーの停止、
+// MaxStreamDuration への到達、StreamSendTimeout 以内に送信できなかったことのいずれかです。
 func (s *grpcServer) ConsumeStream(
 	req *api.ConsumeRequest,
 	stream api.Log_ConsumeStreamServer,
 ) error {
+	req = s.resolveConsumer(req)
+	if err := validateConsumeRequest(req); err != nil {
+		return err
+	}
+	stream = s.withSendTimeout(stream)
+	events, unsubscribe, err := s.subscribeEvents(req)
+	if err != nil {
+		return err
+	}
+	defer unsubscribe()
+	expired, stop := s.streamTimer()
+	defer stop()
+	if s.scheduler != nil {
+		return s.consumeStreamFair(req, stream, events, expired)
+	}
+	lastSent := time.Now()
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
+		case <-s.Shutdown:
+			return endStream(stream, api.StreamEndShuttingDown, errShuttingDown)
+		case <-expired:
+			return endStream(stream, api.StreamEndMaxDuration, errMaxStreamDuration)
 		default:
+			if err := sendEvents(stream, events); err != nil {
+				return err
+			}
+			if endReached(req) {
+				return endStream(stream, api.StreamEndReached, nil)
+			}
+			// Consume の中で読み出し位置が置き換えられると req.Offset とずれるため、先にここで置き換える
+			if req, err = s.resetInvalidOffset(req); err != nil {
+				return err
+			}
 			res, err := s.Consume(stream.Context(), req)
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				if s.truncatedAway(req.Offset) {
+					return endStream(stream, api.StreamEndTruncated, err)
+				}
+				if lastSent, err = s.heartbeat(stream, lastSent); err != nil {
+					return err
+				}
 				continue
 			default:
+				return endOnError(stream, err)
+			}
+			if sampled(req.Offset, req.SampleRate) {
+				if err = stream.Send(res); err != nil {
+					return err
+				}
+				lastSent = time.Now()
+			}
+			req.Offset++
+		}
+	}
+}
+
+// sampled はオフセット offset のレコードを、サンプリング率 rate で配信対象とするかを判定します。
+// 判定はオフセットのハッシュ値に基づくため、同じオフセットと rate に対して常に同じ結果になります。
+// rate が 0 以下（未指定）または 1 以上の場合は常に true を返します。
+func sampled(offset uint64, rate float64) bool {
+	if rate <= 0 || rate >= 1 {
+		return true
+	}
+	// splitmix64 でオフセットを一様に分散させる
+	x := offset + 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x)/math.MaxUint64 < rate
+}
+
+// heartbeat は lastSent から StreamHeartbeatInterval 以上経過している場合にハートビートを送信し、
+// 最後に送信した時刻を返します。StreamHeartbeatInterval が 0 の場合は何もしません。
+func (s *grpcServer) heartbeat(
+	stream api.Log_ConsumeStreamServer,
+	lastSent time.Time,
+) (time.Time, error) {
+	if s.StreamHeartbeatInterval <= 0 ||
+		time.Since(lastSent) < s.StreamHeartbeatInterval {
+		return lastSent, nil
+	}
+	if err := stream.Send(&api.ConsumeResponse{Heartbeat: true}); err != nil {
+		return lastSent, err
+	}
+	return time.Now(), nil
+}
+
+// consumeStreamFair は FairScheduling が有効な場合の ConsumeStream の処理です。
+// スケジューラーから順番を得たときだけ最大 quota 件のレコードを読み出し、順番を返してから送信します。
+func (s *grpcServer) consumeStreamFair(
+	req *api.ConsumeRequest,
+	stream api.Log_ConsumeStreamServer,
+	events <-chan log.Event,
+	expired <-chan time.Time,
+) error {
+	ctx := stream.Context()
+	lastSent := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.Shutdown:
+			return endStream(stream, api.StreamEndShuttingDown, errShuttingDown)
+		case <-expired:
+			return endStream(stream, api.StreamEndMaxDuration, errMaxStreamDuration)
+		default:
+		}
+		if err := sendEvents(stream, events); err != nil {
+			return err
+		}
+		if endReached(req) {
+			return endStream(stream, api.StreamEndReached, nil)
+		}
+		if err := s.scheduler.acquire(ctx); err != nil {
+			return nil
+		}
+		batch, err := s.consumeQuota(ctx, req)
+		s.scheduler.release()
+		if err != nil {
+			return endOnError(stream, err)
+		}
+		if len(batch) == 0 {
+			if s.truncatedAway(req.Offset) {
+				return endStream(stream, api.StreamEndTruncated,
+					api.ErrOffsetOutOfRange{Offset: req.Offset})
+			}
+			if lastSent, err = s.heartbeat(stream, lastSent); err != nil {
 				return err
 			}
+			continue
+		}
+		for _, res := range batch {
 			if err = stream.Send(res); err != nil {
 				return err
 			}
-			req.Offset++
 		}
+		lastSent = time.Now()
+	}
+}
+
+// consumeQuota は req.Offset から最大 quota 件のレコードを読み出し、読み出した分だけ req.Offset を進めます。
+// サンプリングで除外されたレコードも読み出し件数に含めます。
+// ログの末尾か EndOffset に達した場合は、それまでに読み出したレコードを返します。
+func (s *grpcServer) consumeQuota(ctx context.Context, req *api.ConsumeRequest) (
+	[]*api.ConsumeResponse, error) {
+	var batch []*api.ConsumeResponse
+	for n := 0; n < s.scheduler.quota && !endReached(req); n++ {
+		resolved, err := s.resetInvalidOffset(req)
+		if err != nil {
+			return nil, err
+		}
+		// 呼び出し元の req.Offset も進める必要があるため、置き換えたオフセットを書き戻す
+		req.Offset = resolved.Offset
+		res, err := s.Consume(ctx, req)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			return batch, nil
+		default:
+			return nil, err
+		}
+		if sampled(req.Offset, req.SampleRate) {
+			batch = append(batch, res)
+		}
+		req.Offset++
+	}
+	return batch, nil
+}
+
+const (
+	// defaultConsumeBatchSize は MaxRecords が未指定の場合に ConsumeBatch が返す最大レコード数です。
+	defaultConsumeBatchSize = 100
+	// consumeBatchPollInterval は ConsumeBatch がログの末尾で新しいレコードを待つ間、ログを確認する間隔です。
+	consumeBatchPollInterval = 10 * time.Millisecond
+	// consumeBatchDeadlineMargin は応答がクライアントに届くまでの時間として、コンテキストの期限より前に待機を打ち切る時間です。
+	consumeBatchDeadlineMargin = 50 * time.Millisecond
+)
+
+// ConsumeBatch は req.Offset から最大 MaxRecords 件のレコードをまとめて読み出して返します。
+// ログの末尾に達した場合は、MaxRecords 件が揃うかコンテキストの期限が近づくまで新しいレコードを待ちます。
+// 期限までに揃わなかった場合はエラーにせず、それまでに読み出したレコードと DeadlineExceeded を返します。
+// コンテキストに期限がない場合は待機せず、その時点で読み出せたレコードを返します。
+// Order に DESCENDING を指定した場合は、req.Offset から古い方へ向かって新しい順にレコードを返し、末尾での待機は行いません。
+func (s *grpcServer) ConsumeBatch(ctx context.Context, req *api.ConsumeBatchRequest) (
+	*api.ConsumeBatchResponse, error) {
+	// 認可できるかの確認
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	limit := req.MaxRecords
+	if limit == 0 {
+		limit = defaultConsumeBatchSize
+	}
+	if req.Order == api.Order_DESCENDING {
+		return s.consumeBatchDescending(req.Offset, limit)
+	}
+	deadline, ok := ctx.Deadline()
+	res := &api.ConsumeBatchResponse{}
+	for off := req.Offset; uint32(len(res.Records)) < limit; {
+		record, err := s.CommitLog.Read(off)
+		switch err.(type) {
+		case nil:
+			res.Records = append(res.Records, record)
+			off++
+			continue
+		case api.ErrOffsetOutOfRange:
+		default:
+			return nil, err
+		}
+		if !ok {
+			return res, nil
+		}
+		wait := time.Until(deadline.Add(-consumeBatchDeadlineMargin))
+		if wait <= 0 {
+			res.DeadlineExceeded = true
+			return res, nil
+		}
+		select {
+		case <-ctx.Done():
+			res.DeadlineExceeded = true
+			return res, nil
+		case <-time.After(min(wait, consumeBatchPollInterval)):
+		}
+	}
+	return res, nil
+}
+
+// consumeBatchDescending は offset から古い方へ向かって最大 limit 件のレコードを、新しい順に読み出して返します。
+// offset が最大オフセットより大きい場合は最大オフセットから読み出します。
+// オフセット 0 に達するか、削除済みなどで読み出せないオフセットに達した時点で終了します。
+func (s *grpcServer) consumeBatchDescending(offset uint64, limit uint32) (
+	*api.ConsumeBatchResponse, error) {
+	if h, ok := s.CommitLog.(highestOffsetter); ok {
+		highest, err := h.HighestOffset()
+		if err != nil {
+			return nil, err
+		}
+		offset = min(offset, highest)
 	}
+	res := &api.ConsumeBatchResponse{}
+	for off := offset; uint32(len(res.Records)) < limit; off-- {
+		record, err := s.CommitLog.Read(off)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			return res, nil
+		default:
+			return nil, err
+		}
+		res.Records = append(res.Records, record)
+		if off == 0 {
+			break
+		}
+	}
+	return res, nil
+}
+
+// GetServerInfo はサーバーのバージョン、ビルド元のコミット、および有効になっている機能の一覧を返します。
+// ローリングアップグレード中に、異なるバージョンのノードが混在していないかを確認するために使用します。
+func (s *grpcServer) GetServerInfo(_ context.Context, _ *api.GetServerInfoRequest) (
+	*api.GetServerInfoResponse, error) {
+	return &api.GetServerInfoResponse{
+		Version:  version.Version,
+		Commit:   version.Commit,
+		Features: s.features(),
+	}, nil
+}
+
+// features はこのサーバーで有効になっている機能の名前の一覧を返します。
+// gzip による圧縮、冪等キーによる重複排除、Fetch は常に有効で、それ以外は Config の設定と CommitLog が対応しているかから判定します。
+func (s *grpcServer) features() []string {
+	_, tracksHighWatermark := s.CommitLog.(highWatermarker)
+	var features []string
+	for _, f := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"compression", true},
+		{"idempotency", true},
+		{"fetch", true},
+		{"allow_anonymous", s.AllowAnonymous},
+		{"fair_scheduling", s.FairScheduling},
+		{"stream_heartbeat", s.StreamHeartbeatInterval > 0},
+		{"committed_only", s.HighWatermarkFunc != nil || tracksHighWatermark},
+		{"min_schema_version", s.MinSchemaVersion > 0},
+		{"write_quota", s.WriteQuotaBytes > 0},
+		{"tracing", s.TraceExporter != nil || s.TracingEndpoint != ""},
+		{"audit_log", s.AuditLog != nil},
+		{"record_producer_subject", s.RecordProducerSubject},
+		{"throttle", s.ThrottleQueueDepth > 0},
+		{"require_maintenance", s.RequireMaintenance},
+		{"max_stream_duration", s.MaxStreamDuration > 0},
+		{"stream_send_timeout", s.StreamSendTimeout > 0},
+		{"consumer_offset_ttl", s.ConsumerOffsetTTL > 0},
+		{"sequence", s.SequenceHeader != ""},
+	} {
+		if f.enabled {
+			features = append(features, f.name)
+		}
+	}
+	return features
 }
 
 // authenticate は gRPC の認証用インターセプタ関数です。
 // コンテキストからクライアント情報を取得し、認証情報に基づいて主題を設定します。
 // 必要な認証情報が不足している場合でも、エラーではなく適切な値を設定して処理を継続します。
 // 主題情報はコンテキストに保存され、後続の処理で利用されます。
+// 接続元のアドレスは、AttributeAuthorizer が参照するリクエストの属性としてコンテキストに保存します。
 // エラーが発生した場合は context.Context と共にエラーを返却します。
 func authenticate(ctx context.Context) (context.Context, error) {
 	p, ok := peer.FromContext(ctx)
@@ -231,6 +961,12 @@ func authenticate(ctx context.Context) (context.Context, error) {
 		).Err()
 	}
 
+	if p.Addr != nil {
+		ctx = context.WithValue(ctx, attributesContextKey{}, Attributes{
+			AttributePeerAddress: p.Addr.String(),
+		})
+	}
+
 	if p.AuthInfo == nil {
 		return context.WithValue(ctx, subjectContextKey{}, ""), nil
 	}
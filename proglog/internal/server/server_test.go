@@ -1,23 +1,44 @@
 package server
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"math"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"context"
 	"github.com/ishisaka/go_distribute/proglog/internal/auth"
 	"go.opencensus.io/examples/exporter"
+	"go.opencensus.io/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
+	"google.golang.org/protobuf/proto"
 
 	api "github.com/ishisaka/go_distribute/proglog/api/v1"
 	"github.com/ishisaka/go_distribute/proglog/internal/config"
 	"github.com/ishisaka/go_distribute/proglog/internal/log"
+	"github.com/ishisaka/go_distribute/proglog/internal/version"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 )
@@ -51,6 +72,9 @@ func TestServer(t *testing.T) {
 		"produce/consume stream succeeds":                     testProduceConsumeStream,
 		"consume past log boundary fails":                     testConsumePastBoundary,
 		"unauthorized fails":                                  testUnauthorized,
+		"produce with the same idempotency key is duplicate":  testProduceDuplicate,
+		"consume batch returns partial on deadline":           testConsumeBatchDeadline,
+		"consume batch in descending order":                   testConsumeBatchDescending,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient,
@@ -69,7 +93,7 @@ func TestServer(t *testing.T) {
 // rootClient と nobodyClient はそれぞれのクライアントを返します。
 // cfg はサーバー構成を返します。
 // teardown はサーバーやリソースを解放する関数を返します。
-func setupTest(t *testing.T, fn func(*Config)) (
+func setupTest(t testing.TB, fn func(*Config)) (
 	rootClient api.LogClient,
 	nobodyClient api.LogClient,
 	cfg *Config,
@@ -324,3 +348,1990 @@ func testUnauthorized(
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
 }
+
+// TestFairScheduling は FairScheduling を有効にした状態で、高速なストリームと低速なストリームを同時に実行し、
+// 低速なストリームも一定のペースで読み進められることを検証します。
+func TestFairScheduling(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.FairScheduling = true
+		c.FairSchedulingQuota = 4
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const total = 100
+	for i := 0; i < total; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	consume := func(delay time.Duration, received *atomic.Int64) {
+		stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+		if err != nil {
+			return
+		}
+		for want := uint64(0); want < total; want++ {
+			res, err := stream.Recv()
+			if err != nil || res.Record.Offset != want {
+				return
+			}
+			received.Add(1)
+			time.Sleep(delay)
+		}
+	}
+
+	var fast atomic.Int64
+	slow := make([]*atomic.Int64, 3)
+	go consume(0, &fast)
+	for i := range slow {
+		slow[i] = &atomic.Int64{}
+		go consume(10*time.Millisecond, slow[i])
+	}
+
+	require.Eventually(t, func() bool {
+		if fast.Load() != total {
+			return false
+		}
+		for _, s := range slow {
+			if s.Load() < 20 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+// TestFairSchedulingCanceledAtTail は、FairScheduling を有効にした ConsumeStream がログの末尾で待機している間に
+// クライアントが切断した場合、次のレコードを待たずにハンドラーが終了することを検証します。
+func TestFairSchedulingCanceledAtTail(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer func() { _ = clog.Close() }()
+	srv, err := newgrpcServer(&Config{
+		CommitLog:      clog,
+		AllowAnonymous: true,
+		FairScheduling: true,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// 終了したコンテキストでは順番を待たずにエラーを返す
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	require.ErrorIs(t, srv.scheduler.acquire(canceled), context.Canceled)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.ConsumeStream(&api.ConsumeRequest{}, &contextStream{ctx: ctx})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("ConsumeStream did not return after the client disconnected")
+	}
+}
+
+// contextStream は ctx をストリームのコンテキストとして返し、送信したメッセージを破棄する api.Log_ConsumeStreamServer です。
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context はストリームのコンテキストを返します。
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// Send はメッセージを破棄します。
+func (s *contextStream) Send(*api.ConsumeResponse) error {
+	return nil
+}
+
+// SetTrailer はトレーラーを破棄します。
+func (s *contextStream) SetTrailer(metadata.MD) {}
+
+// TestAllowAnonymous は Authorizer を設定せずに AllowAnonymous を有効にした場合、全てのクライアントが操作できること、
+// 呼び出し側の Config の Authorizer は書き換えないことを検証します。
+func TestAllowAnonymous(t *testing.T) {
+	_, nobodyClient, cfg, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = nil
+		c.AllowAnonymous = true
+	})
+	defer teardown()
+
+	testProduceConsume(t, nobodyClient, nil, nil)
+	require.Nil(t, cfg.Authorizer)
+}
+
+// TestNilAuthorizerRejected は Authorizer と AllowAnonymous のどちらも設定されていない場合、
+// サーバーの作成が拒否されることを検証します。
+func TestNilAuthorizerRejected(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer func() { _ = clog.Close() }()
+
+	srv, err := NewGRPCServer(&Config{CommitLog: clog})
+	require.Error(t, err)
+	require.Nil(t, srv)
+}
+
+// testProduceDuplicate は同じ冪等キーで 2 回 Produce した場合、2 回目は書き込まれずに
+// 同じオフセットと Duplicate=true が返されることを検証します。
+func testProduceDuplicate(t *testing.T, client, _ api.LogClient, _ *Config) {
+	ctx := context.Background()
+
+	req := &api.ProduceRequest{
+		Record:         &api.Record{Value: []byte("hello world")},
+		IdempotencyKey: "key-1",
+	}
+	first, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.False(t, first.Duplicate)
+
+	second, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.True(t, second.Duplicate)
+	require.Equal(t, first.Offset, second.Offset)
+
+	// 重複した Produce ではレコードが追加されていない
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: first.Offset + 1})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+// TestStreamHeartbeat はログの末尾で待機している ConsumeStream に、設定した間隔でハートビートが送信され、
+// その後に書き込まれたレコードはハートビートと区別して受信できることを検証します。
+func TestStreamHeartbeat(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.StreamHeartbeatInterval = interval
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.True(t, res.Heartbeat)
+		require.Nil(t, res.Record)
+	}
+	require.GreaterOrEqual(t, time.Since(start), 2*interval)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	for {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		if res.Heartbeat {
+			continue
+		}
+		require.Equal(t, []byte("hello world"), res.Record.Value)
+		break
+	}
+}
+
+// TestGetServerInfo は GetServerInfo がビルド時に埋め込まれたバージョン情報と、有効な機能の一覧を返すことを検証します。
+func TestGetServerInfo(t *testing.T) {
+	defer func(v, c string) {
+		version.Version, version.Commit = v, c
+	}(version.Version, version.Commit)
+	version.Version = "v1.2.3"
+	version.Commit = "0123abc"
+
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.FairScheduling = true
+		c.WriteQuotaBytes = 1024
+		c.SequenceHeader = "seq"
+	})
+	defer teardown()
+
+	info, err := client.GetServerInfo(
+		context.Background(),
+		&api.GetServerInfoRequest{},
+	)
+	require.NoError(t, err)
+	require.Equal(t, "v1.2.3", info.Version)
+	require.Equal(t, "0123abc", info.Commit)
+	require.Equal(t, []string{
+		"compression",
+		"idempotency",
+		"fetch",
+		"fair_scheduling",
+		"committed_only",
+		"write_quota",
+		"sequence",
+	}, info.Features)
+}
+
+// TestConsumeStreamSampling は SampleRate に 0.5 を指定した ConsumeStream が、おおよそ半数のレコードだけを
+// オフセットの昇順で配信することを検証します。
+func TestConsumeStreamSampling(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+
+	const total = 100
+	for i := 0; i < total; i++ {
+		_, err := client.Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:     0,
+		SampleRate: 0.5,
+	})
+	require.NoError(t, err)
+
+	var offsets []uint64
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			break
+		}
+		if len(offsets) > 0 {
+			require.Greater(t, res.Record.Offset, offsets[len(offsets)-1])
+		}
+		offsets = append(offsets, res.Record.Offset)
+	}
+	require.InDelta(t, total/2, len(offsets), total*0.15)
+	require.Less(t, offsets[len(offsets)-1], uint64(total))
+}
+
+// testConsumeBatchDeadline は、ゆっくりとレコードが書き込まれるログに対する ConsumeBatch が、
+// 期限までに MaxRecords 件が揃わない場合にエラーではなく途中までのレコードと DeadlineExceeded を返すことを検証します。
+func testConsumeBatchDeadline(t *testing.T, client, _ api.LogClient, _ *Config) {
+	ctx := context.Background()
+	record := &api.Record{Value: []byte("hello world")}
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: record})
+	require.NoError(t, err)
+
+	// 期限なしで全件揃う場合は待たずに返す
+	res, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{MaxRecords: 1})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+	require.False(t, res.DeadlineExceeded)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, _ = client.Produce(ctx, &api.ProduceRequest{Record: record})
+			}
+		}
+	}()
+
+	deadlineCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	res, err = client.ConsumeBatch(deadlineCtx, &api.ConsumeBatchRequest{MaxRecords: 100})
+	require.NoError(t, err)
+	require.True(t, res.DeadlineExceeded)
+	require.Greater(t, len(res.Records), 1)
+	require.Less(t, len(res.Records), 100)
+	for i, r := range res.Records {
+		require.Equal(t, uint64(i), r.Offset)
+	}
+}
+
+// TestConsumeRequestValidation は、不正なフィールドを持つ ConsumeRequest に対して Consume と ConsumeStream が
+// 範囲外のオフセットとは区別された InvalidArgument のエラーを、フィールド名を含むメッセージとともに返すことを検証します。
+func TestConsumeRequestValidation(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		req     *api.ConsumeRequest
+		message string
+	}{
+		"negative sample rate":   {&api.ConsumeRequest{SampleRate: -0.1}, "invalid sample_rate: must be between 0 and 1"},
+		"sample rate above one":  {&api.ConsumeRequest{SampleRate: 1.5}, "invalid sample_rate: must be between 0 and 1"},
+		"sample rate not number": {&api.ConsumeRequest{SampleRate: math.NaN()}, "invalid sample_rate: must be between 0 and 1"},
+		"inverted range":         {&api.ConsumeRequest{Offset: 2, EndOffset: 1}, "invalid end_offset: must not be less than offset"},
+	} {
+		req := tc.req
+		t.Run(name, func(t *testing.T) {
+			_, err := client.Consume(ctx, req)
+			require.Equal(t, codes.InvalidArgument, status.Code(err))
+			require.Equal(t, tc.message, status.Convert(err).Message())
+
+			stream, err := client.ConsumeStream(ctx, req)
+			require.NoError(t, err)
+			_, err = stream.Recv()
+			require.Equal(t, codes.InvalidArgument, status.Code(err))
+		})
+	}
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1, SampleRate: 1})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+// TestAuditLog は、root が実行した Truncate が主体とパラメーターとともに監査ログに記録され、
+// GetAuditLog で取得できることと、権限のない主体は管理操作を実行できないことを検証します。
+func TestAuditLog(t *testing.T) {
+	auditLog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer func() { _ = auditLog.Close() }()
+
+	client, nobodyClient, _, teardown := setupTest(t, func(c *Config) {
+		c.AuditLog = auditLog
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	before := time.Now()
+	_, err = client.Truncate(ctx, &api.TruncateRequest{Lowest: 1})
+	require.NoError(t, err)
+
+	_, err = nobodyClient.Truncate(ctx, &api.TruncateRequest{Lowest: 1})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.GetAuditLog(ctx, &api.GetAuditLogRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	res, err := client.GetAuditLog(ctx, &api.GetAuditLogRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Entries, 1)
+	entry := res.Entries[0]
+	require.Equal(t, "root", entry.Subject)
+	require.Equal(t, "truncate", entry.Operation)
+	require.Equal(t, map[string]string{"lowest": "1"}, entry.Parameters)
+	require.GreaterOrEqual(t, entry.TimeUnixNano, before.UnixNano())
+}
+
+// TestTruncateErrors は、lowest が最大オフセット以上の Truncate が InvalidArgument を返し、
+// ログを閉じた後の Truncate が Unavailable を返すことを検証します。
+func TestTruncateErrors(t *testing.T) {
+	client, _, cfg, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	_, err := client.Truncate(ctx, &api.TruncateRequest{Lowest: 2})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	require.NoError(t, cfg.CommitLog.(*log.Log).Close())
+	_, err = client.Truncate(ctx, &api.TruncateRequest{Lowest: 1})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+// TestListConnections は、ListConnections が接続ごとに TLS の証明書の主体と実行中のストリームの数を返し、
+// ストリームを閉じるとその数が減ることを検証します。
+func TestListConnections(t *testing.T) {
+	rootClient, nobodyClient, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	streamCtx, closeStreams := context.WithCancel(ctx)
+	for i := 0; i < 2; i++ {
+		_, err := rootClient.ConsumeStream(streamCtx, &api.ConsumeRequest{})
+		require.NoError(t, err)
+	}
+	// nobody は権限がないが、接続は確立される
+	_, err := nobodyClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{}})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	streams := func() map[string]uint64 {
+		res, err := rootClient.ListConnections(ctx, &api.ListConnectionsRequest{})
+		require.NoError(t, err)
+		streams := make(map[string]uint64)
+		for _, conn := range res.Connections {
+			require.NotEmpty(t, conn.PeerAddr)
+			streams[conn.Subject] += conn.ActiveStreams
+		}
+		return streams
+	}
+	require.Eventually(t, func() bool {
+		got := streams()
+		return len(got) == 2 && got["root"] == 2 && got["nobody"] == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	closeStreams()
+	require.Eventually(t, func() bool {
+		return streams()["root"] == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = nobodyClient.ListConnections(ctx, &api.ListConnectionsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// TestRequireMaintenance は、RequireMaintenance が設定されている場合に Truncate がメンテナンスモード外では拒否され、
+// SetMaintenance でメンテナンスモードにした後は実行できることを検証します。
+func TestRequireMaintenance(t *testing.T) {
+	client, nobodyClient, _, teardown := setupTest(t, func(c *Config) {
+		c.RequireMaintenance = true
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	_, err := client.Truncate(ctx, &api.TruncateRequest{Lowest: 1})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = nobodyClient.SetMaintenance(ctx, &api.SetMaintenanceRequest{On: true})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	res, err := client.SetMaintenance(ctx, &api.SetMaintenanceRequest{On: true})
+	require.NoError(t, err)
+	require.False(t, res.Previous)
+	_, err = client.Truncate(ctx, &api.TruncateRequest{Lowest: 1})
+	require.NoError(t, err)
+
+	res, err = client.SetMaintenance(ctx, &api.SetMaintenanceRequest{On: false})
+	require.NoError(t, err)
+	require.True(t, res.Previous)
+	_, err = client.Truncate(ctx, &api.TruncateRequest{Lowest: 1})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+// TestConsumeCommittedOnly は、最大オフセットが 10 でハイウォーターマークが 7 の場合に、
+// CommittedOnly を指定した Consume と ConsumeStream がオフセット 7 までしか読み出さないことを検証します。
+func TestConsumeCommittedOnly(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.HighWatermarkFunc = func() (uint64, bool) {
+			return 7, true
+		}
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i <= 10; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 7, CommittedOnly: true})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), res.Record.Offset)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 8, CommittedOnly: true})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 10})
+	require.NoError(t, err)
+
+	streamCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	stream, err := client.ConsumeStream(streamCtx, &api.ConsumeRequest{CommittedOnly: true})
+	require.NoError(t, err)
+	var last uint64
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+			break
+		}
+		last = res.Record.Offset
+	}
+	require.Equal(t, uint64(7), last)
+}
+
+// TestConsumeCommittedOnlyUntracked は、HighWatermarkFunc が設定されておらず、CommitLog もハイウォーターマークを保持できない
+// サーバーに CommittedOnly を指定した場合に FailedPrecondition のエラーを返すことを検証します。
+func TestConsumeCommittedOnlyUntracked(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		// CommitLog のメソッドだけを公開し、ハイウォーターマークを保持できないログにする
+		c.CommitLog = struct{ CommitLog }{c.CommitLog}
+	})
+	defer teardown()
+
+	_, err := client.Consume(context.Background(), &api.ConsumeRequest{CommittedOnly: true})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+// TestConsumeCommittedOnlyLogHighWatermark は、HighWatermarkFunc が設定されていない場合に CommittedOnly の読み出しが
+// CommitLog のハイウォーターマークを使用し、全てのレプリカが AckReplica するまで確定していないレコードを範囲外として扱うことを検証します。
+func TestConsumeCommittedOnlyLogHighWatermark(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{TrackHighWatermark: true})
+	require.NoError(t, err)
+	defer func() { _ = clog.Close() }()
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = clog
+		c.ReplicaNames = func() []string { return []string{"follower"} }
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0, CommittedOnly: true})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	res, err := client.AckReplica(ctx, &api.AckReplicaRequest{ReplicaName: "follower", Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.HighWatermark)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1, CommittedOnly: true})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 2, CommittedOnly: true})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+// testConsumeBatchDescending は、Order に DESCENDING を指定した ConsumeBatch が最大オフセットから新しい順にレコードを返すことを検証します。
+func testConsumeBatchDescending(t *testing.T, client, _ api.LogClient, _ *Config) {
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	// 最大オフセットより大きいオフセットは最大オフセットから読み出す
+	res, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{
+		Offset: math.MaxUint64,
+		Order:  api.Order_DESCENDING,
+	})
+	require.NoError(t, err)
+	var offsets []uint64
+	for _, record := range res.Records {
+		offsets = append(offsets, record.Offset)
+	}
+	require.Equal(t, []uint64{4, 3, 2, 1, 0}, offsets)
+
+	res, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{
+		Offset:     3,
+		MaxRecords: 2,
+		Order:      api.Order_DESCENDING,
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 2)
+	require.Equal(t, uint64(2), res.Records[1].Offset)
+}
+
+// TestMinSchemaVersion は、MinSchemaVersion より古いスキーマバージョンのレコードが拒否され、
+// 条件を満たすレコードはスキーマバージョンを保ったまま書き込まれて読み出せることを検証します。
+func TestMinSchemaVersion(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.MinSchemaVersion = 2
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("old"), SchemaVersion: 1},
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("new"), SchemaVersion: 3},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), consume.Record.Value)
+	require.Equal(t, uint32(3), consume.Record.SchemaVersion)
+}
+
+// TestTraceExporter は、TraceExporter を設定した場合に RPC のメソッド名を持つスパンがエクスポートされることを検証します。
+// 登録を解除できないため、Shutdown がなければサーバーを作成しないことも検証します。
+func TestTraceExporter(t *testing.T) {
+	exp := &memoryExporter{}
+	_, err := NewGRPCServer(&Config{AllowAnonymous: true, TraceExporter: exp})
+	require.Error(t, err)
+
+	shutdown := make(chan struct{})
+	defer close(shutdown)
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.TraceExporter = exp
+		c.Shutdown = shutdown
+	})
+	defer teardown()
+
+	_, err = client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return exp.has("log.v1.Log.Produce")
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestTracingEndpoint は、TracingEndpoint を設定した場合に RPC のメソッド名を持つスパンが OTLP/HTTP で
+// コレクターへ送信され、Shutdown を閉じたときに送信待ちのスパンも送信されることを検証します。
+// 橋渡しした後のスパンは OpenCensus のエクスポーターに渡らないため、TraceExporter と同時に設定できないことも検証します。
+func TestTracingEndpoint(t *testing.T) {
+	_, err := NewGRPCServer(&Config{
+		AllowAnonymous:  true,
+		TraceExporter:   &memoryExporter{},
+		TracingEndpoint: "http://localhost:4318/v1/traces",
+		Shutdown:        make(chan struct{}),
+	})
+	require.Error(t, err)
+
+	var mu sync.Mutex
+	var names []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if r.URL.Path != "/v1/traces" || err != nil || proto.Unmarshal(body, req) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					names = append(names, span.Name)
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+	// 橋渡しは元に戻らないため、サーバーを止めた後で他のテストのために OpenCensus のトレーサーを戻す
+	previous := trace.DefaultTracer
+	defer func() { trace.DefaultTracer = previous }()
+
+	shutdown := make(chan struct{})
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.TracingEndpoint = collector.URL + "/v1/traces"
+		c.Shutdown = shutdown
+	})
+	defer teardown()
+
+	_, err = client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	close(shutdown)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, name := range names {
+			if name == "log.v1.Log.Produce" {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// memoryExporter はエクスポートされたスパンをメモリに保持する trace.Exporter です。
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+// ExportSpan はスパンを記録します。
+func (e *memoryExporter) ExportSpan(s *trace.SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+// has は name という名前のスパンがエクスポートされたかを返します。
+func (e *memoryExporter) has(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range e.spans {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// TestWriteQuota は、書き込み量の上限を超えた主体の書き込みが ResourceExhausted で拒否される一方、
+// 別の主体は自身の上限まで書き込めること、期間が過ぎると再び書き込めることを検証します。
+func TestWriteQuota(t *testing.T) {
+	client, otherClient, _, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = nil
+		c.AllowAnonymous = true
+		c.WriteQuotaBytes = 30
+		c.WriteQuotaWindow = 300 * time.Millisecond
+	})
+	defer teardown()
+	ctx := context.Background()
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Produce(ctx, req)
+		require.NoError(t, err)
+	}
+	_, err := client.Produce(ctx, req)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	_, err = otherClient.Produce(ctx, req)
+	require.NoError(t, err)
+
+	time.Sleep(300 * time.Millisecond)
+	_, err = client.Produce(ctx, req)
+	require.NoError(t, err)
+}
+
+// TestWriteQuotaRefund は、冪等キーによる重複の書き込みや、シーケンス番号の不一致で拒否された書き込みが
+// 書き込み量に数えられず、新たに書き込んだレコードの分だけが上限まで数えられることを検証します。
+func TestWriteQuotaRefund(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = nil
+		c.AllowAnonymous = true
+		c.WriteQuotaBytes = 30
+		c.WriteQuotaWindow = time.Minute
+		c.SequenceHeader = "seq"
+	})
+	defer teardown()
+	ctx := context.Background()
+	produce := func(seq, key string) error {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value:   []byte("hello world"),
+				Headers: map[string]string{"seq": seq},
+			},
+			IdempotencyKey: key,
+		})
+		return err
+	}
+
+	require.NoError(t, produce("1", "a"))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, produce("1", "a"))
+		require.Equal(t, codes.FailedPrecondition, status.Code(produce("5", "")))
+	}
+	require.NoError(t, produce("2", ""))
+	require.Equal(t, codes.ResourceExhausted, status.Code(produce("3", "")))
+}
+
+// TestDiff は、内容が 1 件だけ異なる 2 つのサーバーのログを Diff で比較した場合に、
+// そのオフセットだけが不一致として返されることを検証します。
+func TestDiff(t *testing.T) {
+	peerLog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer func() { _ = peerLog.Close() }()
+	peerAddr := startPeer(t, &Config{CommitLog: peerLog, AllowAnonymous: true})
+
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.PeerDialOptions = []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		}
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	for i, v := range []string{"a", "b", "c", "d"} {
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(v)}})
+		require.NoError(t, err)
+		if i == 2 {
+			v = "x"
+		}
+		_, err = peerLog.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+
+	stream, err := client.Diff(ctx, &api.DiffRequest{PeerAddr: peerAddr, From: 0, To: 3})
+	require.NoError(t, err)
+	var mismatches []*api.DiffResponse
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		mismatches = append(mismatches, res)
+	}
+	require.Len(t, mismatches, 1)
+	require.Equal(t, uint64(2), mismatches[0].Offset)
+	require.Equal(t, log.MismatchValueDiffers, mismatches[0].Reason)
+}
+
+// startPeer は TLS を使用しない比較先のサーバーを config で起動し、そのアドレスを返します。
+func startPeer(t *testing.T, config *Config) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := NewGRPCServer(config)
+	require.NoError(t, err)
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	t.Cleanup(srv.Stop)
+	return l.Addr().String()
+}
+
+// TestSetLogLevel は、SetLogLevel でログレベルを debug に変更すると、
+// 以降のリクエストでデバッグレベルのログが出力されるようになることを検証します。
+func TestSetLogLevel(t *testing.T) {
+	level := zap.NewAtomicLevelAt(zap.InfoLevel)
+	core, logs := observer.New(level)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	client, nobodyClient, _, teardown := setupTest(t, func(c *Config) {
+		c.LogLevel = &level
+	})
+	defer teardown()
+	ctx := context.Background()
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+
+	_, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Zero(t, logs.FilterMessage("produced record").Len())
+
+	_, err = nobodyClient.SetLogLevel(ctx, &api.SetLogLevelRequest{Level: "debug"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.SetLogLevel(ctx, &api.SetLogLevelRequest{Level: "verbose"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	res, err := client.SetLogLevel(ctx, &api.SetLogLevelRequest{Level: "debug"})
+	require.NoError(t, err)
+	require.Equal(t, "info", res.Previous)
+
+	_, err = client.Produce(ctx, req)
+	require.NoError(t, err)
+	entries := logs.FilterMessage("produced record").All()
+	require.Len(t, entries, 1)
+	require.Equal(t, zap.DebugLevel, entries[0].Level)
+	require.Equal(t, "server", entries[0].LoggerName)
+}
+
+// TestConsumeBySegment は、2 つのセグメントにまたがるログを ConsumeBySegment で読み出した場合に、
+// セグメントの境界の前後で各レコードに正しいセグメントのベースオフセットが付与されることを検証します。
+func TestConsumeBySegment(t *testing.T) {
+	c := log.Config{}
+	c.Segment.MaxRecords = 2
+	clog, err := log.NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer func() { _ = clog.Close() }()
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = clog
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	require.Len(t, clog.Segments(), 2)
+
+	stream, err := client.ConsumeBySegment(ctx, &api.ConsumeBySegmentRequest{})
+	require.NoError(t, err)
+	var got [][2]uint64
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		got = append(got, [2]uint64{res.Record.Offset, res.SegmentBaseOffset})
+	}
+	require.Equal(t, [][2]uint64{{0, 0}, {1, 0}, {2, 2}}, got)
+}
+
+// TestTransportBufferSizes は、バッファーとウィンドウのサイズを設定したサーバーがオプションを適用し、
+// 大きなデータセットを ConsumeStream で最後まで送信できることを検証します。
+func TestTransportBufferSizes(t *testing.T) {
+	require.Empty(t, transportOptions(&Config{}))
+
+	const n = 1000
+	var opts []grpc.ServerOption
+	client, _, cfg, teardown := setupTest(t, func(c *Config) {
+		c.WriteBufferSize = 64 * 1024
+		c.ReadBufferSize = 64 * 1024
+		c.InitialWindowSize = 1 << 20
+		opts = transportOptions(c)
+	})
+	defer teardown()
+	require.Len(t, opts, 3)
+
+	value := make([]byte, 4096)
+	for i := 0; i < n; i++ {
+		_, err := cfg.CommitLog.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for i := uint64(0); i < n; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, i, res.Record.Offset)
+		require.Len(t, res.Record.Value, len(value))
+	}
+}
+
+// BenchmarkConsumeStream は、トランスポートのバッファーサイズを変えて大きなレコードを ConsumeStream で読み出す速度を計測します。
+func BenchmarkConsumeStream(b *testing.B) {
+	for name, size := range map[string]int{
+		"default": 0,
+		"256KiB":  256 * 1024,
+	} {
+		b.Run(name, func(b *testing.B) {
+			client, _, cfg, teardown := setupTest(b, func(c *Config) {
+				c.WriteBufferSize = size
+				c.ReadBufferSize = size
+			})
+			defer teardown()
+
+			value := make([]byte, 4096)
+			for i := 0; i < b.N; i++ {
+				_, err := cfg.CommitLog.Append(&api.Record{Value: value})
+				require.NoError(b, err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			b.SetBytes(int64(len(value)))
+			b.ResetTimer()
+			stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+			require.NoError(b, err)
+			for i := 0; i < b.N; i++ {
+				_, err := stream.Recv()
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+// TestRecordProducerSubject は、RecordProducerSubject を有効にすると書き込んだ主体がヘッダーに記録され、
+// クライアントが指定した値では偽装できず、FindBySubject で主体ごとのオフセットを取得できることを検証します。
+func TestRecordProducerSubject(t *testing.T) {
+	rootClient, nobodyClient, cfg, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = nil
+		c.AllowAnonymous = true
+		c.RecordProducerSubject = true
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	for _, client := range []api.LogClient{rootClient, nobodyClient, rootClient} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value:   []byte("hello world"),
+				Headers: map[string]string{log.ProducerSubjectHeader: "root"},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	res, err := rootClient.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, "nobody", res.Record.Headers[log.ProducerSubjectHeader])
+
+	clog := cfg.CommitLog.(*log.Log)
+	offsets, err := clog.FindBySubject("root")
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 2}, offsets)
+	offsets, err = clog.FindBySubject("nobody")
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1}, offsets)
+}
+
+// TestProduceReadFromLog は、サーバー経由で書き込んだレコードを log.Log から直接読み出せること、
+// つまりサーバーとログが同じ api.Record の型を扱っていることを検証します。
+func TestProduceReadFromLog(t *testing.T) {
+	client, _, cfg, teardown := setupTest(t, nil)
+	defer teardown()
+
+	want := &api.Record{
+		Value:         []byte("hello world"),
+		SchemaVersion: 2,
+		Headers:       map[string]string{"key": "value"},
+	}
+	res, err := client.Produce(context.Background(), &api.ProduceRequest{Record: want})
+	require.NoError(t, err)
+
+	got, err := cfg.CommitLog.(*log.Log).Read(res.Offset)
+	require.NoError(t, err)
+	require.Equal(t, res.Offset, got.Offset)
+	require.Equal(t, want.Value, got.Value)
+	require.Equal(t, want.SchemaVersion, got.SchemaVersion)
+	require.Equal(t, want.Headers, got.Headers)
+}
+
+// TestProduceStreamBackpressure は、書き込みが遅い場合でも ProduceStream が MaxInFlightProduces を超えて
+// リクエストを受信せず、書き込みが再開すると全てのレコードに応答することを検証します。
+func TestProduceStreamBackpressure(t *testing.T) {
+	const limit, n = 4, 50
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	slow := &blockingLog{CommitLog: clog, release: make(chan struct{})}
+	payloads := &payloadCounter{}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := NewGRPCServer(&Config{
+		CommitLog:           slow,
+		AllowAnonymous:      true,
+		MaxInFlightProduces: limit,
+	}, grpc.StatsHandler(payloads))
+	require.NoError(t, err)
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	stream, err := api.NewLogClient(conn).ProduceStream(context.Background())
+	require.NoError(t, err)
+
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := stream.Send(&api.ProduceRequest{
+				Record: &api.Record{Value: []byte("hello world")},
+			}); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	require.LessOrEqual(t, payloads.in.Load(), int64(limit))
+
+	close(slow.release)
+	for i := uint64(0); i < n; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, i, res.Offset)
+	}
+}
+
+// TestProduceThrottleHint は、書き込みを待っている Produce が ThrottleQueueDepth を超えた場合に、
+// 超えた分の応答に 0 より大きい待機時間の ThrottleHint が設定されることを検証します。
+func TestProduceThrottleHint(t *testing.T) {
+	const threshold, n = 2, 6
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	slow := &blockingLog{CommitLog: clog, release: make(chan struct{})}
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = slow
+		c.ThrottleQueueDepth = threshold
+	})
+	defer teardown()
+
+	responses := make(chan *api.ProduceResponse, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Produce(context.Background(), &api.ProduceRequest{
+				Record: &api.Record{Value: []byte("hello world")},
+			})
+			require.NoError(t, err)
+			responses <- res
+		}()
+	}
+	// 全ての Produce が書き込み待ちになるまで待つ
+	time.Sleep(200 * time.Millisecond)
+	close(slow.release)
+	wg.Wait()
+	close(responses)
+
+	var throttled int
+	for res := range responses {
+		if hint := res.ThrottleHint; hint != nil {
+			require.NotZero(t, hint.BackoffMs)
+			require.Greater(t, hint.QueueDepth, uint64(threshold))
+			throttled++
+		}
+	}
+	require.Equal(t, n-threshold, throttled)
+
+	// 混雑が解消した後の書き込みには ThrottleHint を設定しない
+	res, err := client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	require.Nil(t, res.ThrottleHint)
+}
+
+// blockingLog は release が閉じられるまで Append をブロックする CommitLog です。
+type blockingLog struct {
+	CommitLog
+	release chan struct{}
+}
+
+func (l *blockingLog) Append(record *api.Record) (uint64, error) {
+	<-l.release
+	return l.CommitLog.Append(record)
+}
+
+// payloadCounter はサーバーが受信したメッセージの数を数える stats.Handler です。
+type payloadCounter struct {
+	in atomic.Int64
+}
+
+func (c *payloadCounter) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (c *payloadCounter) HandleRPC(_ context.Context, s stats.RPCStats) {
+	if _, ok := s.(*stats.InPayload); ok {
+		c.in.Add(1)
+	}
+}
+
+func (c *payloadCounter) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (c *payloadCounter) HandleConn(context.Context, stats.ConnStats) {}
+
+// TestRequiredMetadata は、RequiredMetadata のキーがないリクエストがハンドラーに届く前に InvalidArgument で拒否され、
+// キーを指定したリクエストは処理されることを検証します。
+func TestRequiredMetadata(t *testing.T) {
+	client, _, cfg, teardown := setupTest(t, func(c *Config) {
+		c.RequiredMetadata = []string{"tenant-id"}
+	})
+	defer teardown()
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+
+	_, err := client.Produce(context.Background(), req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = cfg.CommitLog.Read(0)
+	require.Error(t, err)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "tenant-id", "acme")
+	res, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// TestNewGRPCServerWith は、NewGRPCServerWith の register で登録したヘルスチェックのサービスが Log と同じポートで動作し、
+// RequiredMetadata のインターセプターを Log と共有することを検証します。
+func TestNewGRPCServerWith(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer func() { _ = clog.Close() }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := NewGRPCServerWith(&Config{
+		CommitLog:        clog,
+		AllowAnonymous:   true,
+		RequiredMetadata: []string{"tenant-id"},
+	}, func(gsrv *grpc.Server) {
+		healthpb.RegisterHealthServer(gsrv, health.NewServer())
+	})
+	require.NoError(t, err)
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	healthClient := healthpb.NewHealthClient(conn)
+	_, err = healthClient.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "tenant-id", "acme")
+	check, err := healthClient.Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check.Status)
+
+	produce, err := api.NewLogClient(conn).Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+}
+
+// TestGetClusterOffsets は、GetClusterOffsets が到達できるメンバーのオフセットの範囲を返し、
+// 到達できないメンバーは全体を失敗させずにエラーとして記録することを検証します。
+func TestGetClusterOffsets(t *testing.T) {
+	peerLog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer func() { _ = peerLog.Close() }()
+	for i := 0; i < 3; i++ {
+		_, err = peerLog.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	peerAddr := startPeer(t, &Config{CommitLog: peerLog, AllowAnonymous: true})
+
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.PeerDialOptions = []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		}
+		c.ClusterMembers = func() map[string]string {
+			return map[string]string{"peer": peerAddr, "down": "127.0.0.1:1"}
+		}
+	})
+	defer teardown()
+
+	res, err := client.GetClusterOffsets(context.Background(), &api.GetClusterOffsetsRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Nodes, 2)
+	require.Empty(t, res.Nodes["peer"].Error)
+	require.Equal(t, uint64(0), res.Nodes["peer"].Lowest)
+	require.Equal(t, uint64(2), res.Nodes["peer"].Highest)
+	require.NotEmpty(t, res.Nodes["down"].Error)
+}
+
+// TestPrefetch は、Prefetch の後も通常どおりレコードを読み出せること、指定できるオフセットの数に上限があることを検証します。
+func TestPrefetch(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	_, err := client.Prefetch(ctx, &api.PrefetchRequest{Offsets: []uint64{0, 1, 2}})
+	require.NoError(t, err)
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Record.Offset)
+
+	_, err = client.Prefetch(ctx, &api.PrefetchRequest{
+		Offsets: make([]uint64, maxPrefetchOffsets+1),
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// TestExists は、Exists が書き込んだオフセットに true を、まだ書き込まれていないオフセットに false を返し、
+// 権限のない主体を拒否することを検証します。
+func TestExists(t *testing.T) {
+	client, nobodyClient, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	res, err := client.Exists(ctx, &api.ExistsRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.True(t, res.Exists)
+	res, err = client.Exists(ctx, &api.ExistsRequest{Offset: produce.Offset + 1})
+	require.NoError(t, err)
+	require.False(t, res.Exists)
+
+	_, err = nobodyClient.Exists(ctx, &api.ExistsRequest{Offset: produce.Offset})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// TestConsumeValueRange は、ValueOffset と ValueLength を指定した Consume が値のその範囲だけを返し、
+// 値の長さを超える範囲を InvalidArgument で拒否することを検証します。
+func TestConsumeValueRange(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	value := make([]byte, 100)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: value}})
+	require.NoError(t, err)
+
+	res, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      produce.Offset,
+		ValueOffset: 10,
+		ValueLength: 10,
+	})
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset, res.Record.Offset)
+	require.Equal(t, value[10:20], res.Record.Value)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      produce.Offset,
+		ValueOffset: 95,
+		ValueLength: 10,
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// TestConsumeStreamEvents は、IncludeEvents を指定した ConsumeStream で、
+// 待機中にログが切り詰められると切り詰めのイベントが送信されることを検証します。
+func TestConsumeStreamEvents(t *testing.T) {
+	client, _, cfg, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("a record that spans segments")},
+		})
+		require.NoError(t, err)
+	}
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{IncludeEvents: true})
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Record.Offset)
+	}
+
+	require.NoError(t, cfg.CommitLog.(*log.Log).Truncate(n/2))
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Nil(t, res.Record)
+	require.Equal(t, string(log.EventTruncated), res.Event.Type)
+	require.LessOrEqual(t, res.Event.Offset, uint64(n/2))
+}
+
+// TestNamedConsumer は、名前付きコンシューマーとして 3 件を読み出して Ack した後に再接続すると、
+// オフセットを指定しなくてもオフセット 3 から読み出しを再開することを検証します。
+func TestNamedConsumer(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := client.ConsumeStream(streamCtx, &api.ConsumeRequest{ConsumerName: "reader"})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Record.Offset)
+		_, err = client.Ack(ctx, &api.AckRequest{ConsumerName: "reader", Offset: res.Record.Offset})
+		require.NoError(t, err)
+	}
+	cancel()
+
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{ConsumerName: "reader"})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Record.Offset)
+
+	// Consume でも同じ位置から読み出し、別の名前のコンシューマーは先頭から読み出す
+	consumed, err := client.Consume(ctx, &api.ConsumeRequest{ConsumerName: "reader"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), consumed.Record.Offset)
+	consumed, err = client.Consume(ctx, &api.ConsumeRequest{ConsumerName: "other"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), consumed.Record.Offset)
+
+	_, err = client.Ack(ctx, &api.AckRequest{Offset: 1})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// TestConsumerOffsetTTL は、ConsumerOffsetTTL より長く Ack していないコンシューマーの位置が削除されてログに出力され、
+// その間に Ack したコンシューマーの位置は残ることを検証します。Shutdown がない場合はサーバーを作成しないことも検証します。
+func TestConsumerOffsetTTL(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+	shutdown := make(chan struct{})
+	defer close(shutdown)
+
+	// 削除のゴルーチンを止められないため、Shutdown がなければサーバーを作成しない
+	_, err := newgrpcServer(&Config{
+		AllowAnonymous:    true,
+		ConsumerOffsetTTL: time.Minute,
+	})
+	require.Error(t, err)
+
+	srv, err := newgrpcServer(&Config{
+		AllowAnonymous:    true,
+		ConsumerOffsetTTL: time.Minute,
+		Shutdown:          shutdown,
+	})
+	require.NoError(t, err)
+	clock := time.Now()
+	srv.checkpoints.now = func() time.Time { return clock }
+	ctx := context.Background()
+
+	for _, name := range []string{"stale", "active"} {
+		_, err = srv.Ack(ctx, &api.AckRequest{ConsumerName: name, Offset: 4})
+		require.NoError(t, err)
+	}
+	clock = clock.Add(40 * time.Second)
+	_, err = srv.Ack(ctx, &api.AckRequest{ConsumerName: "active", Offset: 9})
+	require.NoError(t, err)
+	clock = clock.Add(30 * time.Second)
+	srv.evictIdleConsumers()
+
+	require.Equal(t, uint64(0), srv.checkpoints.get("stale"))
+	require.Equal(t, uint64(10), srv.checkpoints.get("active"))
+	evicted := logs.FilterMessage("evicted idle consumer offset").All()
+	require.Len(t, evicted, 1)
+	require.Equal(t, "stale", evicted[0].ContextMap()["consumer"])
+	require.Equal(t, uint64(5), evicted[0].ContextMap()["next_offset"])
+}
+
+// TestConsumeJSONPaths は、JsonPaths を指定した Consume が JSON のレコードからそのパスの値だけを含むオブジェクトを返し、
+// JSON でないレコードは StrictJsonPaths が指定されていなければそのまま返し、指定されていれば FailedPrecondition で拒否することを検証します。
+func TestConsumeJSONPaths(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	for _, value := range []string{
+		`{"id":7,"user":{"name":"alice","email":"alice@example.com"},"payload":"large"}`,
+		`not json`,
+	} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		require.NoError(t, err)
+	}
+
+	paths := []string{"id", "user.name"}
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0, JsonPaths: paths})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"id":7,"user":{"name":"alice"}}`, string(res.Record.Value))
+
+	res, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1, JsonPaths: paths})
+	require.NoError(t, err)
+	require.Equal(t, "not json", string(res.Record.Value))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1, JsonPaths: paths, StrictJsonPaths: true})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0, JsonPaths: []string{"user..name"}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// TestConsumeInvalidOffsetPolicy は、切り詰めによって削除されたオフセットを読み出した場合に、
+// OnInvalidOffset が ERROR なら範囲外のエラーになり、EARLIEST と LATEST なら最小と最大のオフセットに置き換わることを検証します。
+func TestConsumeInvalidOffsetPolicy(t *testing.T) {
+	client, _, cfg, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("a record that spans segments")},
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, cfg.CommitLog.(*log.Log).Truncate(n/2))
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Greater(t, offsets.Lowest, uint64(0))
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	res, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset:          0,
+		OnInvalidOffset: api.InvalidOffsetPolicy_EARLIEST,
+	})
+	require.NoError(t, err)
+	require.Equal(t, offsets.Lowest, res.Record.Offset)
+
+	res, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:          0,
+		OnInvalidOffset: api.InvalidOffsetPolicy_LATEST,
+	})
+	require.NoError(t, err)
+	require.Equal(t, offsets.Highest, res.Record.Offset)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:          0,
+		OnInvalidOffset: api.InvalidOffsetPolicy_EARLIEST,
+	})
+	require.NoError(t, err)
+	for off := offsets.Lowest; off <= offsets.Lowest+2; off++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, off, res.Record.Offset)
+	}
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{OnInvalidOffset: api.InvalidOffsetPolicy(-1)})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// TestConsumeStreamCompressed は、gzip で圧縮した ConsumeStream で、ゆっくり書き込まれたレコードが
+// 後続のレコードを待たずに 1 件ずつ配信されることを検証します。
+func TestConsumeStreamCompressed(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{}, grpc.UseCompressor(gzip.Name))
+	require.NoError(t, err)
+	for i := uint64(0); i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+		produced := time.Now()
+
+		// 次のレコードを書き込む前に受信できなければ、レコードがまとめて配信されている
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, i, res.Record.Offset)
+		require.Less(t, time.Since(produced), time.Second)
+	}
+}
+
+// TestConsumeStreamEndReason は、EndOffset を指定した ConsumeStream がその直前のオフセットまで送信して終了し、
+// トレーラーに終了の理由として StreamEndReached を設定することを検証します。
+func TestConsumeStreamEndReason(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{EndOffset: 2})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Record.Offset)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, []string{api.StreamEndReached}, stream.Trailer().Get(api.StreamEndReasonKey))
+
+	// 逆転した範囲は終端への到達ではなく、不正なリクエストとして扱う
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 2, EndOffset: 1})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Empty(t, stream.Trailer().Get(api.StreamEndReasonKey))
+}
+
+// TestGetMemoryUsage は、GetMemoryUsage がログのメモリ使用量を返し、admin の権限がない主体を拒否することを検証します。
+func TestGetMemoryUsage(t *testing.T) {
+	rootClient, nobodyClient, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	res, err := rootClient.GetMemoryUsage(ctx, &api.GetMemoryUsageRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Segments)
+	require.NotZero(t, res.MmapBytes)
+
+	_, err = nobodyClient.GetMemoryUsage(ctx, &api.GetMemoryUsageRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// TestMaxStreamDuration は、MaxStreamDuration を設定したサーバーが、待機中の ConsumeStream と ProduceStream を
+// その時間の経過後に Unavailable で終了させ、終了の理由をトレーラーに設定することを検証します。
+func TestMaxStreamDuration(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.MaxStreamDuration = 200 * time.Millisecond
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	consume, err := client.ConsumeStream(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = consume.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	require.Equal(t, []string{api.StreamEndMaxDuration}, consume.Trailer().Get(api.StreamEndReasonKey))
+
+	produce, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, produce.Send(&api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}))
+	res, err := produce.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+	// クライアントが送信を続けなくても、サーバーがストリームを終了する
+	_, err = produce.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, []string{api.StreamEndMaxDuration}, produce.Trailer().Get(api.StreamEndReasonKey))
+}
+
+// TestStreamSendTimeout は、StreamSendTimeout を設定したサーバーが、受信を止めたクライアントへの ConsumeStream を
+// その時間の経過後に DeadlineExceeded で終了させ、終了の理由をトレーラーに設定することを検証します。
+// Config.InTapHandle がキャンセルの処理と合成されて呼び出されることと、
+// grpc.InTapHandle のオプションと重複した場合は panic せずにエラーを返すことも検証します。
+func TestStreamSendTimeout(t *testing.T) {
+	const n = 32
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer func() { _ = clog.Close() }()
+	value := make([]byte, 32<<10)
+	for i := 0; i < n; i++ {
+		_, err = clog.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+	}
+
+	// InTapHandle はオプションではなく Config で指定する。オプションで重複して指定しても panic せずにエラーを返す
+	var tapped atomic.Int64
+	countTap := func(ctx context.Context, _ *tap.Info) (context.Context, error) {
+		tapped.Add(1)
+		return ctx, nil
+	}
+	_, err = NewGRPCServer(&Config{
+		CommitLog:         clog,
+		AllowAnonymous:    true,
+		StreamSendTimeout: 100 * time.Millisecond,
+	}, grpc.InTapHandle(countTap))
+	require.Error(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := NewGRPCServer(&Config{
+		CommitLog:         clog,
+		AllowAnonymous:    true,
+		StreamSendTimeout: 100 * time.Millisecond,
+		InTapHandle:       countTap,
+	})
+	require.NoError(t, err)
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	defer srv.Stop()
+
+	// ウィンドウを固定し、受信しないクライアントへの送信がフロー制御で止まるようにする
+	conn, err := grpc.NewClient(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithInitialWindowSize(64<<10),
+		grpc.WithInitialConnWindowSize(64<<10),
+	)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	stream, err := api.NewLogClient(conn).ConsumeStream(context.Background(), &api.ConsumeRequest{})
+	require.NoError(t, err)
+
+	time.Sleep(300 * time.Millisecond)
+	received := 0
+	for {
+		if _, err = stream.Recv(); err != nil {
+			break
+		}
+		received++
+	}
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	require.Less(t, received, n)
+	require.Equal(t, []string{api.StreamEndSendTimeout}, stream.Trailer().Get(api.StreamEndReasonKey))
+	require.Equal(t, int64(1), tapped.Load())
+}
+
+// TestHighWatermark は、リーダーとフォロワーの 2 台のサーバーで、リーダーのハイウォーターマークがフォロワーの複製が
+// 追いつくまで最大オフセットより遅れ、追いつくと一致することと、レプリカを持たないフォロワーでは最大オフセットと一致することを検証します。
+func TestHighWatermark(t *testing.T) {
+	startServer := func(c log.Config, replicaNames func() []string) (api.LogClient, string) {
+		clog, err := log.NewLog(t.TempDir(), c)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = clog.Close() })
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		srv, err := NewGRPCServer(&Config{
+			CommitLog:      clog,
+			AllowAnonymous: true,
+			ReplicaNames:   replicaNames,
+		})
+		require.NoError(t, err)
+		go func() {
+			_ = srv.Serve(l)
+		}()
+		t.Cleanup(srv.Stop)
+		conn, err := grpc.NewClient(
+			l.Addr().String(),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		return api.NewLogClient(conn), l.Addr().String()
+	}
+	leader, leaderAddr := startServer(
+		log.Config{TrackHighWatermark: true},
+		func() []string { return []string{"follower"} },
+	)
+	follower, _ := startServer(log.Config{}, nil)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := leader.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	// フォロワーが複製を始める前は、ハイウォーターマークは進まない
+	res, err := leader.GetHighWatermark(ctx, &api.GetHighWatermarkRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.HighestOffset)
+	require.Equal(t, uint64(0), res.HighWatermark)
+	// 名前付きコンシューマーの Ack はレプリカの確認応答として扱わない
+	_, err = leader.Ack(ctx, &api.AckRequest{ConsumerName: "follower", Offset: 2})
+	require.NoError(t, err)
+	res, err = leader.GetHighWatermark(ctx, &api.GetHighWatermarkRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.HighWatermark)
+
+	r := &log.Replicator{
+		DialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
+		LocalServer: follower,
+		AckName:     "follower",
+		AckInterval: 10 * time.Millisecond,
+	}
+	require.NoError(t, r.Join("leader", leaderAddr))
+	defer func() { _ = r.Close() }()
+	require.Eventually(t, func() bool {
+		res, err = leader.GetHighWatermark(ctx, &api.GetHighWatermarkRequest{})
+		return err == nil && res.HighWatermark == res.HighestOffset
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(2), res.HighWatermark)
+
+	res, err = follower.GetHighWatermark(ctx, &api.GetHighWatermarkRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.HighestOffset)
+	require.Equal(t, res.HighestOffset, res.HighWatermark)
+}
+
+// TestFetch は、Fetch が MaxBytes を超えない範囲でレコードを返し、
+// プルモードの Replicator が自分の指定したサイズで Fetch を繰り返して全てのレコードを順番に複製することを検証します。
+func TestFetch(t *testing.T) {
+	var mu sync.Mutex
+	var fetches []*api.FetchRequest
+	recordFetch := func(ctx context.Context, req any, _ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (any, error) {
+		if f, ok := req.(*api.FetchRequest); ok {
+			mu.Lock()
+			fetches = append(fetches, f)
+			mu.Unlock()
+		}
+		return handler(ctx, req)
+	}
+	startServer := func(opts ...grpc.ServerOption) (api.LogClient, string) {
+		clog, err := log.NewLog(t.TempDir(), log.Config{})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = clog.Close() })
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		srv, err := NewGRPCServer(&Config{
+			CommitLog:      clog,
+			AllowAnonymous: true,
+		}, opts...)
+		require.NoError(t, err)
+		go func() {
+			_ = srv.Serve(l)
+		}()
+		t.Cleanup(srv.Stop)
+		conn, err := grpc.NewClient(
+			l.Addr().String(),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		return api.NewLogClient(conn), l.Addr().String()
+	}
+	leader, leaderAddr := startServer(grpc.ChainUnaryInterceptor(recordFetch))
+	follower, _ := startServer()
+	ctx := context.Background()
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		_, err := leader.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+	size := uint64(proto.Size(&api.Record{Value: []byte("record 0"), Offset: 1}))
+
+	res, err := leader.Fetch(ctx, &api.FetchRequest{Offset: 0, MaxBytes: 3 * size})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 3)
+	require.Equal(t, uint64(n-1), res.HighestOffset)
+	// 先頭のレコードが MaxBytes を超えても、1 件は返す
+	res, err = leader.Fetch(ctx, &api.FetchRequest{Offset: 5, MaxBytes: 1})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+	require.Equal(t, uint64(5), res.Records[0].Offset)
+	// 末尾に達した場合は待たずに空で返す
+	res, err = leader.Fetch(ctx, &api.FetchRequest{Offset: n})
+	require.NoError(t, err)
+	require.Empty(t, res.Records)
+
+	mu.Lock()
+	fetches = nil
+	mu.Unlock()
+	r := &log.Replicator{
+		DialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		},
+		LocalServer:   follower,
+		Mode:          log.ReplicationPull,
+		FetchMaxBytes: 2 * size,
+		FetchInterval: 10 * time.Millisecond,
+	}
+	require.NoError(t, r.Join("leader", leaderAddr))
+	defer func() { _ = r.Close() }()
+	require.Eventually(t, func() bool {
+		_, err := follower.Consume(ctx, &api.ConsumeRequest{Offset: n - 1})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	for i := uint64(0); i < n; i++ {
+		consume, err := follower.Consume(ctx, &api.ConsumeRequest{Offset: i})
+		require.NoError(t, err)
+		require.Equal(t, i, consume.Record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), consume.Record.Value)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// 2 件ずつ取得するため、全件の複製には少なくとも n/2 回の Fetch が必要になる
+	require.GreaterOrEqual(t, len(fetches), n/2)
+	for i, f := range fetches {
+		require.Equal(t, 2*size, f.MaxBytes)
+		if i < n/2 {
+			require.Equal(t, uint64(2*i), f.Offset)
+		}
+	}
+}
+
+// TestAuthorizers は、Authorizer が許可した操作でも Authorizers のいずれかが拒否すれば PermissionDenied で拒否され、
+// AttributeAuthorizer には接続元のアドレスが属性として渡されることを検証します。
+func TestAuthorizers(t *testing.T) {
+	source := &sourceAuthorizer{deny: produceAction}
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.Authorizers = []Authorizer{allowAll{}, source}
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Contains(t, source.peer.Load(), "127.0.0.1:")
+
+	// consume はどの Authorizer も拒否しないため、認可を通過して範囲外のエラーになる
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+// sourceAuthorizer は、接続元のアドレスを記録し、deny のアクションを拒否する AttributeAuthorizer です。
+type sourceAuthorizer struct {
+	deny string
+	peer atomic.Value
+}
+
+func (a *sourceAuthorizer) Authorize(_, _, _ string) error {
+	return errors.New("attributes are required")
+}
+
+func (a *sourceAuthorizer) AuthorizeAttributes(subject, _, action string, attrs Attributes) error {
+	a.peer.Store(attrs[AttributePeerAddress])
+	if action == a.deny {
+		return status.Errorf(codes.PermissionDenied, "%s not permitted to %s from %s",
+			subject, action, attrs[AttributePeerAddress])
+	}
+	return nil
+}
+
+// TestSequenceHeader は、SequenceHeader を設定すると番号どおりの書き込みは受け付け、
+// 番号を飛ばした書き込みは期待したシーケンス番号をエラーの詳細に含めて FailedPrecondition で拒否することを検証します。
+func TestSequenceHeader(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.SequenceHeader = "seq"
+	})
+	defer teardown()
+	ctx := context.Background()
+	produce := func(seq string) error {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value:   []byte("hello world"),
+				Headers: map[string]string{"seq": seq},
+			},
+		})
+		return err
+	}
+
+	require.NoError(t, produce("1"))
+	require.NoError(t, produce("2"))
+
+	err := produce("4")
+	st := status.Convert(err)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	require.Len(t, st.Details(), 1)
+	info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+	require.True(t, ok)
+	require.Equal(t, "3", info.Metadata["expected"])
+	require.Equal(t, "4", info.Metadata["got"])
+
+	// 拒否した書き込みは記録されないため、期待した番号で続けられる
+	require.NoError(t, produce("3"))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 3})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// endStream はストリームが終了する理由 reason をトレーラーに設定し、err をそのまま返します。
+func endStream(stream grpc.ServerStream, reason string, err error) error {
+	stream.SetTrailer(metadata.Pairs(api.StreamEndReasonKey, reason))
+	return err
+}
+
+// endReached は req に EndOffset が指定され、req.Offset がそこに達しているかを判定します。
+func endReached(req *api.ConsumeRequest) bool {
+	return req.EndOffset > 0 && req.Offset >= req.EndOffset
+}
+
+// truncatedAway は off のレコードがログの切り詰めによって削除済みかを判定します。
+// CommitLog が最小オフセットを返せない場合は false を返します。
+func (s *grpcServer) truncatedAway(off uint64) bool {
+	r, ok := s.CommitLog.(offsetRanger)
+	if !ok {
+		return false
+	}
+	lowest, err := r.LowestOffset()
+	return err == nil && off < lowest
+}
+
+// endOnError は ConsumeStream の読み出しで発生した err の理由をトレーラーに設定して返します。
+// 権限がなくなった場合は StreamEndUnauthorized を設定し、それ以外のエラーでは理由を設定しません。
+func endOnError(stream api.Log_ConsumeStreamServer, err error) error {
+	if status.Code(err) == codes.PermissionDenied {
+		return endStream(stream, api.StreamEndUnauthorized, err)
+	}
+	return err
+}
+
+// errShuttingDown はサーバーの停止処理によって ConsumeStream を終了する場合に返すエラーです。
+var errShuttingDown = status.Error(codes.Unavailable, "server is shutting down")
+
+// errMaxStreamDuration は MaxStreamDuration に達したストリームを終了する場合に返すエラーです。
+// クライアントが再接続するように Unavailable を返します。
+var errMaxStreamDuration = status.Error(codes.Unavailable, "stream reached the max duration, reconnect")
+
+// streamTimer は MaxStreamDuration が設定されている場合に、その時間が経過すると受信できるチャネルと、
+// タイマーを止める関数を返します。設定されていない場合は何も受信しない nil のチャネルを返します。
+func (s *grpcServer) streamTimer() (<-chan time.Time, func()) {
+	if s.MaxStreamDuration <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTimer(s.MaxStreamDuration)
+	return t.C, func() { t.Stop() }
+}
+
+// errSendTimeout は StreamSendTimeout 以内に送信を終えられなかった ConsumeStream を終了する場合に返すエラーです。
+var errSendTimeout = status.Error(codes.DeadlineExceeded, "client did not receive within the stream send timeout")
+
+// streamCancelKey はストリームのコンテキストに、そのストリームを終了させるキャンセル関数を保持するためのキーです。
+type streamCancelKey struct{}
+
+// cancelableStream は next を呼び出した後に、ストリームのコンテキストをキャンセルできるようにする InTapHandle を返します。
+// トランスポートはこのコンテキストの終了でフロー制御の待ちを打ち切るため、キャンセルすると送信中の Send が戻ります。
+// gRPC のサーバーには InTapHandle を 1 つしか設定できないため、Config.InTapHandle を next として合成します。next は nil でも構いません。
+func cancelableStream(next tap.ServerInHandle) tap.ServerInHandle {
+	return func(ctx context.Context, info *tap.Info) (context.Context, error) {
+		if next != nil {
+			var err error
+			if ctx, err = next(ctx, info); err != nil {
+				return nil, err
+			}
+		}
+		ctx, cancel := context.WithCancelCause(ctx)
+		return context.WithValue(sendTimeoutContext{ctx}, streamCancelKey{}, cancel), nil
+	}
+}
+
+// sendTimeoutContext は errSendTimeout でキャンセルされた場合に、Err が context.DeadlineExceeded を返すコンテキストです。
+// 打ち切られた Send はこのエラーからクライアントへ返すステータスを決めるため、DeadlineExceeded で終了させます。
+type sendTimeoutContext struct {
+	context.Context
+}
+
+// Err は errSendTimeout でキャンセルされた場合に context.DeadlineExceeded を、それ以外は元のエラーを返します。
+func (c sendTimeoutContext) Err() error {
+	if errors.Is(context.Cause(c.Context), errSendTimeout) {
+		return context.DeadlineExceeded
+	}
+	return c.Context.Err()
+}
+
+// sendTimeoutStream は Send が timeout 以内に終わらない場合に、ストリームのコンテキストをキャンセルして送信を打ち切る ConsumeStream です。
+// 送信はハンドラーのゴルーチンで行い、ストリームごとに 1 つのタイマーを Send のたびに再設定して監視します。
+type sendTimeoutStream struct {
+	api.Log_ConsumeStreamServer
+	timeout  time.Duration
+	watchdog *time.Timer
+	expired  atomic.Bool
+}
+
+// withSendTimeout は StreamSendTimeout が設定されている場合に、stream の Send にタイムアウトを設定したストリームを返します。
+// 設定されていない場合や、ストリームのコンテキストをキャンセルできない場合は stream をそのまま返します。
+func (s *grpcServer) withSendTimeout(stream api.Log_ConsumeStreamServer) api.Log_ConsumeStreamServer {
+	if s.StreamSendTimeout <= 0 {
+		return stream
+	}
+	cancel, ok := stream.Context().Value(streamCancelKey{}).(context.CancelCauseFunc)
+	if !ok {
+		return stream
+	}
+	t := &sendTimeoutStream{Log_ConsumeStreamServer: stream, timeout: s.StreamSendTimeout}
+	t.watchdog = time.AfterFunc(s.StreamSendTimeout, func() {
+		t.expired.Store(true)
+		// 打ち切られた Send がステータスを書き込む前に終了の理由を設定しておく。
+		// Send はフロー制御で待っているだけでトレーラーには触れず、トレーラーの設定はトランスポートで排他制御されている
+		stream.SetTrailer(metadata.Pairs(api.StreamEndReasonKey, api.StreamEndSendTimeout))
+		cancel(errSendTimeout)
+	})
+	t.watchdog.Stop()
+	return t
+}
+
+// Send は res を送信し、受信しないクライアントのフロー制御で timeout 以内に送信を終えられない場合は
+// ストリームのコンテキストをキャンセルして送信を打ち切り、errSendTimeout を返します。
+// 終了の理由はキャンセルの前にトレーラーに設定します。
+func (t *sendTimeoutStream) Send(res *api.ConsumeResponse) error {
+	t.watchdog.Reset(t.timeout)
+	err := t.Log_ConsumeStreamServer.Send(res)
+	t.watchdog.Stop()
+	if t.expired.Load() {
+		return errSendTimeout
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	api "github.com/ishisaka/go_distribute/proglog/api/v1"
+)
+
+// defaultThrottleBackoff は ThrottleBackoff が未設定の場合に、待ちが 1 件超えるごとに提案する待機時間です。
+const defaultThrottleBackoff = 10 * time.Millisecond
+
+// writeQueue はログへの書き込みを待っている Produce の数を数え、混雑している場合にクライアントへ返す ThrottleHint を計算します。
+// 待ちの数が threshold を超えた分に比例して、提案する待機時間を長くします。
+type writeQueue struct {
+	depth     atomic.Int64
+	threshold int64
+	backoff   time.Duration
+}
+
+// newWriteQueue は待ちの数が threshold を超えた場合に ThrottleHint を返す writeQueue を作成します。
+// backoff が 0 以下の場合はデフォルト値を使用します。
+func newWriteQueue(threshold int, backoff time.Duration) *writeQueue {
+	if backoff <= 0 {
+		backoff = defaultThrottleBackoff
+	}
+	return &writeQueue{threshold: int64(threshold), backoff: backoff}
+}
+
+// enter は書き込みを待つ Produce を 1 件数え、その時点の待ちの数から計算した ThrottleHint を返します。
+// 待ちの数が threshold 以下の場合は nil を返します。書き込みを終えたら leave を呼び出す必要があります。
+func (q *writeQueue) enter() *api.ThrottleHint {
+	depth := q.depth.Add(1)
+	if depth <= q.threshold {
+		return nil
+	}
+	backoff := q.backoff * time.Duration(depth-q.threshold)
+	return &api.ThrottleHint{
+		// 1 ミリ秒未満に切り捨てられて待機不要と読まれないようにする
+		BackoffMs:  uint64(max(backoff.Milliseconds(), 1)),
+		QueueDepth: uint64(depth),
+	}
+}
+
+// leave は書き込みを終えた Produce を待ちの数から除きます。
+func (q *writeQueue) leave() {
+	q.depth.Add(-1)
+}
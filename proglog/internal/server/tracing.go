@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opencensus.io/trace"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/bridge/opencensus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	// otlpFlushInterval は溜めたスパンを TracingEndpoint のコレクターへ送信する間隔です。
+	otlpFlushInterval = time.Second
+	// otlpMaxQueuedSpans は送信を待つスパンの上限で、コレクターに届かない間はそれを超えたスパンを破棄します。
+	otlpMaxQueuedSpans = 2048
+	// otlpShutdownTimeout は Shutdown が閉じられたときに、送信待ちのスパンを送信し終えるまで待つ時間の上限です。
+	otlpShutdownTimeout = 10 * time.Second
+	// otlpServiceName はスパンのリソースに service.name として設定する名前です。
+	otlpServiceName = "proglog"
+)
+
+// registerTraceExporters は TraceExporter を OpenCensus に登録するか、TracingEndpoint に OTLP/HTTP で送信する
+// OpenTelemetry のトレーサーへ OpenCensus のスパンを橋渡しします。
+// TraceExporter の登録はプロセス全体で共有されるため、Shutdown が閉じられたら登録を解除します。
+// TracingEndpoint の場合は Shutdown が閉じられたら残りのスパンを送信してから止めます。
+// OpenCensus のトレーサーは同期せずに読み出されるため、実行中の RPC と競合しないように橋渡しは元に戻しません。
+// どちらも設定されていない場合は何もしません。Shutdown が設定されていない場合は止められないため、登録せずにエラーを返します。
+func registerTraceExporters(config *Config) error {
+	if config.TraceExporter == nil && config.TracingEndpoint == "" {
+		return nil
+	}
+	if config.Shutdown == nil {
+		return errors.New("shutdown is required when TraceExporter or TracingEndpoint is set")
+	}
+	if config.TraceExporter != nil && config.TracingEndpoint != "" {
+		// 橋渡しした後のスパンは OpenCensus のエクスポーターに渡らない
+		return errors.New("TraceExporter and TracingEndpoint cannot be set together")
+	}
+	if config.TraceExporter != nil {
+		trace.RegisterExporter(config.TraceExporter)
+		go func() {
+			<-config.Shutdown
+			trace.UnregisterExporter(config.TraceExporter)
+		}()
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(config.TracingEndpoint),
+	)
+	if err != nil {
+		return err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithBatchTimeout(otlpFlushInterval),
+			sdktrace.WithMaxQueueSize(otlpMaxQueuedSpans),
+		),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", otlpServiceName),
+		)),
+	)
+	opencensus.InstallTraceBridge(opencensus.WithTracerProvider(provider))
+	go func() {
+		<-config.Shutdown
+		ctx, cancel := context.WithTimeout(context.Background(), otlpShutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			zap.L().Named("otlp").Warn("failed to export spans",
+				zap.String("endpoint", config.TracingEndpoint),
+				zap.Error(err),
+			)
+		}
+	}()
+	return nil
+}
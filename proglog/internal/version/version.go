@@ -0,0 +1,15 @@
+/*
+ビルド情報を保持する。値はビルド時に ldflags で埋め込む。
+
+	go build -ldflags "-X github.com/ishisaka/go_distribute/proglog/internal/version.Version=v1.0.0 \
+		-X github.com/ishisaka/go_distribute/proglog/internal/version.Commit=$(git rev-parse HEAD)"
+*/
+
+package version
+
+var (
+	// Version はビルドしたバージョンです。
+	Version = "dev"
+	// Commit はビルド元の git コミットです。
+	Commit = "unknown"
+)